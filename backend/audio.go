@@ -10,12 +10,11 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"os"
-	"os/exec"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/jonas747/ogg"
+	"github.com/layeh/gopus"
 )
 
 func waitForReady(conn *discordgo.VoiceConnection) error {
@@ -37,56 +36,97 @@ func waitForReady(conn *discordgo.VoiceConnection) error {
 
 const (
 	sampleRate = 48000
-	DLBitrate  = "48000K"
 	channels   = 2
 	frameSize  = 960
 	maxBytes   = frameSize * 4
+
+	// frameDuration is how much audio a single opus frame holds.
+	frameDuration = time.Second * frameSize / sampleRate
 )
 
-// PlayLoop manages the Player, grabbing tracks off the Q and decoding them.
+// PlayLoop manages the Player, grabbing tracks off the Q and decoding them
+// into the player's Layer. done is called once the PlayLoop has exited.
 //
 // PlayLoop handles various signals, like file skipping.
-func (p *Player) PlayLoop(msg func(string) error, joinVoice func() (*discordgo.VoiceConnection, error)) {
+func (p *Player) PlayLoop(msg func(string) error, done func()) {
 	p.Lock()
 	p.playerOn = true
-	// Using extra channels prevents ffmpeg stutters from disupting our output.
-	// Why 64? I heard it's 1 stacks worth.
-	audio := make(chan []byte, 64)
+	audio := p.out.frames
 	p.Unlock()
 	defer func() {
 		p.Lock()
 		p.playerOn = false
+		p.paused = false
+		p.idle = false
 		p.Unlock()
+
+		p.publish(EventTrackChanged)
+		if done != nil {
+			done()
+		}
 	}()
 
 	logErr := func(err error) {
 		log.Println("PlayLoop: error: ", err)
 		msg(fmt.Sprintf("uh oh: %v", err))
+		if p.notify != nil {
+			p.notify(Event{Type: EventError, Err: err})
+		}
 	}
 
+	// Stop prefetching only once ctx is cancelled, so nothing new is started.
+	defer p.dropNext()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start toDiscord goroutine & ensure it dies correctly
-	go func() {
-		if err := p.toDiscord(ctx, audio, joinVoice); err != nil {
-			logErr(err)
-		}
-	}()
+	// tail is the end of the last track, to be crossfaded into the next one.
+	var tail [][]int16
 
 	for {
+		// Checked under lock so that anything queued from here on sees
+		// we're idle and wakes us up.
+		p.Lock()
 		t, _, err := p.q.Current()
-		if err == ErrNoSongs {
-			time.Sleep(500 * time.Millisecond)
+		idle, wasIdle := err == ErrNoSongs, p.idle
+		p.idle = idle
+		p.Unlock()
+
+		if idle && !wasIdle {
+			p.publish(EventTrackChanged)
+		}
+		if err == ErrNoSongs && len(tail) > 0 {
+			// Nothing to crossfade into after all, let it play out.
+			sig, _, _ := p.DecodeTrackLoop(ctx, audio, nil, tail)
+			tail = nil
+			if sig.Type == SigTypeStop {
+				p.drain(audio)
+				return
+			}
+			continue
+		} else if err == ErrNoSongs {
+			// Wait for something to play, we're sent a reload once there is.
+			if sig := <-p.signal; sig.Type == SigTypeStop {
+				return
+			}
 			continue
 		} else if err != nil {
 			logErr(err)
 			return
 		}
 
-		log.Println("PlayLoop: playing track =", t)
+		offset := p.startTrack()
+		log.Printf("PlayLoop: playing track = %v from %v", t, offset)
+		p.publish(EventTrackChanged)
 
-		sig, err := p.DecodeTrackLoop(ctx, audio, t.CMD())
+		src := p.takeNext(t, offset)
+		if src == nil {
+			src = openSource(ctx, t, offset, p.Normalize(), nil)
+		}
+		go p.prefetch(ctx, src)
+
+		var sig PlayerSignal
+		sig, tail, err = p.DecodeTrackLoop(ctx, audio, src, tail)
+		src.Stop()
 		if err != nil {
 			logErr(err)
 			return
@@ -98,9 +138,13 @@ func (p *Player) PlayLoop(msg func(string) error, joinVoice func() (*discordgo.V
 			log.Println("got clear")
 			continue
 		case SigTypeSkip:
-			p.q.SkipNext()
+			p.queue().SkipNext()
+			continue
+		case SigTypeEnd:
+			p.queue().Finish()
 			continue
 		case SigTypeStop:
+			p.drain(audio)
 			return
 		case SigTypeErr:
 			logErr(sig.Err)
@@ -115,43 +159,272 @@ func (p *Player) PlayLoop(msg func(string) error, joinVoice func() (*discordgo.V
 	}
 }
 
-// DecodeTrack decodes a track (using it's URL) and sends it into the
-// pcm channel.
+// DecodeTrack sends the decoded frames of a track into the audio channel.
+//
+// tail is the end of the previous track, which is crossfaded into the start
+// of this one. If the queue carries on after this track, the end of it is
+// returned in the same way. With no src, the tail is simply played out.
 //
 // DecodeTrackLoop is also responsible for handling signals like
 // - reload / skip / etc
 // since it's controlling PCM input.
-func (p *Player) DecodeTrackLoop(ctx context.Context, audio chan []byte, f *exec.Cmd) (PlayerSignal, error) {
-	log.Println("DecodeTrackLoop: starting ", f.Args)
+func (p *Player) DecodeTrackLoop(ctx context.Context, audio chan []int16, src *trackSource, tail [][]int16) (PlayerSignal, [][]int16, error) {
+	crossfade := durationFrames(p.Crossfade())
+	fadeOut := durationFrames(fadeOutDuration)
+
+	// We hold back enough decoded audio to fade out, or to crossfade into
+	// the next track, before sending it on.
+	lookahead := crossfade
+	if lookahead < fadeOut {
+		lookahead = fadeOut
+	}
+
+	type frame struct {
+		pcm []int16
+		// own is set if the frame is part of this track, and counts towards
+		// its position.
+		own bool
+	}
+	held := []frame{}
+
+	fadeTail := func(i int, pcm []int16) []int16 {
+		fadeFrame(tail[i], 1-float64(i)/float64(len(tail)), 1-float64(i+1)/float64(len(tail)))
+		if pcm == nil {
+			return tail[i]
+		}
+		fadeFrame(pcm, float64(i)/float64(len(tail)), float64(i+1)/float64(len(tail)))
+		mixFrame(pcm, tail[i])
+		return pcm
+	}
+	mixed := 0
+
+	// finishTail holds whatever is left of the tail once this track has
+	// run out, it might be shorter than the crossfade.
+	finishTail := func() {
+		for ; mixed < len(tail); mixed++ {
+			held = append(held, frame{pcm: fadeTail(mixed, nil)})
+		}
+	}
+
+	var frames <-chan []int16
+	keep := lookahead
+	if src != nil {
+		frames = src.frames
+	} else {
+		finishTail()
+		keep = 0
+	}
+
+	for {
+		// Once we've run out of frames, only the next crossfade is kept.
+		if frames == nil && len(held) <= keep {
+			out := [][]int16{}
+			for _, f := range held {
+				out = append(out, f.pcm)
+			}
+			return SigEnd, out, nil
+		}
+
+		// Only decode more once we've caught up on sending.
+		in, out := frames, audio
+		if len(held) > lookahead {
+			in = nil
+		}
+		if len(held) <= keep {
+			out = nil
+		}
+		var next frame
+		if len(held) > 0 {
+			next = held[0]
+		}
+
+		select {
+		case <-ctx.Done():
+			// We've been told to finish up here.
+			return SigStop, nil, nil
+		case sig := <-p.signal:
+			switch sig.Type {
+			case SigTypePause:
+				if in, stop := p.waitPaused(ctx); stop {
+					return in, nil, nil
+				}
+				continue
+			case SigTypeResume:
+				continue
+			}
+
+			// Fade out over what we've already decoded rather than cutting
+			// the track off mid frame.
+			if len(held) > fadeOut {
+				held = held[:fadeOut]
+			}
+			frames := [][]int16{}
+			for _, f := range held {
+				frames = append(frames, f.pcm)
+			}
+			fadeFrames(frames, 1, 0)
+			for _, pcm := range frames {
+				select {
+				case audio <- pcm:
+				case <-ctx.Done():
+					return SigStop, nil, nil
+				}
+			}
+			return sig, nil, nil
+		case pcm, ok := <-in:
+			if !ok {
+				if src.err != nil {
+					return SigStop, nil, src.err
+				}
+				finishTail()
+				frames = nil
+
+				keep = 0
+				if _, err := p.queue().Next(); err == nil {
+					keep = crossfade
+				}
+				continue
+			}
+
+			if mixed < len(tail) {
+				pcm = fadeTail(mixed, pcm)
+				mixed++
+			}
+			held = append(held, frame{pcm: pcm, own: true})
+		case out <- next.pcm:
+			held = held[1:]
+			if next.own {
+				p.Lock()
+				p.frames++
+				p.Unlock()
+			}
+		}
+	}
+}
+
+// drain gives the audio channel a moment to empty out, so fading out on
+// stop is heard before we leave.
+func (p *Player) drain(audio chan []int16) {
+	deadline := time.Now().Add(time.Second)
+	for len(audio) > 0 && time.Now().Before(deadline) {
+		time.Sleep(frameDuration)
+	}
+}
+
+// prefetchFrames is how much of a track we decode ahead of what's playing.
+const prefetchFrames = int(time.Second * 10 / frameDuration)
+
+// trackSource decodes a track ahead of playback, into a buffer of
+// prefetchFrames.
+//
+// Tracks played from the start are measured as they're decoded, and their
+// loudness is kept with the cached track so later plays can be normalized.
+type trackSource struct {
+	track  Track
+	frames chan []int16
+	// done is closed once the track has been read through (or failed).
+	done   chan struct{}
+	cancel context.CancelFunc
+	// after holds off downloading the track until it's closed, if it's set.
+	after <-chan struct{}
+
+	// gain is applied to every frame, it's 1 unless we're normalizing.
+	gain float64
+
+	// err is set before frames is closed if the track couldn't be read.
+	err error
+}
+
+// openSource starts decoding a track. If after is set and the track has to
+// be downloaded, it waits for after to be closed before starting.
+func openSource(ctx context.Context, t Track, offset time.Duration, normalize bool, after <-chan struct{}) *trackSource {
+	ctx, cancel := context.WithCancel(ctx)
+	src := &trackSource{
+		track:  t,
+		frames: make(chan []int16, prefetchFrames),
+		done:   make(chan struct{}),
+		cancel: cancel,
+		after:  after,
+		gain:   1,
+	}
+
+	if normalize {
+		if db, ok := trackCache.Gain(t); ok {
+			src.gain = dbToGain(db)
+		}
+	}
+
+	go src.run(ctx, offset)
+	return src
+}
+
+func (src *trackSource) run(ctx context.Context, offset time.Duration) {
 	const ffmpegBuffer = 16384 * 4
+	defer close(src.done)
+	defer close(src.frames)
+
+	dec, err := gopus.NewDecoder(sampleRate, channels)
+	if err != nil {
+		src.err = err
+		return
+	}
+
+	var meter *loudnessMeter
+	if offset == 0 {
+		meter = newLoudnessMeter()
+	}
+
+	if src.after != nil && !trackCache.Cached(src.track) {
+		select {
+		case <-src.after:
+		case <-ctx.Done():
+			return
+		}
+	}
 
-	out, err := f.StdoutPipe()
+	stream, err := trackCache.Open(ctx, src.track, offset)
 	if err != nil {
-		return SigStop, err
+		src.err = err
+		return
 	}
-	f.Stderr = os.Stderr
 
+	finished := false
 	defer func() {
-		if f.Process != nil {
-			if err := f.Process.Kill(); err != nil {
-				log.Printf("DecodeTrackLoop: error killing ffpmeg: %v", err)
-			}
+		if !finished {
+			stream.Kill()
+			return
+		}
+
+		// We read the whole track, so anything that went wrong is real.
+		if err := stream.Close(); err != nil {
+			log.Printf("trackSource: %v", err)
+			return
+		}
+
+		// The track is in the cache now, if it's going to be.
+		if meter == nil {
+			return
+		}
+		if db, ok := meter.Gain(); ok {
+			trackCache.SetGain(src.track, db)
 		}
 	}()
 
-	in := bufio.NewReaderSize(out, ffmpegBuffer)
-	if err := f.Start(); err != nil {
-		return SigStop, err
-	}
+	in := bufio.NewReaderSize(stream, ffmpegBuffer)
 	decoder := ogg.NewPacketDecoder(ogg.NewDecoder(in))
 
 	skip := 2
 	for {
 		pkt, _, err := decoder.Decode()
-		if err != nil && err != io.EOF {
-			return SigStop, fmt.Errorf("error reading ogg: %w", err)
+		if ctx.Err() != nil {
+			// Killed streams end early, that's on us.
+			return
 		} else if err == io.EOF {
-			return SigSkip, nil
+			finished = true
+			return
+		} else if err != nil {
+			src.err = fmt.Errorf("error reading ogg: %w", err)
+			return
 		}
 
 		if skip > 0 {
@@ -159,53 +432,133 @@ func (p *Player) DecodeTrackLoop(ctx context.Context, audio chan []byte, f *exec
 			continue
 		}
 
+		pcm, err := decodeFrame(dec, pkt)
+		if err != nil {
+			log.Printf("trackSource: skipping bad packet: %v", err)
+			continue
+		}
+
+		if meter != nil {
+			meter.Add(pcm)
+		}
+		if src.gain != 1 {
+			fadeFrame(pcm, src.gain, src.gain)
+		}
+
 		select {
+		case src.frames <- pcm:
 		case <-ctx.Done():
-			// We've been told to finish up here.
-			return SigStop, nil
-		case in := <-p.signal:
-			return in, nil
-		case audio <- pkt:
+			return
 		}
 	}
 }
 
-// toDiscord is responsible for handling the discord audio connection
-func (p *Player) toDiscord(ctx context.Context, audio chan []byte,
-	joinVoice func() (*discordgo.VoiceConnection, error)) error {
-	conn, err := joinVoice()
+// Stop abandons whatever is left of the track.
+func (src *trackSource) Stop() {
+	src.cancel()
+}
+
+// prefetch gets the next track in the queue ready while src plays, so it's
+// ready to go the moment src finishes.
+//
+// The next track is picked, and played from the cache if it's there, as soon
+// as src starts. Downloading it waits for src to be read through, so we only
+// hold one download open at a time and youtube doesn't drop a stalled
+// connection.
+func (p *Player) prefetch(ctx context.Context, src *trackSource) {
+	p.prepareNext(ctx, src.done)
+
+	select {
+	case <-src.done:
+	case <-ctx.Done():
+		return
+	}
+
+	// The queue might have changed while src was playing.
+	p.prepareNext(ctx, nil)
+}
+
+// prepareNext opens the next track in the queue, unless it's already open,
+// holding off any download until after is closed.
+func (p *Player) prepareNext(ctx context.Context, after <-chan struct{}) {
+	next, err := p.queue().Next()
 	if err != nil {
-		return err
+		return
 	}
-	defer conn.Disconnect()
 
-	// conn.LogLevel = discordgo.LogDebug // uncomment if stuff starts acting weird
-	if err := waitForReady(conn); err != nil {
-		return err
+	p.Lock()
+	defer p.Unlock()
+
+	if ctx.Err() != nil || !p.playerOn {
+		return
+	}
+	if p.next != nil {
+		if p.next.track.URL == next.URL {
+			return
+		}
+		p.next.Stop()
 	}
+	p.next = openSource(ctx, next, 0, p.normalize, after)
+}
+
+// takeNext returns the prefetched source if it's for the track t starting
+// from offset. Anything prefetched that isn't coming up next is thrown away.
+func (p *Player) takeNext(t Track, offset time.Duration) *trackSource {
+	upcoming, upcomingErr := p.queue().Next()
+
+	p.Lock()
+	defer p.Unlock()
 
-	if err := conn.Speaking(true); err != nil {
-		return err
+	src := p.next
+	if src == nil {
+		return nil
 	}
 
-	var in []byte
+	if offset == 0 && src.track.URL == t.URL {
+		p.next = nil
+		return src
+	}
+
+	// We might just be seeking, in which case it's still good.
+	if upcomingErr != nil || src.track.URL != upcoming.URL {
+		p.next = nil
+		src.Stop()
+	}
+	return nil
+}
+
+func (p *Player) dropNext() {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.next != nil {
+		p.next.Stop()
+		p.next = nil
+	}
+}
+
+// waitPaused holds playback until we're told to resume. We simply stop
+// reading from the decoder, so ffmpeg and the voice connection are left
+// untouched and playback continues where it left off.
+//
+// Any signal other than a resume ends the pause and is returned, along with
+// true, so it can be handled by the caller.
+func (p *Player) waitPaused(ctx context.Context) (PlayerSignal, bool) {
+	p.setPaused(true)
+	defer p.setPaused(false)
+
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
-		case in = <-audio:
-		case <-time.After(time.Second * 120):
-			// haven't got a frame in a long time
-			// assume everything is okay and we are supposed to leave now.
-			// this doubles as an auto timeout.
-			return nil
-		}
-
-		select {
-		case conn.OpusSend <- in:
-		case <-time.After(time.Second):
-			// We haven't been able to send a frame in a second, assume something is fucked
-			return errors.New("couldn't send audio to discord")
+			return SigStop, true
+		case in := <-p.signal:
+			switch in.Type {
+			case SigTypePause:
+				continue
+			case SigTypeResume:
+				return in, false
+			}
+			return in, true
 		}
 	}
 }
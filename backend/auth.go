@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// linkTTL is how long a link from ;ui can be used for.
+	linkTTL = 10 * time.Minute
+	// loginTTL is how long the cookie a link is exchanged for lasts.
+	loginTTL = 7 * 24 * time.Hour
+	// memberTTL is how long we trust that someone is still in a guild
+	// before asking discord again.
+	memberTTL = time.Minute
+
+	cookieName = "dndmusic"
+)
+
+var (
+	ErrNotLoggedIn    = errors.New("you're not logged in, use the link from the ui command")
+	ErrLinkInvalid    = errors.New("that link isn't valid, ask the bot for a new one with the ui command")
+	ErrLinkExpired    = errors.New("that link has expired, ask the bot for a new one with the ui command")
+	ErrLinkUsed       = errors.New("that link has already been used, ask the bot for a new one with the ui command")
+	ErrNotGuildMember = errors.New("you're no longer a member of that server")
+	ErrLoginExpired   = errors.New("your login has expired, use the link from the ui command again")
+)
+
+// WebUser is who a web ui client is logged in as.
+type WebUser struct {
+	GuildID string
+	UserID  string
+}
+
+// memberCheck is what discord last told us about someone in a guild.
+type memberCheck struct {
+	// member is nil if they aren't in the guild.
+	member  *Member
+	checked time.Time
+}
+
+// Auth lets people into the web ui.
+//
+// The ui command hands out signed links that only work once, and only for a
+// little while. Following one swaps it for a cookie that says which guild and
+// user it was for, which is checked again on every request.
+type Auth struct {
+	// key signs links.
+	key     []byte
+	cookies *sessions.CookieStore
+	// member looks a user up in a guild, it's nil if they aren't in it.
+	member func(guildID, userID string) (*Member, error)
+
+	sync.Mutex
+	// used is the nonces of links that have been used, until they expire.
+	used    map[string]time.Time
+	members map[WebUser]memberCheck
+}
+
+// NewAuth makes an Auth from a 64 byte secret, see LoadAuthKey. Cookies are
+// only sent over https if secure is set.
+func NewAuth(secret []byte, secure bool, member func(guildID, userID string) (*Member, error)) *Auth {
+	// Links and cookies are signed with different keys, so one can never be
+	// passed off as the other.
+	linkKey := sha256.Sum256(append([]byte("links:"), secret...))
+
+	cookies := sessions.NewCookieStore(secret[:32], secret[32:64])
+	cookies.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(loginTTL.Seconds()),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	return &Auth{
+		key:     linkKey[:],
+		cookies: cookies,
+		member:  member,
+		used:    map[string]time.Time{},
+		members: map[WebUser]memberCheck{},
+	}
+}
+
+// LoadAuthKey reads the secret that links and cookies are signed with,
+// making one if there isn't one yet. It's kept so logins survive restarts.
+func LoadAuthKey(path string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(path)
+	if err == nil {
+		if len(secret) != 64 {
+			return nil, fmt.Errorf("auth key %s should be 64 bytes, not %d", path, len(secret))
+		}
+		return secret, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret = make([]byte, 64)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(path, secret, 0600); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// randomToken is n random bytes, in hex.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// The system is in no state to be handing out logins.
+		log.Fatalf("randomToken: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (a *Auth) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Token makes a token for a login link, for a user of a guild.
+func (a *Auth) Token(guildID, userID string) string {
+	return a.token(guildID, userID, time.Now().Add(linkTTL))
+}
+
+func (a *Auth) token(guildID, userID string, expires time.Time) string {
+	payload := strings.Join([]string{guildID, userID, strconv.FormatInt(expires.Unix(), 10), randomToken(16)}, ":")
+	payload = base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return payload + "." + a.sign(payload)
+}
+
+// Redeem checks the token of a login link and uses it up.
+func (a *Auth) Redeem(token string) (WebUser, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return WebUser{}, ErrLinkInvalid
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(a.sign(payload))) {
+		return WebUser{}, ErrLinkInvalid
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return WebUser{}, ErrLinkInvalid
+	}
+	fields := strings.Split(string(raw), ":")
+	if len(fields) != 4 {
+		return WebUser{}, ErrLinkInvalid
+	}
+	unix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return WebUser{}, ErrLinkInvalid
+	}
+	expires, nonce := time.Unix(unix, 0), fields[3]
+
+	now := time.Now()
+	if now.After(expires) {
+		return WebUser{}, ErrLinkExpired
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	for n, exp := range a.used {
+		if now.After(exp) {
+			delete(a.used, n)
+		}
+	}
+	if _, ok := a.used[nonce]; ok {
+		return WebUser{}, ErrLinkUsed
+	}
+	a.used[nonce] = expires
+
+	return WebUser{GuildID: fields[0], UserID: fields[1]}, nil
+}
+
+// User is who a request is logged in as.
+func (a *Auth) User(r *http.Request) (WebUser, error) {
+	u, _, err := a.login(r)
+	return u, err
+}
+
+// login is who a request is logged in as, and until when. The cookie is only
+// checked once for a websocket, so it has to know when to stop trusting it.
+func (a *Auth) login(r *http.Request) (WebUser, time.Time, error) {
+	sesh, err := a.cookies.Get(r, cookieName)
+	if err != nil || sesh.IsNew {
+		return WebUser{}, time.Time{}, ErrNotLoggedIn
+	}
+
+	guildID, _ := sesh.Values["guild"].(string)
+	userID, _ := sesh.Values["user"].(string)
+	if guildID == "" || userID == "" {
+		return WebUser{}, time.Time{}, ErrNotLoggedIn
+	}
+
+	// Cookies from before logins were dated can't be older than the
+	// cookie store lets them be.
+	expires := time.Now().Add(loginTTL)
+	if unix, ok := sesh.Values["expires"].(int64); ok {
+		expires = time.Unix(unix, 0)
+	}
+	if time.Now().After(expires) {
+		return WebUser{}, time.Time{}, ErrLoginExpired
+	}
+	return WebUser{GuildID: guildID, UserID: userID}, expires, nil
+}
+
+// Check makes sure a user is still in the guild they logged in to, and finds
+// out what they're allowed to do there.
+func (a *Auth) Check(u WebUser) (Member, error) {
+	a.Lock()
+	c, ok := a.members[u]
+	a.Unlock()
+
+	if !ok || time.Since(c.checked) > memberTTL {
+		member, err := a.member(u.GuildID, u.UserID)
+		if err != nil {
+			return Member{}, err
+		}
+		c = memberCheck{member: member, checked: time.Now()}
+
+		a.Lock()
+		a.members[u] = c
+		a.Unlock()
+	}
+
+	if c.member == nil {
+		return Member{}, ErrNotGuildMember
+	}
+	return *c.member, nil
+}
+
+// Session finds the session of the guild a user logged in to, as long as
+// they're still allowed in.
+func (a *Auth) Session(u WebUser, ongoingSessions *SessionManager) (*Session, Member, error) {
+	mem, err := a.Check(u)
+	if err != nil {
+		return nil, Member{}, err
+	}
+	gs, err := ongoingSessions.FromGuild(u.GuildID)
+	return gs, mem, err
+}
+
+// loginHandler swaps the token of a login link for a cookie, then sends them
+// on to the web ui.
+func (a *Auth) loginHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := a.Redeem(r.URL.Query().Get("t"))
+		if err != nil {
+			writeError("/login", w, r, err, http.StatusForbidden)
+			return
+		}
+
+		if _, err := a.Check(u); err != nil {
+			writeError("/login", w, r, err, http.StatusForbidden)
+			return
+		}
+
+		// Start from a fresh cookie, rather than whatever was logged in
+		// before.
+		sesh := sessions.NewSession(a.cookies, cookieName)
+		opts := *a.cookies.Options
+		sesh.Options = &opts
+		sesh.Values["guild"] = u.GuildID
+		sesh.Values["user"] = u.UserID
+		sesh.Values["expires"] = time.Now().Add(loginTTL).Unix()
+		if err := sesh.Save(r, w); err != nil {
+			writeError("/login", w, r, err, http.StatusInternalServerError)
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+)
+
+func TestLoginLinks(t *testing.T) {
+	auth := NewAuth(make([]byte, 64), false, nil)
+
+	token := auth.Token("guild", "user")
+	u, err := auth.Redeem(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (WebUser{GuildID: "guild", UserID: "user"}); u != want {
+		t.Errorf("Redeem = %+v, want %+v", u, want)
+	}
+
+	if _, err := auth.Redeem(token); !errors.Is(err, ErrLinkUsed) {
+		t.Errorf("redeeming a link twice: got %v, want %v", err, ErrLinkUsed)
+	}
+
+	other := make([]byte, 64)
+	other[0] = 1
+	for name, token := range map[string]string{
+		"tampered":    strings.Replace(auth.Token("guild", "user"), "Z", "Y", 1) + "x",
+		"unsigned":    strings.Split(auth.Token("guild", "user"), ".")[0],
+		"another key": NewAuth(other, false, nil).Token("guild", "user"),
+		"empty":       "",
+	} {
+		if _, err := auth.Redeem(token); !errors.Is(err, ErrLinkInvalid) {
+			t.Errorf("%s: got %v, want %v", name, err, ErrLinkInvalid)
+		}
+	}
+
+	expired := auth.token("guild", "user", time.Now().Add(-time.Second))
+	if _, err := auth.Redeem(expired); !errors.Is(err, ErrLinkExpired) {
+		t.Errorf("expired link: got %v, want %v", err, ErrLinkExpired)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	web := newTestWeb(t, testSessions())
+	member := WebUser{GuildID: "guild", UserID: "user"}
+	web.setMember(member, &Member{UserID: "user"})
+
+	jar, res := web.login(t, web.auth.Token("guild", "user"))
+	if res.StatusCode != http.StatusSeeOther {
+		t.Fatalf("login: status %d, want %d", res.StatusCode, http.StatusSeeOther)
+	}
+	cookies := res.Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Errorf("login set cookies %v, want one HttpOnly cookie", cookies)
+	}
+
+	// The cookie lets them in.
+	c := web.dial(t, jar, "v=1")
+	var status wsStatus
+	if err := json.Unmarshal(readEnvelope(t, c, "Snapshot").Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "Verified" {
+		t.Errorf("snapshot status = %#v, want Verified", status.Status)
+	}
+
+	// Links only work for people in the guild.
+	if _, res := web.login(t, web.auth.Token("guild", "stranger")); res.StatusCode != http.StatusForbidden {
+		t.Errorf("login of someone not in the guild: status %d, want %d", res.StatusCode, http.StatusForbidden)
+	}
+
+	// Without a cookie, nothing is let through.
+	anon := web.dial(t, nil, "v=1")
+	anon.WriteJSON(wsEnvelope{V: 1, ID: "1", Type: "MusicSkip"})
+	var wsErr wsError
+	if err := json.Unmarshal(readEnvelope(t, anon, wsErrorType).Payload, &wsErr); err != nil {
+		t.Fatal(err)
+	}
+	if wsErr.Code != wsErrForbidden {
+		t.Errorf("request without logging in: got %+v, want code %s", wsErr, wsErrForbidden)
+	}
+
+	// Once they leave the guild, they're stopped at their next request.
+	web.setMember(member, nil)
+	c.WriteJSON(wsEnvelope{V: 1, ID: "2", Type: "MusicSkip"})
+	if err := json.Unmarshal(readEnvelope(t, c, wsErrorType).Payload, &wsErr); err != nil {
+		t.Fatal(err)
+	}
+	if wsErr.Code != wsErrForbidden {
+		t.Errorf("request after leaving the guild: got %+v, want code %s", wsErr, wsErrForbidden)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Error("connection is still open after leaving the guild")
+	}
+}
+
+// loginUntil makes the cookies of a login that lasts until expires.
+func (web *testWeb) loginUntil(t *testing.T, u WebUser, expires time.Time) http.CookieJar {
+	t.Helper()
+
+	sesh := sessions.NewSession(web.auth.cookies, cookieName)
+	opts := *web.auth.cookies.Options
+	sesh.Options = &opts
+	sesh.Values["guild"] = u.GuildID
+	sesh.Values["user"] = u.UserID
+	sesh.Values["expires"] = expires.Unix()
+	rec := httptest.NewRecorder()
+	if err := sesh.Save(httptest.NewRequest(http.MethodGet, "/", nil), rec); err != nil {
+		t.Fatal(err)
+	}
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	site, _ := url.Parse(web.URL)
+	jar.SetCookies(site, rec.Result().Cookies())
+	return jar
+}
+
+func TestWebsocketHangsUp(t *testing.T) {
+	sessions := testSessions()
+	gs, _ := sessions.FromGuild("guild")
+	web := newTestWeb(t, sessions)
+	member := WebUser{GuildID: "guild", UserID: "user"}
+	web.setMember(member, &Member{UserID: "user"})
+
+	// hungUp checks that a client is told why, and nothing else, before
+	// being hung up on.
+	hungUp := func(c *websocket.Conn, what string) {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var env wsEnvelope
+		if err := c.ReadJSON(&env); err != nil {
+			t.Fatalf("%s: %v", what, err)
+		}
+		var wsErr wsError
+		json.Unmarshal(env.Payload, &wsErr)
+		if env.Type != wsErrorType || wsErr.Code != wsErrForbidden {
+			t.Errorf("%s: got %s %+v, want a %s error", what, env.Type, wsErr, wsErrForbidden)
+		}
+		if _, _, err := c.ReadMessage(); err == nil {
+			t.Errorf("%s: connection is still open", what)
+		}
+	}
+
+	// Someone who leaves the guild stops getting pushed changes, even if
+	// they never ask for anything.
+	jar, _ := web.login(t, web.auth.Token("guild", "user"))
+	c := web.dial(t, jar, "v=1")
+	readEnvelope(t, c, "Snapshot")
+	web.setMember(member, nil)
+	gs.SetVolume(20)
+	hungUp(c, "pushing to someone who left the guild")
+
+	// Logins run out on connections that are already open.
+	web.setMember(member, &Member{UserID: "user"})
+	expires := time.Now().Add(time.Second)
+	c = web.dial(t, web.loginUntil(t, member, expires), "v=1")
+	readEnvelope(t, c, "Snapshot")
+	time.Sleep(time.Until(expires.Truncate(time.Second).Add(time.Second)))
+	gs.SetVolume(30)
+	hungUp(c, "pushing after the login expired")
+
+	// Expired logins aren't let in at all.
+	c = web.dial(t, web.loginUntil(t, member, time.Now().Add(-time.Minute)), "v=1")
+	hungUp(c, "connecting with an expired login")
+}
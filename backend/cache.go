@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Initalized in main(), see initCache. A nil cache streams every track.
+var trackCache *TrackCache = nil
+
+// audioStream is an Ogg/Opus stream of a single track.
+type audioStream interface {
+	io.Reader
+
+	// Close is called once the stream has been read to io.EOF, and reports
+	// whether anything went wrong producing it.
+	Close() error
+
+	// Kill abandons the stream before it's finished.
+	Kill()
+}
+
+// fileStream plays a track straight from the cache.
+type fileStream struct {
+	*os.File
+}
+
+func (f fileStream) Kill() {
+	f.File.Close()
+}
+
+// cacheEntry is a single encoded track kept on disk.
+type cacheEntry struct {
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	File     string    `json:"file"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+
+	// Gain normalizes the track's loudness, in dB. It's measured the first
+	// time the track plays through.
+	Gain *float64 `json:"gain,omitempty"`
+}
+
+// CacheStats describes what's in a TrackCache.
+type CacheStats struct {
+	Tracks  int
+	Size    int64
+	MaxSize int64
+	Hits    int
+	Misses  int
+}
+
+// TrackCache keeps the encoded Opus of tracks we've played on disk, so tracks
+// we play again (and again, ambient playlists loop for hours) don't have to
+// be streamed from youtube every time.
+//
+// Tracks are keyed by their URL and the least recently used tracks are
+// evicted once the cache grows past maxSize. Like our other caches the index
+// is a JSON file that's rewritten whenever it changes, except that playing a
+// cached track only marks it as used, that's written out with the next change
+// or by Flush.
+type TrackCache struct {
+	sync.Mutex
+
+	dir     string
+	index   string
+	maxSize int64
+
+	entries map[string]*cacheEntry
+	// dirty is set when entries have been used since the index was saved.
+	dirty  bool
+	hits   int
+	misses int
+}
+
+// NewTrackCache opens the cache stored in dir, with its index at index.
+func NewTrackCache(dir, index string, maxSize int64) (*TrackCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("NewTrackCache: %w", err)
+	}
+
+	c := &TrackCache{
+		dir:     dir,
+		index:   index,
+		maxSize: maxSize,
+		entries: map[string]*cacheEntry{},
+	}
+
+	if err := loadJSON(index, &c.entries); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("NewTrackCache: loadJSON(%s): %w", index, err)
+	}
+
+	// Fills that were going when we last stopped will never finish.
+	stale, _ := filepath.Glob(path.Join(dir, "fill-*"))
+	for _, p := range stale {
+		if err := os.Remove(p); err != nil {
+			log.Printf("TrackCache: %v", err)
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Forget anything that was removed behind our back.
+	for url, e := range c.entries {
+		if _, err := os.Stat(c.path(e)); err != nil {
+			delete(c.entries, url)
+		}
+	}
+	c.evict()
+
+	return c, c.save()
+}
+
+func (c *TrackCache) path(e *cacheEntry) string {
+	return path.Join(c.dir, e.File)
+}
+
+func cacheFileName(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return hex.EncodeToString(sum[:]) + ".ogg"
+}
+
+// save writes the index to disk, the lock must be held.
+func (c *TrackCache) save() error {
+	if err := writeJSON(c.index, c.entries); err != nil {
+		return fmt.Errorf("writeJSON(trackCache): %w", err)
+	}
+	c.dirty = false
+	return nil
+}
+
+// Flush saves when tracks were last used, if that's changed since the index
+// was last written. Call it before exiting.
+func (c *TrackCache) Flush() error {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	return c.save()
+}
+
+// evict removes the least recently used tracks until the cache fits in
+// maxSize, the lock must be held.
+func (c *TrackCache) evict() {
+	var size int64
+	entries := []*cacheEntry{}
+	for _, e := range c.entries {
+		size += e.Size
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+
+	for _, e := range entries {
+		if size <= c.maxSize {
+			return
+		}
+		// Anyone still playing the file keeps reading it fine after it's removed.
+		if err := os.Remove(c.path(e)); err != nil && !os.IsNotExist(err) {
+			log.Printf("TrackCache: evict: %v", err)
+		}
+		delete(c.entries, e.URL)
+		size -= e.Size
+	}
+}
+
+// lookup returns the cached file of a track, if we have it.
+func (c *TrackCache) lookup(t Track) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[t.URL]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+
+	c.hits++
+	e.LastUsed = time.Now()
+	c.dirty = true
+	return c.path(e), true
+}
+
+// Cached is whether a track can be played without downloading it.
+func (c *TrackCache) Cached(t Track) bool {
+	if c == nil || c.maxSize <= 0 {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.entries[t.URL]
+	return ok
+}
+
+// forget drops a track whose file turned out to be unusable.
+func (c *TrackCache) forget(t Track) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.entries, t.URL)
+	if err := c.save(); err != nil {
+		log.Printf("TrackCache: %v", err)
+	}
+}
+
+// add moves a fully encoded track at tmp into the cache.
+func (c *TrackCache) add(t Track, tmp string) error {
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return fmt.Errorf("TrackCache.add: %w", err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if _, exists := c.entries[t.URL]; exists {
+		// Someone else filled it while we were playing.
+		return os.Remove(tmp)
+	}
+
+	e := &cacheEntry{
+		URL:      t.URL,
+		Name:     t.Name,
+		File:     cacheFileName(t.URL),
+		Size:     fi.Size(),
+		LastUsed: time.Now(),
+	}
+	if err := os.Rename(tmp, c.path(e)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("TrackCache.add: %w", err)
+	}
+
+	c.entries[t.URL] = e
+	c.evict()
+	return c.save()
+}
+
+// Open starts playing a track offset into it, from the cache if we have it.
+// Otherwise the track is streamed and the cache is filled as it plays.
+func (c *TrackCache) Open(ctx context.Context, t Track, offset time.Duration) (audioStream, error) {
+	if c == nil || c.maxSize <= 0 {
+		return openTrackStream(ctx, t, offset)
+	}
+
+	if p, ok := c.lookup(t); ok {
+		if offset > 0 {
+			// Re-encoding from disk is still a lot quicker than youtube.
+			return openFileStream(ctx, p, offset)
+		}
+
+		f, err := os.Open(p)
+		if err == nil {
+			return fileStream{f}, nil
+		}
+		log.Printf("TrackCache: %v", err)
+		c.forget(t)
+	}
+
+	stream, err := openTrackStream(ctx, t, offset)
+	if err != nil || offset > 0 {
+		// Only whole tracks are worth keeping.
+		return stream, err
+	}
+
+	tmp, err := ioutil.TempFile(c.dir, "fill-*.ogg")
+	if err != nil {
+		log.Printf("TrackCache: can't fill cache: %v", err)
+		return stream, nil
+	}
+
+	f := &cacheFill{stream: stream, tmp: &fillWriter{f: tmp}, cache: c, track: t}
+	f.Reader = io.TeeReader(stream, f.tmp)
+	return f, nil
+}
+
+// Gain returns the loudness normalization gain of a track in dB, if it's
+// been measured.
+func (c *TrackCache) Gain(t Track) (float64, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[t.URL]
+	if !ok || e.Gain == nil {
+		return 0, false
+	}
+	return *e.Gain, true
+}
+
+// SetGain records the normalization gain of a cached track.
+func (c *TrackCache) SetGain(t Track, db float64) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.entries[t.URL]
+	if !ok {
+		return
+	}
+	e.Gain = &db
+	if err := c.save(); err != nil {
+		log.Printf("TrackCache: %v", err)
+	}
+}
+
+// Stats reports how full the cache is and how useful it's been.
+func (c *TrackCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	stats := CacheStats{
+		Tracks:  len(c.entries),
+		MaxSize: c.maxSize,
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+	for _, e := range c.entries {
+		stats.Size += e.Size
+	}
+	return stats
+}
+
+// Clear removes every track from the cache.
+func (c *TrackCache) Clear() error {
+	if c == nil {
+		return nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	for url, e := range c.entries {
+		if err := os.Remove(c.path(e)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("TrackCache.Clear: %w", err)
+		}
+		delete(c.entries, url)
+	}
+	return c.save()
+}
+
+// fillWriter writes the cache copy of a track. Failing to write it shouldn't
+// stop the track from playing, so errors are held onto instead of returned.
+type fillWriter struct {
+	f   *os.File
+	err error
+}
+
+func (w *fillWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.f.Write(p)
+	}
+	return len(p), nil
+}
+
+// cacheFill streams a track while copying it into the cache.
+type cacheFill struct {
+	io.Reader
+
+	stream *trackStream
+	tmp    *fillWriter
+	cache  *TrackCache
+	track  Track
+}
+
+func (f *cacheFill) discard() {
+	f.tmp.f.Close()
+	os.Remove(f.tmp.f.Name())
+}
+
+func (f *cacheFill) Close() error {
+	if err := f.stream.Close(); err != nil {
+		f.discard()
+		return err
+	}
+
+	if err := f.tmp.err; err != nil {
+		log.Printf("TrackCache: can't fill cache: %v", err)
+		f.discard()
+		return nil
+	}
+
+	if err := f.tmp.f.Close(); err != nil {
+		log.Printf("TrackCache: can't fill cache: %v", err)
+		os.Remove(f.tmp.f.Name())
+		return nil
+	}
+
+	if err := f.cache.add(f.track, f.tmp.f.Name()); err != nil {
+		log.Printf("TrackCache: %v", err)
+	}
+	return nil
+}
+
+func (f *cacheFill) Kill() {
+	f.stream.Kill()
+	f.discard()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// fillCache adds a fake encoded track of size bytes to the cache.
+func fillCache(t *testing.T, c *TrackCache, url string, size int) {
+	tmp, err := ioutil.TempFile(c.dir, "fill-*.ogg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmp.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	tmp.Close()
+
+	if err := c.add(Track{Name: url, URL: url}, tmp.Name()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTrackCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trackcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := path.Join(dir, "video_cache.json")
+	c, err := NewTrackCache(path.Join(dir, "tracks"), index, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fillCache(t, c, "a", 100)
+	fillCache(t, c, "b", 100)
+
+	// Using a makes b the least recently used, so b goes when c comes in.
+	if _, ok := c.lookup(Track{URL: "a"}); !ok {
+		t.Fatal("lookup(a) missed")
+	}
+	fillCache(t, c, "c", 100)
+
+	for url, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := c.lookup(Track{URL: url}); ok != want {
+			t.Errorf("lookup(%s) = %v, want %v", url, ok, want)
+		}
+	}
+
+	if _, ok := c.Gain(Track{URL: "a"}); ok {
+		t.Error("Gain(a) before it's been measured, want none")
+	}
+	c.SetGain(Track{URL: "a"}, -3.5)
+	c.SetGain(Track{URL: "b"}, -3.5)
+	if gain, ok := c.Gain(Track{URL: "a"}); !ok || gain != -3.5 {
+		t.Errorf("Gain(a) = %v, %v, want -3.5", gain, ok)
+	}
+	if _, ok := c.Gain(Track{URL: "b"}); ok {
+		t.Error("Gain(b) for an evicted track, want none")
+	}
+
+	stats := c.Stats()
+	if stats.Tracks != 2 || stats.Size != 200 {
+		t.Errorf("Stats() = %+v, want 2 tracks of 200 bytes", stats)
+	}
+
+	// The index survives a restart.
+	c, err = NewTrackCache(path.Join(dir, "tracks"), index, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.lookup(Track{URL: "c"}); !ok {
+		t.Error("lookup(c) missed after reopening the cache")
+	}
+	if gain, ok := c.Gain(Track{URL: "a"}); !ok || gain != -3.5 {
+		t.Errorf("Gain(a) = %v, %v after reopening the cache, want -3.5", gain, ok)
+	}
+
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := c.Stats(); stats.Tracks != 0 || stats.Size != 0 {
+		t.Errorf("Stats() after Clear = %+v, want an empty cache", stats)
+	}
+	files, err := ioutil.ReadDir(path.Join(dir, "tracks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("%d files left after Clear, want 0", len(files))
+	}
+}
+
+func TestTrackCacheOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trackcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A fill that was cut short by a crash.
+	tracks := path.Join(dir, "tracks")
+	if err := os.MkdirAll(tracks, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(tracks, "fill-123.ogg"), make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	index := path.Join(dir, "video_cache.json")
+	c, err := NewTrackCache(tracks, index, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(tracks, "fill-123.ogg")); !os.IsNotExist(err) {
+		t.Errorf("stale fill is still there: %v", err)
+	}
+
+	fillCache(t, c, "a", 100)
+	before, err := ioutil.ReadFile(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Playing a cached track doesn't rewrite the index, Flush does.
+	if _, ok := c.lookup(Track{URL: "a"}); !ok {
+		t.Fatal("lookup(a) missed")
+	}
+	if after, _ := ioutil.ReadFile(index); string(after) != string(before) {
+		t.Error("lookup rewrote the index")
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := ioutil.ReadFile(index); string(after) == string(before) {
+		t.Error("Flush didn't save when a was last used")
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const defaultPrefix = ";"
+
+// Arg describes a single argument taken by a Command.
+type Arg struct {
+	Name     string
+	Optional bool
+
+	// Rest consumes every remaining word as a single argument, it must be
+	// the last argument of a command.
+	Rest bool
+}
+
+func (a Arg) String() string {
+	if a.Optional {
+		return "[" + a.Name + "]"
+	}
+	return "<" + a.Name + ">"
+}
+
+// CommandHandler runs a command. args always has one entry per Arg in the
+// command's schema, with missing optional arguments left empty.
+type CommandHandler func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string)
+
+// Command is a text command understood by the bot.
+type Command struct {
+	Name        string
+	Aliases     []string
+	Description string
+	Args        []Arg
+	Handler     CommandHandler
+}
+
+// Usage returns how the command should be called, e.g. ";remove <N | N..M>".
+func (c *Command) Usage(prefix string) string {
+	parts := []string{prefix + c.Name}
+	for _, a := range c.Args {
+		parts = append(parts, a.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Parse validates the words following a command against its argument schema.
+func (c *Command) Parse(words []string) ([]string, error) {
+	args := make([]string, len(c.Args))
+
+	for i, a := range c.Args {
+		if i >= len(words) {
+			if !a.Optional {
+				return nil, fmt.Errorf("missing %s", a)
+			}
+			continue
+		}
+
+		if a.Rest {
+			args[i] = strings.Join(words[i:], " ")
+			return args, nil
+		}
+		args[i] = words[i]
+	}
+
+	if len(words) > len(c.Args) {
+		return nil, errors.New("too many arguments")
+	}
+	return args, nil
+}
+
+// CommandRouter looks up commands by name or alias.
+type CommandRouter struct {
+	commands []*Command
+	lookup   map[string]*Command
+}
+
+func NewCommandRouter(commands []*Command) *CommandRouter {
+	r := &CommandRouter{
+		commands: commands,
+		lookup:   map[string]*Command{},
+	}
+
+	for _, c := range commands {
+		for _, name := range append([]string{c.Name}, c.Aliases...) {
+			if _, exists := r.lookup[name]; exists {
+				panic(fmt.Sprintf("NewCommandRouter: duplicate command name %#v", name))
+			}
+			r.lookup[name] = c
+		}
+	}
+
+	sort.Slice(r.commands, func(i, j int) bool {
+		return r.commands[i].Name < r.commands[j].Name
+	})
+
+	return r
+}
+
+func (r *CommandRouter) Find(name string) (*Command, bool) {
+	c, ok := r.lookup[strings.ToLower(name)]
+	return c, ok
+}
+
+// maxMessageLength is the longest message discord accepts.
+const maxMessageLength = 2000
+
+// Help lists every command, or describes a single one if name is given. The
+// list is split over as many messages as it takes to fit in discord's limit.
+func (r *CommandRouter) Help(prefix, name string) ([]string, error) {
+	if name != "" {
+		c, ok := r.Find(strings.TrimPrefix(name, prefix))
+		if !ok {
+			return nil, fmt.Errorf("there's no command called %#v, try %shelp", name, prefix)
+		}
+
+		lines := []string{c.Usage(prefix), "", c.Description}
+		if len(c.Aliases) > 0 {
+			lines = append(lines, "", "aliases: "+strings.Join(c.Aliases, ", "))
+		}
+		return codeBlocks(lines, maxMessageLength), nil
+	}
+
+	lines := []string{}
+	for _, c := range r.commands {
+		lines = append(lines, fmt.Sprintf("%-40s %s", c.Usage(prefix), c.Description))
+	}
+	return codeBlocks(lines, maxMessageLength), nil
+}
+
+// codeBlocks packs lines into as few code blocks as it can, each no longer
+// than max.
+func codeBlocks(lines []string, max int) []string {
+	const start, end = "```\n", "```"
+
+	blocks := []string{}
+	block := ""
+	for _, l := range lines {
+		if block != "" && len(start)+len(block)+len(l)+1+len(end) > max {
+			blocks = append(blocks, start+block+end)
+			block = ""
+		}
+		block += l + "\n"
+	}
+	if block != "" {
+		blocks = append(blocks, start+block+end)
+	}
+	return blocks
+}
+
+// botCommands returns every command the bot understands.
+func botCommands() []*Command {
+	return []*Command{
+		{
+			Name:        "help",
+			Description: "list commands, or describe a single command",
+			Args:        []Arg{{Name: "command", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleHelp(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "ui",
+			Aliases:     []string{"party", "create", "start"},
+			Description: "DM you a link to control the bot from your browser",
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleCreate(ds, m)
+			},
+		},
+		{
+			Name:        "play",
+			Aliases:     []string{"p"},
+			Description: "play a playlist, queue a song, or resume if paused",
+			Args:        []Arg{{Name: "playlist | url | search", Optional: true, Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				if args[0] == "" {
+					s.handleResume(ds, m)
+					return
+				}
+				s.handlePlay(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "playnext",
+			Aliases:     []string{"play_next", "pn"},
+			Description: "queue a song to play after the current one",
+			Args:        []Arg{{Name: "url | search", Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handlePlayNext(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "queue",
+			Aliases:     []string{"q"},
+			Description: "list the queue, or set the queue mode",
+			Args:        []Arg{{Name: "balanced | normal", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				if args[0] != "" {
+					s.handleQueueMode(ds, m, args[0])
+					return
+				}
+				s.handleQueue(ds, m)
+			},
+		},
+		{
+			Name:        "skip",
+			Aliases:     []string{"s"},
+			Description: "skip the current song",
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleSkip(ds, m)
+			},
+		},
+		{
+			Name:        "pause",
+			Description: "pause the music",
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handlePause(ds, m)
+			},
+		},
+		{
+			Name:        "resume",
+			Description: "resume the music after pausing or stopping",
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleResume(ds, m)
+			},
+		},
+		{
+			Name:        "seek",
+			Description: "jump to a position in the current song, like 1:23",
+			Args:        []Arg{{Name: "position"}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleSeek(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "crossfade",
+			Description: "show or set how many seconds tracks overlap for",
+			Args:        []Arg{{Name: "seconds | off", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleCrossfade(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "volume",
+			Aliases:     []string{"vol"},
+			Description: "show or set the volume, from 0 to 200",
+			Args:        []Arg{{Name: "0-200", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleVolume(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "normalize",
+			Description: "show or set whether tracks are normalized to the same loudness",
+			Args:        []Arg{{Name: "on | off", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleNormalize(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "shuffle",
+			Description: "show or set whether the queue plays in a random order",
+			Args:        []Arg{{Name: "on | off", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleShuffle(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "loop",
+			Aliases:     []string{"repeat"},
+			Description: "show or set what happens at the end of a track or the queue",
+			Args:        []Arg{{Name: "off | queue | one | auto", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleLoop(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "ambience",
+			Aliases:     []string{"amb"},
+			Description: "loop a playlist or song under the music, or set its volume",
+			Args:        []Arg{{Name: "playlist | url | off | volume 0-200", Optional: true, Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleAmbience(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "scene",
+			Description: "switch to a scene, or list, save or delete scenes",
+			Args:        []Arg{{Name: "name | list | save name | delete name", Optional: true, Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleScene(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "combat",
+			Aliases:     []string{"fight"},
+			Description: "switch to combat music, or end combat and carry on where the music left off",
+			Args:        []Arg{{Name: "playlist | end", Optional: true, Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleCombat(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "sfx",
+			Description: "play a sound effect over the music, or list, add or remove them",
+			Args:        []Arg{{Name: "name | list | add name [url] | remove name | duck [on | off]", Optional: true, Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleSfx(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "dj",
+			Aliases:     []string{"permissions", "perms"},
+			Description: "show who may control the music, or set the DJ role, the DM, or who may do what (admins and the DM only)",
+			Args: []Arg{
+				{Name: "role | dm | skip | stop | playlist | scene | soundboard", Optional: true},
+				{Name: "@role | @user | off | everyone | dj | dm", Optional: true},
+			},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleDJ(ds, m, args[0], args[1])
+			},
+		},
+		{
+			Name:        "voteskip",
+			Aliases:     []string{"vs"},
+			Description: "vote to skip the current song, or set the share of listeners who have to (admins and the DM only)",
+			Args: []Arg{
+				{Name: "share", Optional: true},
+				{Name: "1-100", Optional: true},
+			},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleVoteSkip(ds, m, args[0], args[1])
+			},
+		},
+		{
+			Name:        "stop",
+			Description: "stop the music",
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleStop(ds, m)
+			},
+		},
+		{
+			Name:        "bounce",
+			Aliases:     []string{"exit"},
+			Description: "leave the voice channel",
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleBounce(ds, m)
+			},
+		},
+		{
+			Name:        "clear",
+			Description: "clear the queue",
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleClear(ds, m)
+			},
+		},
+		{
+			Name:        "remove",
+			Description: "remove the Nth song, or songs N to M, from the queue",
+			Args:        []Arg{{Name: "N | N..M"}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleRemove(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "remove_all",
+			Description: "remove every song a user added to the queue",
+			Args:        []Arg{{Name: "@user"}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleRemoveAll(ds, m)
+			},
+		},
+		{
+			Name:        "save_current",
+			Description: "save the queue as a new playlist",
+			Args:        []Arg{{Name: "name", Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleSaveCurrent(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "playlist",
+			Aliases:     []string{"pl"},
+			Description: "list, add or delete playlists",
+			Args: []Arg{
+				{Name: "list | add | delete", Optional: true},
+				{Name: "name [url]", Optional: true, Rest: true},
+			},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handlePlaylist(ds, m, args[0], args[1])
+			},
+		},
+		{
+			Name:        "add_playlist",
+			Description: "add a playlist",
+			Args:        []Arg{{Name: "name [url]", Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handlePlaylistAdd(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "delete_playlist",
+			Description: "delete a playlist",
+			Args:        []Arg{{Name: "name", Rest: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleDelete(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "cache",
+			Description: "show track cache stats, or clear the cache (admins only)",
+			Args:        []Arg{{Name: "stats | clear", Optional: true}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handleCache(ds, m, args[0])
+			},
+		},
+		{
+			Name:        "prefix",
+			Description: "change the prefix used for commands in this server (admins and the DM only)",
+			Args:        []Arg{{Name: "prefix"}},
+			Handler: func(s *DiscordBot, ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+				s.handlePrefix(ds, m, args[0])
+			},
+		},
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommandParse(t *testing.T) {
+	c := &Command{
+		Name: "playlist",
+		Args: []Arg{
+			{Name: "sub", Optional: true},
+			{Name: "name", Optional: true, Rest: true},
+		},
+	}
+
+	if got := c.Usage(";"); got != ";playlist [sub] [name]" {
+		t.Errorf("Usage() = %#v", got)
+	}
+
+	tests := []struct {
+		words []string
+		want  []string
+	}{
+		{words: []string{}, want: []string{"", ""}},
+		{words: []string{"list"}, want: []string{"list", ""}},
+		{words: []string{"add", "Boss", "Fight"}, want: []string{"add", "Boss Fight"}},
+	}
+	for _, tc := range tests {
+		got, err := c.Parse(tc.words)
+		if err != nil {
+			t.Errorf("Parse(%v) = %v", tc.words, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("Parse(%v) mismatch (-want +got):\n%s", tc.words, diff)
+		}
+	}
+
+	remove := &Command{Name: "remove", Args: []Arg{{Name: "N"}}}
+	if _, err := remove.Parse([]string{}); err == nil {
+		t.Error("expected error for missing argument")
+	}
+	if _, err := remove.Parse([]string{"1", "2"}); err == nil {
+		t.Error("expected error for too many arguments")
+	}
+}
+
+func TestCommandRouter(t *testing.T) {
+	r := NewCommandRouter(botCommands())
+
+	for _, name := range []string{"p", "PLAY", "pn", "q"} {
+		if _, ok := r.Find(name); !ok {
+			t.Errorf("Find(%#v) found nothing", name)
+		}
+	}
+
+	if _, err := r.Help(";", "nope"); err == nil {
+		t.Error("expected error for help on an unknown command")
+	}
+}
+
+func TestHelpFitsInMessages(t *testing.T) {
+	r := NewCommandRouter(botCommands())
+
+	msgs, err := r.Help(";", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := strings.Join(msgs, "\n")
+	for _, msg := range msgs {
+		if len(msg) > maxMessageLength {
+			t.Errorf("help message is %d characters, discord only takes %d", len(msg), maxMessageLength)
+		}
+		if !strings.HasPrefix(msg, "```\n") || !strings.HasSuffix(msg, "\n```") {
+			t.Errorf("help message %#v isn't a code block", msg)
+		}
+	}
+	for _, c := range r.commands {
+		if !strings.Contains(all, c.Usage(";")) {
+			t.Errorf("help doesn't list %s", c.Name)
+		}
+	}
+
+	if msgs, err := r.Help(";", "play"); err != nil || len(msgs) != 1 {
+		t.Errorf("Help(play) = %d messages, %v, want one", len(msgs), err)
+	}
+}
+
+func TestCodeBlocks(t *testing.T) {
+	lines := []string{"aaaa", "bbbb", "cccc"}
+
+	// Each block is "```\n" + lines + "```", two lines fit in 17.
+	got := codeBlocks(lines, 17)
+	want := []string{"```\naaaa\nbbbb\n```", "```\ncccc\n```"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("codeBlocks() mismatch (-want +got):\n%s", diff)
+	}
+
+	if got := codeBlocks(lines, maxMessageLength); len(got) != 1 {
+		t.Errorf("codeBlocks() = %d blocks, want everything in one", len(got))
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -15,6 +17,23 @@ type discordSession interface {
 
 type DiscordBot struct {
 	sessions *SessionManager
+	auth     *Auth
+	router   *CommandRouter
+	slash    map[string]*SlashCommand
+}
+
+func NewDiscordBot(sessions *SessionManager, auth *Auth) *DiscordBot {
+	slash := map[string]*SlashCommand{}
+	for _, c := range slashCommands() {
+		slash[c.Name] = c
+	}
+
+	return &DiscordBot{
+		sessions: sessions,
+		auth:     auth,
+		router:   NewCommandRouter(botCommands()),
+		slash:    slash,
+	}
 }
 
 // Have to wrap the function to allow us to use an interface
@@ -22,111 +41,1145 @@ func (s *DiscordBot) incomingMessage(ds *discordgo.Session, m *discordgo.Message
 	s.handleMessage(ds, m)
 }
 
-func (s *DiscordBot) handleMessage(ds *discordgo.Session, m *discordgo.MessageCreate) {
-	const prefix = ";"
+func (s *DiscordBot) handleMessage(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.Author == nil || m.Author.Bot {
+		return
+	}
+
+	prefix := s.prefix(m.GuildID)
+	if !strings.HasPrefix(m.Content, prefix) {
+		return
+	}
+
+	words := strings.Fields(strings.TrimPrefix(m.Content, prefix))
+	if len(words) == 0 {
+		return
+	}
+
+	c, ok := s.router.Find(words[0])
+	if !ok {
+		return
+	}
+
+	args, err := c.Parse(words[1:])
+	if err != nil {
+		s.sendErrorMsg(ds, m, fmt.Errorf("%v, usage: %s", err, c.Usage(prefix)))
+		return
+	}
+
+	c.Handler(s, ds, m, args)
+}
+
+// prefix returns the command prefix used in the given guild.
+func (s *DiscordBot) prefix(guildID string) string {
+	gs, err := s.sessions.FromGuild(guildID)
+	if err != nil {
+		return defaultPrefix
+	}
+	return gs.Prefix()
+}
+
+func (s *DiscordBot) handleHelp(ds *discordgo.Session, m *discordgo.MessageCreate, name string) {
+	help, err := s.router.Help(s.prefix(m.GuildID), name)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+	for _, msg := range help {
+		if err := s.sendMsg(ds, m.ChannelID, msg); err != nil {
+			return
+		}
+	}
+}
+
+func (s *DiscordBot) handlePrefix(ds *discordgo.Session, m *discordgo.MessageCreate, prefix string) {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+	if !s.adminOrDM(ds, m, gs) {
+		return
+	}
+
+	if err := gs.SetPrefix(prefix); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("commands now start with %s, try %shelp", prefix, prefix))
+}
+
+var ErrNotAdmin = errors.New("you need the manage server permission to do that")
+
+// isAdmin reports whether a user can manage the server, which we ask for
+// before running commands that affect the whole bot.
+func isAdmin(ds *discordgo.Session, channelID, userID string) (bool, error) {
+	perms, err := ds.UserChannelPermissions(userID, channelID)
+	if err != nil {
+		return false, err
+	}
+	return perms&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0, nil
+}
+
+// guildMember looks someone up in a guild, it's nil if they aren't in it.
+func guildMember(ds *discordgo.Session, guildID, userID string) (*Member, error) {
+	member, err := ds.GuildMember(guildID, userID)
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMember {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	g, err := ds.State.Guild(guildID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like isAdmin, but for the whole server rather than a channel.
+	mem := &Member{UserID: userID, Roles: member.Roles, Admin: g.OwnerID == userID}
+	for _, r := range g.Roles {
+		if r.Permissions&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) == 0 {
+			continue
+		}
+		// Everyone has the @everyone role, it has the id of the guild.
+		if r.ID == guildID {
+			mem.Admin = true
+		}
+		for _, id := range member.Roles {
+			if id == r.ID {
+				mem.Admin = true
+			}
+		}
+	}
+	return mem, nil
+}
+
+// discordMember describes someone using a command, for checking their
+// permissions.
+func discordMember(ds *discordgo.Session, channelID string, user *discordgo.User, member *discordgo.Member) (Member, error) {
+	admin, err := isAdmin(ds, channelID, user.ID)
+	if err != nil {
+		return Member{}, err
+	}
+
+	mem := Member{UserID: user.ID, Admin: admin}
+	if member != nil {
+		mem.Roles = member.Roles
+	}
+	return mem, nil
+}
+
+// allowed checks that the author of a message may do something, telling them
+// if they can't.
+func (s *DiscordBot) allowed(ds *discordgo.Session, m *discordgo.MessageCreate, perm Permission) bool {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil || !gs.Permissions().Enabled() {
+		// Until there's a session, nobody can have set up permissions.
+		return true
+	}
+
+	mem, err := discordMember(ds, m.ChannelID, m.Author, m.Member)
+	if err == nil {
+		err = gs.Allowed(mem, perm)
+	}
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return false
+	}
+	return true
+}
+
+var ErrNotAdminOrDM = errors.New("only admins and the DM can do that")
+
+// adminOrDM checks that the author of a message can manage the server or is
+// the DM, telling them if they can't. Unlike allowed, this holds before any
+// permissions are set up.
+func (s *DiscordBot) adminOrDM(ds *discordgo.Session, m *discordgo.MessageCreate, gs *Session) bool {
+	mem, err := discordMember(ds, m.ChannelID, m.Author, m.Member)
+	if err == nil && gs.Permissions().roleOf(mem) != RoleDM {
+		err = ErrNotAdminOrDM
+	}
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return false
+	}
+	return true
+}
+
+// handleDJ shows or changes who may control the music:
+//
+//	dj
+//	dj role @role|off
+//	dj dm @user|off
+//	dj permission everyone|dj|dm
+func (s *DiscordBot) handleDJ(ds *discordgo.Session, m *discordgo.MessageCreate, sub, value string) {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if sub != "" && !s.adminOrDM(ds, m, gs) {
+		return
+	}
+
+	switch strings.ToLower(sub) {
+	case "":
+	case "role":
+		switch {
+		case strings.EqualFold(value, "off"):
+			gs.SetDJRole("")
+		case len(m.MentionRoles) == 1:
+			gs.SetDJRole(m.MentionRoles[0])
+		default:
+			s.sendErrorMsg(ds, m, errors.New("usage: dj role @role, or dj role off"))
+			return
+		}
+	case "dm":
+		switch {
+		case strings.EqualFold(value, "off"):
+			gs.SetDM("")
+		case len(m.Mentions) == 1:
+			gs.SetDM(m.Mentions[0].ID)
+		default:
+			s.sendErrorMsg(ds, m, errors.New("usage: dj dm @user, or dj dm off"))
+			return
+		}
+	default:
+		perm, err := ParsePermission(sub)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		r, err := ParseRole(value)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		gs.SetPermission(perm, r)
+	}
+
+	s.sendQuietMsg(ds, m.ChannelID, formatPermissions(gs.Permissions()))
+}
+
+func formatPermissions(p Permissions) string {
+	if !p.Enabled() {
+		return "everyone can do everything, set a DJ role with `dj role @role` or the DM with `dj dm @user`"
+	}
+
+	lines := []string{}
+	if p.DJRole != "" {
+		lines = append(lines, fmt.Sprintf("DJ role: <@&%s>", p.DJRole))
+	} else {
+		lines = append(lines, "DJ role: none")
+	}
+	if p.DM != "" {
+		lines = append(lines, fmt.Sprintf("DM: <@%s>", p.DM))
+	} else {
+		lines = append(lines, "DM: none")
+	}
+	for _, perm := range permissions {
+		lines = append(lines, fmt.Sprintf("%s: %s", perm, p.Role(perm)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+}
+
+func (s *DiscordBot) handleCache(ds *discordgo.Session, m *discordgo.MessageCreate, sub string) {
+	admin, err := isAdmin(ds, m.ChannelID, m.Author.ID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	} else if !admin {
+		s.sendErrorMsg(ds, m, ErrNotAdmin)
+		return
+	}
+
+	switch strings.ToLower(sub) {
+	case "", "stats":
+		stats := trackCache.Stats()
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("%d tracks cached, using %s of %s (%d hits, %d misses)",
+			stats.Tracks, formatBytes(stats.Size), formatBytes(stats.MaxSize), stats.Hits, stats.Misses))
+	case "clear":
+		if err := trackCache.Clear(); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, "cleared the track cache")
+	default:
+		s.sendErrorMsg(ds, m, fmt.Errorf("unknown cache command %#v, expected stats or clear", sub))
+	}
+}
+
+// requesterFromMessage identifies the author of a message, preferring their
+// nickname in the guild.
+func requesterFromMessage(m *discordgo.MessageCreate) Requester {
+	return requesterFromMember(m.Author, m.Member)
+}
+
+func requesterFromMember(u *discordgo.User, member *discordgo.Member) Requester {
+	name := u.Username
+	if member != nil && member.Nick != "" {
+		name = member.Nick
+	}
+	return Requester{ID: u.ID, Name: name}
+}
+
+func (s *DiscordBot) handlePlay(ds *discordgo.Session, m *discordgo.MessageCreate, search string) {
+	if !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	gs, _, err := s.getOrCreateSession(ds, m)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	// Playlists take priority over searching youtube.
+	if pl, ok := gs.FindPlaylist(search); ok {
+		if err := gs.SetPlaylist(pl.Title); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("playing playlist %s", pl.Title))
+		return
+	}
+
+	track, err := gs.QueueSingle(search, requesterFromMessage(m))
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendTrackEmbed(ds, m.ChannelID, "Queued", track)
+}
+
+func (s *DiscordBot) handlePlayNext(ds *discordgo.Session, m *discordgo.MessageCreate, search string) {
+	if !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	gs, _, err := s.getOrCreateSession(ds, m)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	track, err := gs.QueueNext(search, requesterFromMessage(m))
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendTrackEmbed(ds, m.ChannelID, "Playing next", track)
+}
+
+func trackEmbed(title string, track Track) *discordgo.MessageEmbed {
+	return &discordgo.MessageEmbed{
+		Color: 3447003,
+		Fields: []*discordgo.MessageEmbedField{{
+			Name:  title,
+			Value: fmt.Sprintf("[%s](%s)", track.Name, track.URL),
+		}},
+	}
+}
+
+func (s *DiscordBot) sendTrackEmbed(ds *discordgo.Session, channelID, title string, track Track) {
+	msg := &discordgo.MessageSend{Embed: trackEmbed(title, track)}
+
+	if _, err := ds.ChannelMessageSendComplex(channelID, msg); err != nil {
+		log.Printf("sendTrackEmbed: %v", err)
+	}
+}
+
+// handlePlaylist handles the playlist subcommands,
+//
+//	playlist [list]
+//	playlist add name [url]
+//	playlist delete name
+func (s *DiscordBot) handlePlaylist(ds *discordgo.Session, m *discordgo.MessageCreate, sub, rest string) {
+	switch strings.ToLower(sub) {
+	case "", "list", "ls":
+		s.handlePlaylistList(ds, m)
+	case "add":
+		s.handlePlaylistAdd(ds, m, rest)
+	case "delete", "remove", "rm":
+		s.handleDelete(ds, m, rest)
+	default:
+		s.sendErrorMsg(ds, m, fmt.Errorf("unknown playlist command %#v, expected list, add or delete", sub))
+	}
+}
+
+func (s *DiscordBot) handlePlaylistList(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, formatPlaylists(gs.Playlists()))
+}
+
+// noPlaylists is what we say when a guild has no playlists to list.
+const noPlaylists = "there are no playlists yet, add one with `playlist add name`"
+
+func formatPlaylists(playlists []*Playlist) string {
+	if len(playlists) == 0 {
+		return noPlaylists
+	}
+	return "```\n" + strings.Join(playlistLines(playlists), "\n") + "\n```"
+}
+
+func playlistLines(playlists []*Playlist) []string {
+	lines := []string{}
+	for _, pl := range playlists {
+		lines = append(lines, fmt.Sprintf("-  %s (%s, %d tracks)", pl.Title, pl.Category, len(pl.Tracks)))
+	}
+	return lines
+}
+
+func (s *DiscordBot) handlePlaylistAdd(ds *discordgo.Session, m *discordgo.MessageCreate, rest string) {
+	if !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	args := strings.Fields(rest)
+	if len(args) == 0 {
+		s.sendErrorMsg(ds, m, errors.New("usage: playlist add name [url]"))
+		return
+	}
+
+	if last := args[len(args)-1]; strings.HasPrefix(last, "http://") || strings.HasPrefix(last, "https://") {
+		// TODO: handle spotify playlist download
+		s.sendErrorMsg(ds, m, errors.New("adding playlists from a url isn't supported yet, remind devoxel to implement this"))
+		return
+	}
+
+	name := strings.Join(args, " ")
+	category := "misc"
+	s.handleAdd(ds, m, name, category, []Track{})
+}
+
+func (s *DiscordBot) handleAdd(ds *discordgo.Session, m *discordgo.MessageCreate, name, category string, tracks []Track) {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	pl, err := NewPlaylist(name, category, tracks)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+
+	}
+
+	if err := gs.AddPlaylist(pl); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("added playlist %s", pl.Title))
+}
+
+func (s *DiscordBot) handleDelete(ds *discordgo.Session, m *discordgo.MessageCreate, name string) {
+	if !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	if name == "" {
+		s.sendErrorMsg(ds, m, errors.New("usage: playlist delete name"))
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	pl, ok := gs.FindPlaylist(name)
+	if !ok {
+		s.sendErrorMsg(ds, m, ErrGuildPlaylistDoesNotExist)
+		return
+	}
+
+	if err := gs.RemovePlaylist(pl.Title); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("deleted playlist %s", pl.Title))
+}
+
+func (s *DiscordBot) handleSaveCurrent(ds *discordgo.Session, m *discordgo.MessageCreate, name string) {
+	if !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	pl, err := gs.SaveCurrent(name)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("saved %d tracks to playlist %s", len(pl.Tracks), pl.Title))
+}
+
+// parseRange parses a one indexed "N" or "N..M" into a zero indexed range.
+func parseRange(arg string) (int, int, error) {
+	parts := strings.SplitN(arg, "..", 2)
+
+	from, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("%#v is not a number", parts[0])
+	}
+
+	to := from
+	if len(parts) == 2 {
+		to, err = strconv.Atoi(parts[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("%#v is not a number", parts[1])
+		}
+	}
+
+	if from < 1 || to < 1 {
+		return 0, 0, errors.New("tracks are numbered from 1")
+	}
+	// Either way round means the same tracks.
+	if from > to {
+		from, to = to, from
+	}
+
+	return from - 1, to - 1, nil
+}
+
+func (s *DiscordBot) handleRemove(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	if !s.allowed(ds, m, PermSkip) {
+		return
+	}
+
+	from, to, err := parseRange(arg)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if err := gs.Remove(from, to); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("removed %d tracks", to-from+1))
+}
+
+func (s *DiscordBot) handleClear(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if !s.allowed(ds, m, PermStop) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+	gs.Clear()
+
+	s.sendMsg(ds, m.ChannelID, "cleared the queue")
+}
+
+func (s *DiscordBot) handlePause(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if !s.allowed(ds, m, PermStop) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if err := gs.Pause(); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, "paused, use resume to carry on")
+}
+
+func (s *DiscordBot) handleResume(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if !s.allowed(ds, m, PermStop) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if !gs.Active() {
+		// We'll be picking up where we left off, so we need to join voice again.
+		if gs, _, err = s.getOrCreateSession(ds, m); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+	}
+
+	if err := gs.Resume(); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, "resuming")
+}
+
+// parseTimestamp parses a position in a track, like "83", "1:23" or "1:02:03".
+func parseTimestamp(arg string) (time.Duration, error) {
+	parts := strings.Split(arg, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("%#v is not a timestamp, try something like 1:23", arg)
+	}
+
+	var d time.Duration
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%#v is not a timestamp, try something like 1:23", arg)
+		}
+		d = d*60 + time.Duration(n)
+	}
+	return d * time.Second, nil
+}
+
+func (s *DiscordBot) handleSeek(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	if !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	offset, err := parseTimestamp(arg)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if err := gs.Seek(offset); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("skipping to %s", formatPosition(offset)))
+}
+
+func (s *DiscordBot) handleCrossfade(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	if arg != "" && !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	switch arg {
+	case "":
+		if cf := gs.Crossfade(); cf > 0 {
+			s.sendMsg(ds, m.ChannelID, fmt.Sprintf("crossfading tracks over %v", cf))
+		} else {
+			s.sendMsg(ds, m.ChannelID, "crossfade is off")
+		}
+		return
+	case "off":
+		arg = "0"
+	}
+
+	secs, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		s.sendErrorMsg(ds, m, fmt.Errorf("%#v is not a number of seconds", arg))
+		return
+	}
+
+	d := time.Duration(secs * float64(time.Second)).Round(frameDuration)
+	if err := gs.SetCrossfade(d); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if d == 0 {
+		s.sendMsg(ds, m.ChannelID, "crossfade is off")
+		return
+	}
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("crossfading tracks over %v", d))
+}
+
+func (s *DiscordBot) handleVolume(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	if arg != "" && !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if arg == "" {
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("volume is %d%%", gs.Volume()))
+		return
+	}
+
+	volume, err := strconv.Atoi(strings.TrimSuffix(arg, "%"))
+	if err != nil {
+		s.sendErrorMsg(ds, m, fmt.Errorf("%#v is not a volume, try something between 0 and %d", arg, maxVolume))
+		return
+	}
+
+	if err := gs.SetVolume(volume); err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("volume set to %d%%", volume))
+}
+
+func (s *DiscordBot) handleNormalize(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	if arg != "" && !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	switch strings.ToLower(arg) {
+	case "":
+	case "on":
+		gs.SetNormalize(true)
+	case "off":
+		gs.SetNormalize(false)
+	default:
+		s.sendErrorMsg(ds, m, fmt.Errorf("expected on or off, not %#v", arg))
+		return
+	}
+
+	if gs.Normalize() {
+		s.sendMsg(ds, m.ChannelID, "normalizing loudness, tracks are measured the first time they play through")
+		return
+	}
+	s.sendMsg(ds, m.ChannelID, "loudness normalization is off")
+}
+
+func (s *DiscordBot) handleShuffle(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if arg != "" && !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	switch strings.ToLower(arg) {
+	case "":
+	case "on":
+		gs.SetShuffle(true)
+	case "off":
+		gs.SetShuffle(false)
+	default:
+		s.sendErrorMsg(ds, m, fmt.Errorf("expected on or off, not %#v", arg))
+		return
+	}
+
+	if gs.Shuffle() {
+		s.sendMsg(ds, m.ChannelID, "shuffle is on")
+		return
+	}
+	s.sendMsg(ds, m.ChannelID, "shuffle is off, playing in order")
+}
+
+func (s *DiscordBot) handleLoop(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	if arg != "" {
+		if !s.allowed(ds, m, PermPlaylist) {
+			return
+		}
+		mode, err := ParseLoopMode(arg)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		gs.SetLoop(mode)
+	}
+
+	switch gs.Loop() {
+	case LoopOff:
+		s.sendMsg(ds, m.ChannelID, "looping is off, i'll stop after the last track")
+	case LoopQueue:
+		s.sendMsg(ds, m.ChannelID, "looping the whole queue")
+	case LoopOne:
+		s.sendMsg(ds, m.ChannelID, "repeating the current track")
+	default:
+		s.sendMsg(ds, m.ChannelID, "looping playlists, queued tracks play once")
+	}
+}
+
+func (s *DiscordBot) handleAmbience(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	words := strings.Fields(arg)
+	if len(words) > 0 && !s.allowed(ds, m, PermScene) {
+		return
+	}
+
+	switch {
+	case len(words) == 0:
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		if t, ok := gs.Ambience(); ok {
+			s.sendMsg(ds, m.ChannelID, fmt.Sprintf("ambience: %s at %d%%", t.Name, gs.AmbienceVolume()))
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, "there's no ambience playing")
+	case strings.EqualFold(arg, "off"):
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		if err := gs.StopAmbience(); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, "stopped the ambience")
+	case strings.EqualFold(words[0], "volume") && len(words) == 2:
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		volume, err := strconv.Atoi(strings.TrimSuffix(words[1], "%"))
+		if err != nil {
+			s.sendErrorMsg(ds, m, fmt.Errorf("%#v is not a volume, try something between 0 and %d", words[1], maxVolume))
+			return
+		}
+		if err := gs.SetAmbienceVolume(volume); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("ambience volume set to %d%%", volume))
+	default:
+		gs, _, err := s.getOrCreateSession(ds, m)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		title, err := gs.SetAmbience(arg, requesterFromMessage(m))
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("looping %s in the background", title))
+	}
+}
+
+// handleScene switches between and manages scenes:
+//
+//	scene [list]
+//	scene name
+//	scene save name
+//	scene delete name
+func (s *DiscordBot) handleScene(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	words := strings.Fields(arg)
+	sub, name := "", ""
+	if len(words) > 0 {
+		sub = strings.ToLower(words[0])
+		name = strings.Join(words[1:], " ")
+	}
 
-	if !strings.HasPrefix(m.Content, prefix) {
+	if sub != "" && sub != "list" && !s.allowed(ds, m, PermScene) {
 		return
 	}
 
-	cmd := strings.Fields(strings.TrimPrefix(m.Content, prefix))
-	for i, c := range cmd {
-		if i == 0 {
-			cmd[i] = strings.ToLower(cmd[i])
+	switch sub {
+	case "", "list":
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, formatScenes(gs.Scenes()))
+	case "save":
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		sc := gs.CurrentScene(name)
+		if err := gs.SaveScene(sc); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("saved scene %s: %s", sc.Name, describeScene(sc)))
+	case "delete", "remove", "rm":
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		if err := gs.RemoveScene(name); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("deleted scene %s", name))
+	default:
+		gs, _, err := s.getOrCreateSession(ds, m)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		sc, err := gs.SetScene(arg, requesterFromMessage(m))
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
 		}
-		cmd[i] = strings.TrimSpace(c)
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("switched to %s: %s", sc.Name, describeScene(sc)))
+	}
+}
+
+// describeScene sums up what a scene plays.
+func describeScene(sc *Scene) string {
+	parts := []string{}
+	if sc.Playlist != "" {
+		parts = append(parts, sc.Playlist)
+	} else {
+		parts = append(parts, "no music")
+	}
+	if sc.Ambience != "" {
+		parts = append(parts, fmt.Sprintf("%s in the background", sc.Ambience))
+	}
+	parts = append(parts, fmt.Sprintf("volume %d%%", sc.Volume))
+	return strings.Join(parts, ", ")
+}
+
+func formatScenes(scenes []*Scene) string {
+	if len(scenes) == 0 {
+		return "there are no scenes yet, set things up how you like and save them with `scene save name`"
+	}
+
+	lines := []string{}
+	for _, sc := range scenes {
+		lines = append(lines, fmt.Sprintf("-  %s (%s)", sc.Name, describeScene(sc)))
 	}
+	return "```\n" + strings.Join(lines, "\n") + "\n```"
+}
 
-	if len(cmd) == 0 {
+// handleCombat starts combat music, or ends combat and goes back to what was
+// playing before.
+func (s *DiscordBot) handleCombat(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	if !s.allowed(ds, m, PermScene) {
 		return
 	}
 
-	switch cmd[0] {
-	case "create", "start":
-		s.handleCreate(ds, m)
-	case "stop":
-		s.handleStop(ds, m)
-	case "q", "queue":
-		s.handleQueue(ds, m)
-	case "play", "p":
-		s.handlePlay(ds, m, strings.Join(cmd[1:], " "))
-	case "skip", "s":
-		s.handleSkip(ds, m)
-	case "add_playlist":
-		if len(cmd) > 1 {
-			// TODO: handle spotify playlist download
-			s.sendErrorMsg(ds, m, errors.New("remind devoxel to implement this"))
+	switch strings.ToLower(arg) {
+	case "end", "over", "stop":
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		t, ok, err := gs.EndCombat()
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		} else if !ok {
+			s.sendMsg(ds, m.ChannelID, "combat's over")
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("combat's over, back to %s", t.Name))
+	default:
+		gs, _, err := s.getOrCreateSession(ds, m)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		pl, err := gs.StartCombat(arg)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
 			return
 		}
-		name := cmd[1]
-		category := "misc"
-		s.handleAdd(ds, m, name, category, []Track{})
-	case "delete_playlist":
-		name := cmd[1]
-		s.handleDelete(ds, m, name)
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("roll for initiative! playing %s", pl.Title))
 	}
 }
 
-func (s *DiscordBot) handlePlay(ds *discordgo.Session, m *discordgo.MessageCreate, search string) {
-	gs, _, err := s.getOrCreateSession(ds, m)
-	if err != nil {
-		s.sendErrorMsg(ds, m, err)
-		return
+// handleSfx plays and manages sound effects:
+//
+//	sfx [list]
+//	sfx name
+//	sfx add name [url]
+//	sfx remove name
+//	sfx duck [on|off]
+func (s *DiscordBot) handleSfx(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	words := strings.Fields(arg)
+	sub := ""
+	if len(words) > 0 {
+		sub = strings.ToLower(words[0])
 	}
 
-	track, err := gs.QueueSingle(search)
-	if err != nil {
-		s.sendErrorMsg(ds, m, err)
-		return
+	switch sub {
+	case "", "list":
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, formatEffects(gs.Effects()))
+	case "add":
+		s.handleSfxAdd(ds, m, words[1:])
+	case "remove", "delete", "rm":
+		if !s.allowed(ds, m, PermSoundboard) {
+			return
+		}
+		if len(words) != 2 {
+			s.sendErrorMsg(ds, m, errors.New("usage: sfx remove name"))
+			return
+		}
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		if err := gs.RemoveEffect(words[1]); err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("removed sound effect %s", strings.ToLower(words[1])))
+	case "duck":
+		gs, err := s.sessions.FromGuild(m.GuildID)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		if len(words) > 1 && !s.allowed(ds, m, PermSoundboard) {
+			return
+		}
+		switch {
+		case len(words) == 1:
+		case strings.EqualFold(words[1], "on"):
+			gs.SetDucking(true)
+		case strings.EqualFold(words[1], "off"):
+			gs.SetDucking(false)
+		default:
+			s.sendErrorMsg(ds, m, fmt.Errorf("expected on or off, not %#v", words[1]))
+			return
+		}
+		if gs.Ducking() {
+			s.sendMsg(ds, m.ChannelID, fmt.Sprintf("the music drops to %d%% while sound effects play", duckVolume))
+			return
+		}
+		s.sendMsg(ds, m.ChannelID, "sound effects play over the music without ducking it")
+	default:
+		if len(words) != 1 {
+			s.sendErrorMsg(ds, m, errors.New("usage: sfx name"))
+			return
+		}
+		if !s.allowed(ds, m, PermSoundboard) {
+			return
+		}
+		gs, _, err := s.getOrCreateSession(ds, m)
+		if err != nil {
+			s.sendErrorMsg(ds, m, err)
+			return
+		}
+		if err := gs.PlayEffect(words[0]); err != nil {
+			s.sendErrorMsg(ds, m, err)
+		}
 	}
+}
 
-	msg := &discordgo.MessageSend{
-		Embed: &discordgo.MessageEmbed{
-			Color: 3447003,
-			Fields: []*discordgo.MessageEmbedField{{
-				Name:  "Queued",
-				Value: fmt.Sprintf("[%s](%s)", track.Name, track.URL),
-			}},
-		},
+// handleSfxAdd adds a sound effect from a url, or from a file attached to
+// the message.
+func (s *DiscordBot) handleSfxAdd(ds *discordgo.Session, m *discordgo.MessageCreate, args []string) {
+	if !s.allowed(ds, m, PermSoundboard) {
+		return
 	}
 
-	if _, err = ds.ChannelMessageSendComplex(m.ChannelID, msg); err != nil {
-		log.Println("handlePlay: %v", err)
+	var name, url string
+	switch {
+	case len(args) == 2:
+		name, url = args[0], args[1]
+	case len(args) == 1 && len(m.Attachments) > 0:
+		name, url = args[0], m.Attachments[0].URL
+	default:
+		s.sendErrorMsg(ds, m, errors.New("usage: sfx add name url, or attach a file"))
+		return
 	}
-}
 
-func (s *DiscordBot) handleAdd(ds *discordgo.Session, m *discordgo.MessageCreate, name, category string, tracks []Track) {
 	gs, err := s.sessions.FromGuild(m.GuildID)
 	if err != nil {
 		s.sendErrorMsg(ds, m, err)
 		return
 	}
 
-	pl, err := NewPlaylist(name, category, tracks)
+	e, err := gs.AddEffect(name, url)
 	if err != nil {
 		s.sendErrorMsg(ds, m, err)
 		return
+	}
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("added sound effect %s (%.1fs)", e.Name, e.Length.Seconds()))
+}
 
+func formatEffects(effects []*Effect) string {
+	if len(effects) == 0 {
+		return "there are no sound effects yet, add one with `sfx add name url`"
 	}
 
-	if err := gs.AddPlaylist(pl); err != nil {
-		s.sendErrorMsg(ds, m, err)
-		return
+	lines := []string{}
+	for _, e := range effects {
+		lines = append(lines, fmt.Sprintf("-  %s (%.1fs)", e.Name, e.Length.Seconds()))
 	}
+	return "```\n" + strings.Join(lines, "\n") + "\n```"
 }
 
-func (s *DiscordBot) handleDelete(ds *discordgo.Session, m *discordgo.MessageCreate, name string) {
-	/*
-		gs, err := s.sessions.FromGuild(m.GuildID)
-		if err != nil {
-			s.sendErrorMsg(ds, m, err)
-			return
-		}
-		if err := gs.RemovePlaylist(pl); err != nil {
-			s.sendErrorMsg(ds, m, err)
-			return
-		}
-	*/
+func formatPosition(d time.Duration) string {
+	d = d.Round(time.Second)
+	h, m, sec := int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, sec)
+	}
+	return fmt.Sprintf("%d:%02d", m, sec)
 }
 
 func (s *DiscordBot) sendErrorMsg(ds discordSession, m *discordgo.MessageCreate, err error) {
@@ -165,22 +1218,80 @@ func (s *DiscordBot) handleQueue(ds *discordgo.Session, m *discordgo.MessageCrea
 		return
 	}
 
-	tracks := []string{}
 	playing, playlist := gs.Playing()
-	for _, t := range playlist {
+	msg := formatQueue(playing, playlist)
+	if len(playlist) > 0 {
+		msg = fmt.Sprintf("now playing at %s\n%s", formatPosition(gs.Position()), msg)
+	}
+	s.sendMsg(ds, m.ChannelID, msg)
+}
+
+func formatQueue(playing Track, playlist []Track) string {
+	tracks := queueLines(playing, playlist)
+	if len(tracks) == 0 {
+		return "the queue is empty"
+	}
+
+	return "```\n" + strings.Join(tracks, "\n") + "\n```"
+}
+
+func queueLines(playing Track, playlist []Track) []string {
+	tracks := []string{}
+	for i, t := range playlist {
+		line := fmt.Sprintf("%d. %s", i+1, t.Name)
+		if t.Requester != nil {
+			line += fmt.Sprintf(" [%s, %s]", t.Requester.Name, t.Requester.AddedAt.Format("15:04"))
+		}
+
 		if t.Equal(playing) {
-			tracks = append(tracks, "+  "+t.Name+" (now playing)")
+			tracks = append(tracks, "+  "+line+" (now playing)")
 		} else {
-			tracks = append(tracks, "-  "+t.Name+"")
+			tracks = append(tracks, "-  "+line)
 		}
 	}
+	return tracks
+}
+
+func (s *DiscordBot) handleQueueMode(ds *discordgo.Session, m *discordgo.MessageCreate, arg string) {
+	if !s.allowed(ds, m, PermPlaylist) {
+		return
+	}
+
+	mode, err := ParseQueueMode(arg)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
 
-	msg := strings.Join(tracks, "\n")
-	_, err = ds.ChannelMessageSend(m.ChannelID, "```\n"+msg+"\n```")
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+	gs.SetQueueMode(mode)
+
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("queue mode set to %s", mode))
+}
+
+func (s *DiscordBot) handleRemoveAll(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if !s.allowed(ds, m, PermSkip) {
+		return
+	}
+
+	if len(m.Mentions) != 1 {
+		s.sendErrorMsg(ds, m, errors.New("usage: remove_all @user"))
+		return
+	}
+	user := m.Mentions[0]
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
 	if err != nil {
-		log.Printf("handleQueue: %v", err)
+		s.sendErrorMsg(ds, m, err)
+		return
 	}
 
+	n := gs.RemoveRequester(user.ID)
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("removed %d tracks queued by %s", n, user.Username))
 }
 
 func (s *DiscordBot) sendMsg(ds *discordgo.Session, channelID, msg string) error {
@@ -191,6 +1302,18 @@ func (s *DiscordBot) sendMsg(ds *discordgo.Session, channelID, msg string) error
 	return err
 }
 
+// sendQuietMsg sends a message without pinging anyone it mentions.
+func (s *DiscordBot) sendQuietMsg(ds *discordgo.Session, channelID, msg string) error {
+	_, err := ds.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:         msg,
+		AllowedMentions: &discordgo.MessageAllowedMentions{},
+	})
+	if err != nil {
+		log.Printf("sendQuietMsg: %v", err)
+	}
+	return err
+}
+
 func (s *DiscordBot) partialSendMsg(ds *discordgo.Session, channelID string) func(string) error {
 	return func(m string) error {
 		return s.sendMsg(ds, channelID, m)
@@ -209,24 +1332,83 @@ func (s *DiscordBot) partialJoinVoice(ds *discordgo.Session, guildID, authorID s
 }
 
 func (s *DiscordBot) getOrCreateSession(ds *discordgo.Session, m *discordgo.MessageCreate) (*Session, string, error) {
-	joinVoice, err := s.partialJoinVoice(ds, m.GuildID, m.Author.ID)
+	return s.sessionFor(ds, m.GuildID, m.ChannelID, m.Author.ID)
+}
+
+// sessionFor gets or creates the session of a guild, joining the voice
+// channel of the given user and replying in the given channel.
+func (s *DiscordBot) sessionFor(ds *discordgo.Session, guildID, channelID, userID string) (*Session, string, error) {
+	joinVoice, err := s.partialJoinVoice(ds, guildID, userID)
 	if err != nil {
 		return nil, "", err
 	}
-	sendMsg := s.partialSendMsg(ds, m.ChannelID)
-	return s.sessions.FromOrCreate(m.GuildID, sendMsg, joinVoice)
+	sendMsg := s.partialSendMsg(ds, channelID)
+	return s.sessions.FromOrCreate(guildID, sendMsg, joinVoice, s.partialListeners(ds, guildID))
+}
+
+// partialListeners lists who, other than bots, is in the bot's voice channel
+// in a guild. It's empty while the bot isn't in one.
+func (s *DiscordBot) partialListeners(ds *discordgo.Session, guildID string) func() []string {
+	return func() []string {
+		g, err := ds.State.Guild(guildID)
+		if err != nil || ds.State.User == nil {
+			return nil
+		}
+
+		channelID := ""
+		for _, vs := range g.VoiceStates {
+			if vs.UserID == ds.State.User.ID {
+				channelID = vs.ChannelID
+			}
+		}
+		if channelID == "" {
+			return nil
+		}
+
+		listeners := []string{}
+		for _, vs := range g.VoiceStates {
+			if vs.ChannelID != channelID || vs.UserID == ds.State.User.ID {
+				continue
+			}
+			if mem, err := ds.State.Member(guildID, vs.UserID); err == nil && mem.User != nil && mem.User.Bot {
+				continue
+			}
+			listeners = append(listeners, vs.UserID)
+		}
+		return listeners
+	}
+}
+
+// uiLink is a link that logs a user in to the web ui of a guild. It works
+// once, so it's wrapped in <> to stop discord fetching it for a preview.
+func (s *DiscordBot) uiLink(guildID, userID string) string {
+	return fmt.Sprintf("join here: <%s/login?t=%s>", siteURL, s.auth.Token(guildID, userID))
 }
 
+// handleCreate starts a session, and DMs whoever asked a link to its web ui,
+// since anyone who sees the link could use it.
 func (s *DiscordBot) handleCreate(ds *discordgo.Session, m *discordgo.MessageCreate) {
-	_, sessionToken, err := s.getOrCreateSession(ds, m)
-	if err != nil {
+	if _, _, err := s.getOrCreateSession(ds, m); err != nil {
 		s.sendErrorMsg(ds, m, err)
 		return
 	}
-	s.sendMsg(ds, m.GuildID, fmt.Sprintf("%s %s/?s=%s", "join here: ", siteURL, sessionToken))
+
+	dm, err := ds.UserChannelCreate(m.Author.ID)
+	if err == nil {
+		err = s.sendMsg(ds, dm.ID, s.uiLink(m.GuildID, m.Author.ID))
+	}
+	if err != nil {
+		s.sendErrorMsg(ds, m, errors.New("I couldn't DM you a link to the web ui, allow DMs from this server or use /ui"))
+		return
+	}
+	s.sendMsg(ds, m.ChannelID, "I've DMed you a link to the web ui")
 }
 
 func (s *DiscordBot) handleStop(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if !s.allowed(ds, m, PermStop) {
+		return
+	}
+
 	gs, err := s.sessions.FromGuild(m.GuildID)
 	if err != nil {
 		s.sendErrorMsg(ds, m, err)
@@ -237,7 +1419,26 @@ func (s *DiscordBot) handleStop(ds *discordgo.Session, m *discordgo.MessageCreat
 	ds.ChannelMessageSend(m.ChannelID, "bye! see you soon :)")
 }
 
+func (s *DiscordBot) handleBounce(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if !s.allowed(ds, m, PermStop) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+	gs.Leave()
+
+	s.sendMsg(ds, m.ChannelID, "leaving the channel, bye!")
+}
+
 func (s *DiscordBot) handleSkip(ds *discordgo.Session, m *discordgo.MessageCreate) {
+	if !s.allowed(ds, m, PermSkip) {
+		return
+	}
+
 	gs, err := s.sessions.FromGuild(m.GuildID)
 	if err != nil {
 		s.sendErrorMsg(ds, m, err)
@@ -246,6 +1447,52 @@ func (s *DiscordBot) handleSkip(ds *discordgo.Session, m *discordgo.MessageCreat
 	gs.Skip()
 }
 
+// handleVoteSkip votes to skip the current track, anyone listening can vote.
+// Admins and the DM can set how many have to with "voteskip share N".
+func (s *DiscordBot) handleVoteSkip(ds *discordgo.Session, m *discordgo.MessageCreate, sub, value string) {
+	gs, err := s.sessions.FromGuild(m.GuildID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+
+	switch strings.ToLower(sub) {
+	case "":
+	case "share":
+		if !s.adminOrDM(ds, m, gs) {
+			return
+		}
+
+		if value != "" {
+			share, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil {
+				s.sendErrorMsg(ds, m, errors.New("usage: voteskip share 1-100"))
+				return
+			}
+			if err := gs.SetVoteSkipShare(share); err != nil {
+				s.sendErrorMsg(ds, m, err)
+				return
+			}
+		}
+		s.sendMsg(ds, m.ChannelID, fmt.Sprintf("%d%% of listeners have to vote to skip", gs.VoteSkipShare()))
+		return
+	default:
+		s.sendErrorMsg(ds, m, errors.New("usage: voteskip, or voteskip share 1-100"))
+		return
+	}
+
+	votes, needed, skipped, err := gs.VoteSkip(m.Author.ID)
+	if err != nil {
+		s.sendErrorMsg(ds, m, err)
+		return
+	}
+	if skipped {
+		s.sendMsg(ds, m.ChannelID, "vote passed, skipping")
+		return
+	}
+	s.sendMsg(ds, m.ChannelID, fmt.Sprintf("%d/%d votes to skip", votes, needed))
+}
+
 func (s *DiscordBot) sendMessage(ds discordSession, id, message string) {
 	m, err := ds.ChannelMessageSend(id, message)
 	if err != nil {
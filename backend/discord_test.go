@@ -1 +1,66 @@
 package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		arg      string
+		from, to int
+		wantErr  bool
+	}{
+		{arg: "1", from: 0, to: 0},
+		{arg: "2..5", from: 1, to: 4},
+		{arg: "5..3", from: 2, to: 4},
+		{arg: "0", wantErr: true},
+		{arg: "a..2", wantErr: true},
+		{arg: "3..", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		from, to, err := parseRange(tc.arg)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseRange(%#v) expected error", tc.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRange(%#v) = %v", tc.arg, err)
+			continue
+		}
+		if from != tc.from || to != tc.to {
+			t.Errorf("parseRange(%#v) = %d, %d, want %d, %d", tc.arg, from, to, tc.from, tc.to)
+		}
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		arg     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{arg: "83", want: 83 * time.Second},
+		{arg: "1:23", want: 83 * time.Second},
+		{arg: "1:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{arg: "1:-2", wantErr: true},
+		{arg: "1:2:3:4", wantErr: true},
+		{arg: "abc", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		got, err := parseTimestamp(tc.arg)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseTimestamp(%#v) expected error", tc.arg)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("parseTimestamp(%#v) = %v, %v, want %v", tc.arg, got, err, tc.want)
+		}
+	}
+}
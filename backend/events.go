@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+)
+
+// EventType says what changed in a session.
+type EventType string
+
+const (
+	// EventTrackChanged is sent when a new track starts, or the player
+	// stops.
+	EventTrackChanged EventType = "TrackChanged"
+	// EventQueueChanged is sent when tracks are added, removed or
+	// reordered.
+	EventQueueChanged EventType = "QueueChanged"
+	// EventPaused is sent when playback is paused or resumed.
+	EventPaused EventType = "Paused"
+	// EventPlaylistsChanged is sent when a playlist is added or removed.
+	EventPlaylistsChanged EventType = "PlaylistsChanged"
+	// EventSkipVotesChanged is sent when someone votes to skip, or the
+	// votes are cleared.
+	EventSkipVotesChanged EventType = "SkipVotesChanged"
+	// EventSettingsChanged is sent for everything else the web ui shows:
+	// volume, ambience, effects, scenes, combat and so on.
+	EventSettingsChanged EventType = "SettingsChanged"
+	// EventError is sent when something goes wrong during playback.
+	EventError EventType = "Error"
+)
+
+// maxPendingErrors is how many errors a subscriber can fall behind by before
+// we drop them.
+const maxPendingErrors = 8
+
+// Event tells subscribers that something changed in a session. It only says
+// what changed, subscribers look the new state up themselves, so they never
+// work from a stale copy of it.
+type Event struct {
+	Type EventType
+	// Err is set for EventError.
+	Err error
+}
+
+// EventBus fans the events of a session out to any number of subscribers.
+// Publishing never blocks, so it's safe from anywhere, even with locks held.
+type EventBus struct {
+	sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{subs: map[*Subscription]struct{}{}}
+}
+
+// Subscribe starts collecting events, until the subscription is closed.
+func (b *EventBus) Subscribe() *Subscription {
+	sub := &Subscription{
+		bus:   b,
+		ready: make(chan struct{}, 1),
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *EventBus) Publish(e Event) {
+	b.Lock()
+	defer b.Unlock()
+
+	for sub := range b.subs {
+		sub.add(e)
+	}
+}
+
+// Subscription collects the events of a bus for one subscriber.
+//
+// Events of the same type are merged while they wait to be taken, since
+// they'd only lead to the same state being looked up twice. That way a slow
+// subscriber can't hold up the bus or make it buffer without limit.
+type Subscription struct {
+	sync.Mutex
+
+	bus *EventBus
+	// ready has a value in it while there are events waiting.
+	ready  chan struct{}
+	events []Event
+	errors int
+}
+
+func (sub *Subscription) add(e Event) {
+	sub.Lock()
+	defer sub.Unlock()
+
+	if e.Type == EventError {
+		if sub.errors >= maxPendingErrors {
+			return
+		}
+		sub.errors++
+	} else {
+		for _, pending := range sub.events {
+			if pending.Type == e.Type {
+				return
+			}
+		}
+	}
+	sub.events = append(sub.events, e)
+
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Ready is sent on once there are events to take.
+func (sub *Subscription) Ready() <-chan struct{} {
+	return sub.ready
+}
+
+// Events takes the events that are waiting, in the order they were first
+// published.
+func (sub *Subscription) Events() []Event {
+	sub.Lock()
+	defer sub.Unlock()
+
+	events := sub.events
+	sub.events = nil
+	sub.errors = 0
+	return events
+}
+
+// Close stops collecting events.
+func (sub *Subscription) Close() {
+	sub.bus.Lock()
+	defer sub.bus.Unlock()
+	delete(sub.bus.subs, sub)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func eventTypes(events []Event) []EventType {
+	types := []EventType{}
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	a, b := bus.Subscribe(), bus.Subscribe()
+
+	bus.Publish(Event{Type: EventTrackChanged})
+	bus.Publish(Event{Type: EventQueueChanged})
+	bus.Publish(Event{Type: EventTrackChanged})
+	for i := 0; i < maxPendingErrors+2; i++ {
+		bus.Publish(Event{Type: EventError, Err: errors.New("uh oh")})
+	}
+
+	select {
+	case <-a.Ready():
+	default:
+		t.Fatal("subscriber isn't ready after events were published")
+	}
+
+	// Repeats are merged while they wait, except for errors, which are
+	// only capped.
+	want := []EventType{EventTrackChanged, EventQueueChanged}
+	for i := 0; i < maxPendingErrors; i++ {
+		want = append(want, EventError)
+	}
+	if diff := cmp.Diff(want, eventTypes(a.Events())); diff != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", diff)
+	}
+	if got := a.Events(); len(got) != 0 {
+		t.Errorf("events were taken twice: %v", eventTypes(got))
+	}
+
+	b.Close()
+	bus.Publish(Event{Type: EventPaused})
+	if got := eventTypes(a.Events()); !cmp.Equal(got, []EventType{EventPaused}) {
+		t.Errorf("events after more were published = %v, want [Paused]", got)
+	}
+	if got := b.Events(); len(got) != len(want) {
+		t.Errorf("closed subscriber has %d events, want the %d from before it closed", len(got), len(want))
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	gs := newSession("guild", "session", nil)
+	sub := gs.Subscribe()
+	defer sub.Close()
+
+	if err := gs.SetVolume(50); err != nil {
+		t.Fatal(err)
+	}
+	gs.SetShuffle(true)
+	if err := gs.AddPlaylist(&Playlist{Title: "new", Category: "Saved"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []EventType{EventSettingsChanged, EventQueueChanged, EventPlaylistsChanged}
+	if diff := cmp.Diff(want, eventTypes(sub.Events())); diff != "" {
+		t.Errorf("events mismatch (-want +got):\n%s", diff)
+	}
+
+	msg := wsEvent(gs, Event{Type: EventSettingsChanged})
+	if settings, ok := msg.Payload.(wsSettings); msg.Type != "SettingsChanged" || !ok || *settings.Volume != 50 {
+		t.Errorf("SettingsChanged message = %+v, want volume 50", msg)
+	}
+}
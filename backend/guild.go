@@ -1,10 +1,14 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bwmarrin/discordgo"
 )
@@ -80,12 +84,11 @@ func (gp *GuildPlaylist) Remove(t string) error {
 		return ErrGuildPlaylistDoesNotExist
 	}
 
-	delete(gp.keys, t)
-
 	i, err := gp.get(t)
 	if err != nil {
 		return err
 	}
+	delete(gp.keys, t)
 
 	l := len(gp.playlists)
 	copy(gp.playlists[i:], gp.playlists[i+1:])
@@ -103,14 +106,74 @@ func (gp *GuildPlaylist) sort() {
 type Session struct {
 	sync.Mutex
 
+	id        string
+	guildID   string
+	store     *GuildStore
+	settings  SessionSettings
 	playlists *GuildPlaylist
 
+	// resume is where playback was when the session was last stopped.
+	resume *ResumePoint
+
 	msg       func(msg string) error
 	joinVoice func() (voice *discordgo.VoiceConnection, err error)
 	p         *Player
+
+	// listeners returns the user ids of the people in our voice channel,
+	// not counting bots. It's nil until someone has used a command.
+	listeners func() []string
+	// votes are the votes to skip the current track.
+	votes skipVotes
+
+	// scenes are the guild's presets, keyed by sceneKey. scene is the name
+	// of the last one switched to.
+	scenes map[string]*Scene
+	scene  string
+
+	// combat holds what was playing before combat started, while we're in
+	// combat. The ResumePoint in it is nil if nothing was.
+	combat *combatState
+
+	// ambience loops under the music and sfx plays sound effects over it,
+	// everything is mixed together by mix. ambienceSource is what the
+	// ambience was set from.
+	ambience       *Player
+	ambienceSource string
+	sfx            *Soundboard
+	mix            *Mixer
+
+	// events tells the web ui about changes as they happen.
+	events *EventBus
+}
+
+// combatState is what to go back to once combat is over.
+type combatState struct {
+	resume *ResumePoint
 }
 
-func newSession() *Session {
+const (
+	// combatCategory is the category of playlists suited to combat, and
+	// defaultCombatPlaylist the one we pick if none has been chosen.
+	combatCategory        = "Combat"
+	defaultCombatPlaylist = "Combat: Standard"
+)
+
+var (
+	ErrNotInCombat      = errors.New("we're not in combat")
+	ErrNoCombatPlaylist = errors.New("there's no combat playlist, pick one with combat <playlist>")
+)
+
+// ambienceCrossfade smooths over the seam when ambience loops.
+const ambienceCrossfade = 2 * time.Second
+
+var ErrNoAmbience = errors.New("there's no ambience playing")
+
+// ErrNotInVoice is returned when we'd have to join voice but can't, sessions
+// restored after a restart don't know which channel to join until someone
+// uses a command in Discord.
+var ErrNotInVoice = errors.New("i'm not in a voice channel")
+
+func newSession(guildID, id string, store *GuildStore) *Session {
 	playlists := newGuildPlaylists()
 
 	for _, sample := range samplePlaylists {
@@ -121,40 +184,211 @@ func newSession() *Session {
 		playlists.Insert(newPl)
 	}
 
-	// TODO: persist playlists
-	return &Session{
-		p:         NewPlayer(),
+	gs := &Session{
+		id:      id,
+		guildID: guildID,
+		store:   store,
+		settings: SessionSettings{
+			Volume:         defaultVolume,
+			AmbienceVolume: defaultAmbienceVolume,
+			VoteSkipShare:  defaultVoteSkipShare,
+		},
+		p:         NewPlayer(QueueNormal),
+		sfx:       newSoundboard(guildEffectsDir(guildID), nil),
+		scenes:    map[string]*Scene{},
 		playlists: playlists,
+		events:    newEventBus(),
+	}
+	gs.initAudio()
+	return gs
+}
+
+// sessionFromRecord restores a session previously written to the store.
+func sessionFromRecord(rec *guildRecord, store *GuildStore) (*Session, error) {
+	playlists := newGuildPlaylists()
+	for _, pl := range rec.Playlists {
+		if err := playlists.Insert(pl); err != nil {
+			return nil, fmt.Errorf("guild %s: playlist %#v: %w", rec.GuildID, pl.Title, err)
+		}
+	}
+
+	p := NewPlayer(rec.Settings.QueueMode)
+	if err := p.SetCrossfade(rec.Settings.Crossfade); err != nil {
+		log.Printf("guild %s: ignoring crossfade setting: %v", rec.GuildID, err)
+	}
+	p.SetNormalize(rec.Settings.Normalize)
+	p.SetShuffle(rec.Settings.Shuffle)
+	p.SetLoop(rec.Settings.Loop)
+
+	gs := &Session{
+		id:        rec.SessionID,
+		guildID:   rec.GuildID,
+		store:     store,
+		settings:  rec.Settings,
+		resume:    rec.Resume,
+		p:         p,
+		sfx:       newSoundboard(guildEffectsDir(rec.GuildID), rec.Effects),
+		scenes:    map[string]*Scene{},
+		playlists: playlists,
+		events:    newEventBus(),
+	}
+	for _, sc := range rec.Scenes {
+		gs.scenes[sceneKey(sc.Name)] = sc
+	}
+	gs.initAudio()
+	return gs, nil
+}
+
+// initAudio sets up the ambience player, and the mixer everything plays
+// through, from the session's settings.
+func (gs *Session) initAudio() {
+	gs.ambience = NewPlayer(QueueNormal)
+	gs.ambience.SetCrossfade(ambienceCrossfade)
+	if err := gs.ambience.Layer().SetVolume(gs.settings.AmbienceVolume); err != nil {
+		log.Printf("guild %s: ignoring ambience volume setting: %v", gs.guildID, err)
+	}
+
+	gs.mix = NewMixer(gs.p.Layer(), gs.ambience.Layer(), gs.sfx.Layer())
+	if err := gs.mix.SetVolume(gs.settings.Volume); err != nil {
+		log.Printf("guild %s: ignoring volume setting: %v", gs.guildID, err)
+	}
+	gs.mix.duck = gs.sfx.Layer()
+	gs.mix.SetDucking(gs.settings.Duck)
+
+	// The ambience is one of the settings as far as anyone watching is
+	// concerned.
+	gs.p.notify = func(e Event) {
+		// Votes are for the track that was playing.
+		if e.Type == EventTrackChanged && gs.votes.Reset() {
+			gs.events.Publish(Event{Type: EventSkipVotesChanged})
+		}
+		gs.events.Publish(e)
+	}
+	gs.ambience.notify = func(e Event) {
+		if e.Type != EventError {
+			e.Type = EventSettingsChanged
+		}
+		gs.events.Publish(e)
+	}
+
+	// Stay in voice while paused, and stop playing if we leave.
+	gs.mix.hold = gs.p.Paused
+	gs.mix.onExit = func() {
+		gs.Stop()
+		gs.ambience.Stop()
+		gs.sfx.Stop()
+	}
+}
+
+// Subscribe returns a subscription to the events of the session.
+func (gs *Session) Subscribe() *Subscription {
+	return gs.events.Subscribe()
+}
+
+func (gs *Session) publish(t EventType) {
+	gs.events.Publish(Event{Type: t})
+}
+
+// voiceReady checks that we can join voice and reply before anything is
+// started. Must be called with the session locked.
+func (gs *Session) voiceReady() error {
+	if gs.msg == nil || gs.joinVoice == nil {
+		return ErrNotInVoice
+	}
+	return nil
+}
+
+// start joins voice, if we haven't already, and starts the player. Check
+// voiceReady before changing anything that leads here.
+func (gs *Session) start(p *Player) {
+	gs.mix.Start(gs.msg, gs.joinVoice)
+	p.Start(gs.msg, gs.playerDone)
+}
+
+// playerDone leaves voice once there's nothing left playing.
+func (gs *Session) playerDone() {
+	if !gs.p.On() && !gs.ambience.On() && !gs.sfx.Playing() {
+		gs.mix.Stop()
+	}
+}
+
+// record builds the on disk representation of the session.
+// Must be called with the session locked.
+func (gs *Session) record() *guildRecord {
+	return &guildRecord{
+		GuildID:   gs.guildID,
+		SessionID: gs.id,
+		Playlists: gs.playlists.GetAll(),
+		Settings:  gs.settings,
+		Effects:   gs.sfx.Effects(),
+		Scenes:    gs.sceneList(),
+		Resume:    gs.resume,
+	}
+}
+
+// Checkpoint saves where playback is, so it can be resumed later.
+func (gs *Session) Checkpoint() {
+	gs.Lock()
+	defer gs.Unlock()
+	gs.checkpoint()
+}
+
+// checkpoint must be called with the session locked.
+func (gs *Session) checkpoint() {
+	if rp := gs.p.ResumePoint(); rp != nil {
+		gs.resume = rp
+	}
+	gs.save()
+}
+
+// save persists the session. Must be called with the session locked.
+//
+// Failing to save is logged but otherwise ignored, the session is still
+// perfectly usable until the next restart.
+func (gs *Session) save() {
+	if gs.store == nil {
+		return
+	}
+
+	if err := gs.store.Save(gs.record()); err != nil {
+		log.Printf("save: cannot persist session %s: %v", gs.id, err)
 	}
 }
 
-func (gs *Session) SetPlaylist(title string) {
+func (gs *Session) SetPlaylist(title string) error {
 	gs.Lock()
 	defer gs.Unlock()
 
+	if err := gs.voiceReady(); err != nil {
+		return err
+	}
+
 	pl, err := gs.playlists.Get(title)
 	if err != nil {
-		log.Printf("SetPlaylist: cannot find playlist: %v", err) // XXX Debug
-		gs.msg(fmt.Sprintf("Sorry, I can't find the playlist %#v.", title))
-		return
+		return err
 	}
 
 	if err := gs.p.SetPlaylist(pl); err != nil {
-		log.Printf("SetPlaylist: cannot set: %v", err)
-		msg := fmt.Sprintf("Couldn't set your playlist. Here's the debug output: %#v", err)
-		gs.msg(msg)
-		return
+		return fmt.Errorf("couldn't set your playlist: %w", err)
 	}
 
+	gs.settings.Playlist = title
+	gs.save()
+
 	// Signal that we want to join the voice channel and start playing.
-	gs.p.Start(gs.msg, gs.joinVoice)
+	gs.start(gs.p)
+	return nil
 }
 
-func (gs *Session) QueueSingle(search string) (Track, error) {
+func (gs *Session) QueueSingle(search string, requester Requester) (Track, error) {
 	gs.Lock()
 	defer gs.Unlock()
 
-	track, err := gs.p.QueueSingle(search)
+	if err := gs.voiceReady(); err != nil {
+		return Track{}, err
+	}
+
+	track, err := gs.p.QueueSingle(search, requester)
 	if err != nil {
 		log.Printf("QueueSingle(%s) error: %v", search, err)
 		msg := fmt.Sprintf("Oops! Flargunnstow failed at the modest tasks that was his charge. Debug: %#v", err)
@@ -163,22 +397,872 @@ func (gs *Session) QueueSingle(search string) (Track, error) {
 	}
 
 	// Signal that we want to join the voice channel and start playing.
-	gs.p.Start(gs.msg, gs.joinVoice)
+	gs.start(gs.p)
 	return track, nil
 }
 
+// QueueNext queues a track after the currently playing one.
+func (gs *Session) QueueNext(search string, requester Requester) (Track, error) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if err := gs.voiceReady(); err != nil {
+		return Track{}, err
+	}
+
+	track, err := gs.p.QueueNext(search, requester)
+	if err != nil {
+		log.Printf("QueueNext(%s) error: %v", search, err)
+		return Track{}, err
+	}
+
+	gs.start(gs.p)
+	return track, nil
+}
+
+// Remove removes the tracks between from and to (inclusive, zero indexed).
+func (gs *Session) Remove(from, to int) error {
+	return gs.p.Remove(from, to)
+}
+
+// Clear empties the queue.
+func (gs *Session) Clear() {
+	gs.p.Clear()
+}
+
+// FindPlaylist looks up a playlist by title, ignoring case.
+func (gs *Session) FindPlaylist(title string) (*Playlist, bool) {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.findPlaylist(title)
+}
+
+// findPlaylist must be called with the session locked.
+func (gs *Session) findPlaylist(title string) (*Playlist, bool) {
+	if pl, err := gs.playlists.Get(title); err == nil {
+		return pl, true
+	}
+
+	for _, pl := range gs.playlists.GetAll() {
+		if strings.EqualFold(pl.Title, title) {
+			return pl, true
+		}
+	}
+	return nil, false
+}
+
+// SaveCurrent stores the queue as a new playlist.
+func (gs *Session) SaveCurrent(title string) (*Playlist, error) {
+	_, playing := gs.Playing()
+	if len(playing) == 0 {
+		return nil, ErrNoSongs
+	}
+
+	// Saved playlists belong to the guild, not to whoever queued the tracks.
+	tracks := make([]Track, len(playing))
+	for i, t := range playing {
+		t.Requester = nil
+		tracks[i] = t
+	}
+
+	pl, err := NewPlaylist(title, "Saved", tracks)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := gs.AddPlaylist(pl); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
 func (gs *Session) Playing() (Track, []Track) {
 	return gs.p.Playing()
 }
 
+// RemoveRequester removes a user's pending additions from the queue.
+func (gs *Session) RemoveRequester(id string) int {
+	return gs.p.RemoveRequester(id)
+}
+
+func (gs *Session) Pause() error {
+	if err := gs.p.Pause(); err != nil {
+		return err
+	}
+
+	gs.Checkpoint()
+	return nil
+}
+
+// Resume carries on after a pause. If the player isn't running it picks up
+// from the last checkpoint instead, which survives restarts.
+func (gs *Session) Resume() error {
+	if gs.p.On() {
+		return gs.p.Resume()
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	if gs.resume == nil {
+		return ErrNotPlaying
+	}
+	if err := gs.voiceReady(); err != nil {
+		return err
+	}
+
+	if err := gs.p.Restore(gs.resume); err != nil {
+		return err
+	}
+	gs.start(gs.p)
+	return nil
+}
+
+// Active reports whether the session's player is running.
+func (gs *Session) Active() bool {
+	return gs.p.On()
+}
+
+func (gs *Session) Seek(offset time.Duration) error {
+	return gs.p.Seek(offset)
+}
+
+// Position returns how far into the current track we are.
+func (gs *Session) Position() time.Duration {
+	return gs.p.Position()
+}
+
+func (gs *Session) Paused() bool {
+	return gs.p.Paused()
+}
+
 func (gs *Session) Skip() {
 	gs.p.Skip()
 }
 
+// listening returns who's listening to us.
+func (gs *Session) listening() ([]string, error) {
+	gs.Lock()
+	listeners := gs.listeners
+	gs.Unlock()
+
+	if listeners == nil {
+		return nil, ErrNotInVoice
+	}
+	l := listeners()
+	if len(l) == 0 {
+		return nil, ErrNotInVoice
+	}
+	return l, nil
+}
+
+// VoteSkip votes to skip the current track for a listener, and skips it once
+// enough of them have voted.
+func (gs *Session) VoteSkip(userID string) (votes, needed int, skipped bool, err error) {
+	if playing, _ := gs.Playing(); playing.URL == "" {
+		return 0, 0, false, ErrNotPlaying
+	}
+
+	listeners, err := gs.listening()
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	votes, needed, skipped, err = gs.votes.Vote(userID, listeners, gs.VoteSkipShare())
+	if err != nil {
+		return 0, 0, false, err
+	}
+
+	if skipped {
+		gs.Skip()
+	}
+	gs.publish(EventSkipVotesChanged)
+	return votes, needed, skipped, nil
+}
+
+// SkipVotes is how many listeners have voted to skip the current track, and
+// how many have to.
+func (gs *Session) SkipVotes() (votes, needed int) {
+	listeners, err := gs.listening()
+	if err != nil {
+		return 0, 0
+	}
+	return gs.votes.Count(listeners, gs.VoteSkipShare())
+}
+
+func (gs *Session) VoteSkipShare() int {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.settings.VoteSkipShare
+}
+
+// SetVoteSkipShare sets the percentage of listeners who have to vote to skip
+// a track.
+func (gs *Session) SetVoteSkipShare(share int) error {
+	if share < 1 || share > 100 {
+		return errors.New("the share of votes needed to skip must be from 1 to 100%")
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.settings.VoteSkipShare = share
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return nil
+}
+
 func (gs *Session) Stop() {
+	gs.Checkpoint()
 	gs.p.Stop()
 }
 
+// Prefix returns the prefix used for text commands in the guild.
+func (gs *Session) Prefix() string {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if gs.settings.Prefix == "" {
+		return defaultPrefix
+	}
+	return gs.settings.Prefix
+}
+
+func (gs *Session) SetPrefix(prefix string) error {
+	if prefix == "" || len(prefix) > 3 || strings.ContainsAny(prefix, " \t\n`") {
+		return errors.New("a prefix must be one to three characters, without spaces or backticks")
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.settings.Prefix = prefix
+	gs.save()
+	return nil
+}
+
+func (gs *Session) SetQueueMode(mode QueueMode) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.p.SetQueueMode(mode)
+	gs.settings.QueueMode = mode
+	gs.save()
+}
+
+func (gs *Session) QueueMode() QueueMode {
+	return gs.p.QueueMode()
+}
+
+// SetCrossfade sets how long tracks overlap for, 0 turns crossfading off.
+func (gs *Session) SetCrossfade(d time.Duration) error {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if err := gs.p.SetCrossfade(d); err != nil {
+		return err
+	}
+	gs.settings.Crossfade = d
+	gs.save()
+	return nil
+}
+
+func (gs *Session) Crossfade() time.Duration {
+	return gs.p.Crossfade()
+}
+
+func (gs *Session) SetVolume(volume int) error {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if err := gs.mix.SetVolume(volume); err != nil {
+		return err
+	}
+	gs.settings.Volume = volume
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return nil
+}
+
+func (gs *Session) Volume() int {
+	return gs.mix.Volume()
+}
+
+// findAmbience finds what to loop for an ambience search, which is either
+// one of our playlists or a single track. It also returns what to set the
+// ambience from next time, without searching again.
+// Must be called with the session unlocked, so nothing else is held up while
+// we search for a track.
+func (gs *Session) findAmbience(search string, requester Requester) (*Playlist, string, error) {
+	gs.Lock()
+	pl, ok := gs.findPlaylist(search)
+	empty := ok && len(pl.Tracks) == 0
+	gs.Unlock()
+
+	if !ok {
+		track, err := gs.ambience.lookup(search, requester)
+		if err != nil {
+			return nil, "", err
+		}
+		return &Playlist{Title: track.Name, Tracks: []Track{track}}, track.URL, nil
+	}
+	if empty {
+		return nil, "", fmt.Errorf("the playlist %s is empty", pl.Title)
+	}
+	return pl, pl.Title, nil
+}
+
+// SetAmbience loops a playlist, or a single track, under the music.
+// It returns a description of what's now playing.
+func (gs *Session) SetAmbience(search string, requester Requester) (string, error) {
+	gs.Lock()
+	err := gs.voiceReady()
+	gs.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	pl, source, err := gs.findAmbience(search, requester)
+	if err != nil {
+		return "", err
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	// We might have been sent away while searching.
+	if err := gs.voiceReady(); err != nil {
+		return "", err
+	}
+	if err := gs.ambience.SetPlaylist(pl); err != nil {
+		return "", err
+	}
+	gs.ambienceSource = source
+	gs.start(gs.ambience)
+	return pl.Title, nil
+}
+
+// StopAmbience stops the ambience, leaving the music playing.
+func (gs *Session) StopAmbience() error {
+	if !gs.ambience.On() {
+		return ErrNoAmbience
+	}
+	gs.ambience.Stop()
+	return nil
+}
+
+// Ambience returns the ambience track that's playing.
+func (gs *Session) Ambience() (Track, bool) {
+	if !gs.ambience.On() {
+		return Track{}, false
+	}
+	t, _ := gs.ambience.Playing()
+	return t, t.URL != ""
+}
+
+func (gs *Session) SetAmbienceVolume(volume int) error {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if err := gs.ambience.Layer().SetVolume(volume); err != nil {
+		return err
+	}
+	gs.settings.AmbienceVolume = volume
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return nil
+}
+
+func (gs *Session) AmbienceVolume() int {
+	return gs.ambience.Layer().Volume()
+}
+
+// combatPlaylist picks the playlist to fight to. Without a title it's the
+// last one used, or one from the Combat category.
+// Must be called with the session locked.
+func (gs *Session) combatPlaylist(title string) (*Playlist, error) {
+	if title != "" {
+		pl, ok := gs.findPlaylist(title)
+		if !ok {
+			return nil, ErrGuildPlaylistDoesNotExist
+		}
+		return pl, nil
+	}
+
+	for _, t := range []string{gs.settings.CombatPlaylist, defaultCombatPlaylist} {
+		if t == "" {
+			continue
+		}
+		if pl, ok := gs.findPlaylist(t); ok {
+			return pl, nil
+		}
+	}
+	for _, pl := range gs.playlists.GetAll() {
+		if strings.EqualFold(pl.Category, combatCategory) {
+			return pl, nil
+		}
+	}
+	return nil, ErrNoCombatPlaylist
+}
+
+// StartCombat switches to combat music, remembering what was playing so
+// EndCombat can go back to it. Starting combat again while in combat only
+// changes the music.
+func (gs *Session) StartCombat(title string) (*Playlist, error) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if err := gs.voiceReady(); err != nil {
+		return nil, err
+	}
+
+	pl, err := gs.combatPlaylist(title)
+	if err != nil {
+		return nil, err
+	}
+	if len(pl.Tracks) == 0 {
+		return nil, fmt.Errorf("the playlist %s is empty", pl.Title)
+	}
+
+	if gs.combat == nil {
+		gs.combat = &combatState{resume: gs.p.ResumePoint()}
+	}
+
+	// The player fades out whatever is playing when the queue changes.
+	if err := gs.p.SetPlaylist(pl); err != nil {
+		return nil, err
+	}
+	gs.settings.CombatPlaylist = pl.Title
+	gs.save()
+	gs.publish(EventSettingsChanged)
+
+	gs.start(gs.p)
+	return pl, nil
+}
+
+// EndCombat goes back to what was playing before combat, where it left off.
+// It returns the track we're back to, if there was anything playing.
+func (gs *Session) EndCombat() (Track, bool, error) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if gs.combat == nil {
+		return Track{}, false, ErrNotInCombat
+	}
+	rp := gs.combat.resume
+	if rp != nil {
+		if err := gs.voiceReady(); err != nil {
+			return Track{}, false, err
+		}
+	}
+	gs.combat = nil
+	gs.publish(EventSettingsChanged)
+
+	if rp == nil {
+		gs.p.Stop()
+		return Track{}, false, nil
+	}
+
+	if err := gs.p.Restore(rp); err != nil {
+		return Track{}, false, err
+	}
+	gs.start(gs.p)
+	return rp.Tracks[rp.Current], true, nil
+}
+
+// CombatPlaylist returns the title of the playlist last used for combat.
+func (gs *Session) CombatPlaylist() string {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.settings.CombatPlaylist
+}
+
+// InCombat reports whether we're in combat.
+func (gs *Session) InCombat() bool {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.combat != nil
+}
+
+// sceneList returns the scenes sorted by name.
+// Must be called with the session locked.
+func (gs *Session) sceneList() []*Scene {
+	scenes := []*Scene{}
+	for _, sc := range gs.scenes {
+		scenes = append(scenes, sc)
+	}
+	sort.Slice(scenes, func(i, j int) bool {
+		return sceneKey(scenes[i].Name) < sceneKey(scenes[j].Name)
+	})
+	return scenes
+}
+
+func (gs *Session) Scenes() []*Scene {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.sceneList()
+}
+
+// Scene returns the name of the scene last switched to.
+func (gs *Session) Scene() string {
+	gs.Lock()
+	defer gs.Unlock()
+	return gs.scene
+}
+
+// SaveScene adds a scene, replacing any scene with the same name.
+func (gs *Session) SaveScene(sc *Scene) error {
+	if err := sc.Validate(); err != nil {
+		return err
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	if sc.Playlist != "" {
+		pl, ok := gs.findPlaylist(sc.Playlist)
+		if !ok {
+			return ErrGuildPlaylistDoesNotExist
+		}
+		sc.Playlist = pl.Title
+	}
+
+	gs.scenes[sceneKey(sc.Name)] = sc
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return nil
+}
+
+// CurrentScene describes what's playing now as a scene, ready to be saved.
+func (gs *Session) CurrentScene(name string) *Scene {
+	gs.Lock()
+	defer gs.Unlock()
+
+	sc := &Scene{
+		Name:           name,
+		Volume:         gs.mix.Volume(),
+		AmbienceVolume: gs.ambience.Layer().Volume(),
+		QueueMode:      gs.p.QueueMode(),
+		Shuffle:        gs.p.Shuffle(),
+		Loop:           gs.p.Loop(),
+		Crossfade:      gs.p.Crossfade(),
+	}
+	if gs.p.On() {
+		sc.Playlist = gs.settings.Playlist
+	}
+	if gs.ambience.On() {
+		sc.Ambience = gs.ambienceSource
+	}
+	return sc
+}
+
+func (gs *Session) RemoveScene(name string) error {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if _, ok := gs.scenes[sceneKey(name)]; !ok {
+		return ErrSceneDoesNotExist
+	}
+	delete(gs.scenes, sceneKey(name))
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return nil
+}
+
+// SetScene switches to a scene. Everything the scene needs is looked up
+// before anything changes, so if it fails the session is left as it was.
+// The ambience is looked up with the session unlocked, then the whole scene
+// is applied at once.
+func (gs *Session) SetScene(name string, requester Requester) (*Scene, error) {
+	gs.Lock()
+	sc, ok := gs.scenes[sceneKey(name)]
+	var err error
+	if !ok {
+		err = ErrSceneDoesNotExist
+	} else if _, err = gs.sceneMusic(sc); err == nil && (sc.Playlist != "" || sc.Ambience != "") {
+		err = gs.voiceReady()
+	}
+	gs.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var ambience *Playlist
+	var ambienceSource string
+	if sc.Ambience != "" {
+		if ambience, ambienceSource, err = gs.findAmbience(sc.Ambience, requester); err != nil {
+			return nil, fmt.Errorf("can't find the ambience of %s: %w", sc.Name, err)
+		}
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+
+	// The scene might have changed while we were searching.
+	cur, ok := gs.scenes[sceneKey(name)]
+	if !ok {
+		return nil, ErrSceneDoesNotExist
+	} else if cur.Ambience != sc.Ambience {
+		return nil, fmt.Errorf("the scene %s changed while it was being set, try again", sc.Name)
+	}
+	sc = cur
+
+	music, err := gs.sceneMusic(sc)
+	if err != nil {
+		return nil, err
+	}
+	if music != nil || ambience != nil {
+		if err := gs.voiceReady(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Everything below was checked when the scene was saved.
+	if sc.QueueMode != "" {
+		gs.p.SetQueueMode(sc.QueueMode)
+		gs.settings.QueueMode = sc.QueueMode
+	}
+	gs.p.SetShuffle(sc.Shuffle)
+	gs.settings.Shuffle = sc.Shuffle
+	if sc.Loop != "" {
+		gs.p.SetLoop(sc.Loop)
+		gs.settings.Loop = sc.Loop
+	}
+	gs.p.SetCrossfade(sc.Crossfade)
+	gs.settings.Crossfade = sc.Crossfade
+	gs.mix.SetVolume(sc.Volume)
+	gs.settings.Volume = sc.Volume
+	gs.ambience.Layer().SetVolume(sc.AmbienceVolume)
+	gs.settings.AmbienceVolume = sc.AmbienceVolume
+
+	// A scene is a fresh start, there's no going back to before combat.
+	gs.combat = nil
+	gs.scene = sc.Name
+
+	if music != nil {
+		gs.p.SetPlaylist(music)
+		gs.settings.Playlist = music.Title
+		gs.start(gs.p)
+	} else {
+		gs.p.Stop()
+	}
+
+	if ambience != nil {
+		gs.ambience.SetPlaylist(ambience)
+		gs.ambienceSource = ambienceSource
+		gs.start(gs.ambience)
+	} else {
+		gs.ambience.Stop()
+	}
+
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return sc, nil
+}
+
+// sceneMusic finds the playlist a scene plays, if it has one.
+// Must be called with the session locked.
+func (gs *Session) sceneMusic(sc *Scene) (*Playlist, error) {
+	if sc.Playlist == "" {
+		return nil, nil
+	}
+	music, ok := gs.findPlaylist(sc.Playlist)
+	if !ok {
+		return nil, fmt.Errorf("the scene %s plays %s, which doesn't exist anymore", sc.Name, sc.Playlist)
+	}
+	if len(music.Tracks) == 0 {
+		return nil, fmt.Errorf("the playlist %s is empty", music.Title)
+	}
+	return music, nil
+}
+
+// Leave stops everything and leaves voice.
+func (gs *Session) Leave() {
+	gs.Lock()
+	gs.combat = nil
+	gs.Unlock()
+
+	gs.Stop()
+	gs.ambience.Stop()
+	gs.sfx.Stop()
+	gs.mix.Stop()
+}
+
+// PlayEffect plays a sound effect over whatever else is playing.
+func (gs *Session) PlayEffect(name string) error {
+	gs.Lock()
+	msg, joinVoice := gs.msg, gs.joinVoice
+	err := gs.voiceReady()
+	gs.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := gs.sfx.Play(name); err != nil {
+		return err
+	}
+	gs.mix.Start(msg, joinVoice)
+	return nil
+}
+
+// AddEffect adds a sound effect from a url, replacing any effect with the
+// same name.
+func (gs *Session) AddEffect(name, url string) (*Effect, error) {
+	// Encoding takes a while, only lock once it's done.
+	e, err := gs.sfx.AddURL(name, url)
+	if err != nil {
+		return nil, err
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return e, nil
+}
+
+// UploadEffect adds an uploaded file as a sound effect, replacing any effect
+// with the same name.
+func (gs *Session) UploadEffect(name, filename string, r io.Reader) (*Effect, error) {
+	e, err := gs.sfx.AddFile(name, filename, r)
+	if err != nil {
+		return nil, err
+	}
+
+	gs.Lock()
+	defer gs.Unlock()
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return e, nil
+}
+
+func (gs *Session) RemoveEffect(name string) error {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if err := gs.sfx.Remove(name); err != nil {
+		return err
+	}
+	gs.save()
+	gs.publish(EventSettingsChanged)
+	return nil
+}
+
+func (gs *Session) Effects() []*Effect {
+	return gs.sfx.Effects()
+}
+
+// SetDucking sets whether the music is turned down under sound effects.
+func (gs *Session) SetDucking(on bool) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.mix.SetDucking(on)
+	gs.settings.Duck = on
+	gs.save()
+	gs.publish(EventSettingsChanged)
+}
+
+func (gs *Session) Ducking() bool {
+	return gs.mix.Ducking()
+}
+
+// SetNormalize turns loudness normalization on or off.
+func (gs *Session) SetNormalize(on bool) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.p.SetNormalize(on)
+	gs.settings.Normalize = on
+	gs.save()
+	gs.publish(EventSettingsChanged)
+}
+
+func (gs *Session) Normalize() bool {
+	return gs.p.Normalize()
+}
+
+// SetShuffle turns shuffle on or off.
+func (gs *Session) SetShuffle(on bool) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.p.SetShuffle(on)
+	gs.settings.Shuffle = on
+	gs.save()
+	gs.publish(EventSettingsChanged)
+}
+
+func (gs *Session) Shuffle() bool {
+	return gs.p.Shuffle()
+}
+
+// SetLoop sets what happens when a track ends, or the queue runs out.
+func (gs *Session) SetLoop(mode LoopMode) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.p.SetLoop(mode)
+	gs.settings.Loop = mode
+	gs.save()
+	gs.publish(EventSettingsChanged)
+}
+
+func (gs *Session) Loop() LoopMode {
+	return gs.p.Loop()
+}
+
+// Permissions says who may control the music.
+func (gs *Session) Permissions() Permissions {
+	gs.Lock()
+	defer gs.Unlock()
+
+	p := gs.settings.Permissions
+	p.Roles = map[Permission]Role{}
+	for perm, r := range gs.settings.Permissions.Roles {
+		p.Roles[perm] = r
+	}
+	return p
+}
+
+// Allowed checks that a member may do something.
+func (gs *Session) Allowed(m Member, perm Permission) error {
+	return gs.Permissions().Allowed(m, perm)
+}
+
+// SetDJRole sets the id of the DJ role, empty for none.
+func (gs *Session) SetDJRole(roleID string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.settings.Permissions.DJRole = roleID
+	gs.save()
+	gs.publish(EventSettingsChanged)
+}
+
+// SetDM sets the user id of the DM, empty for none.
+func (gs *Session) SetDM(userID string) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	gs.settings.Permissions.DM = userID
+	gs.save()
+	gs.publish(EventSettingsChanged)
+}
+
+// SetPermission sets who may do something.
+func (gs *Session) SetPermission(perm Permission, r Role) {
+	gs.Lock()
+	defer gs.Unlock()
+
+	if gs.settings.Permissions.Roles == nil {
+		gs.settings.Permissions.Roles = map[Permission]Role{}
+	}
+	gs.settings.Permissions.Roles[perm] = r
+	gs.save()
+	gs.publish(EventSettingsChanged)
+}
+
 func (gs *Session) Playlists() []*Playlist {
 	gs.Lock()
 	defer gs.Unlock()
@@ -190,12 +1274,24 @@ func (gs *Session) AddPlaylist(p *Playlist) error {
 	gs.Lock()
 	defer gs.Unlock()
 
-	return gs.playlists.Insert(p)
+	if err := gs.playlists.Insert(p); err != nil {
+		return err
+	}
+
+	gs.save()
+	gs.publish(EventPlaylistsChanged)
+	return nil
 }
 
 func (gs *Session) RemovePlaylist(title string) error {
 	gs.Lock()
 	defer gs.Unlock()
 
-	return gs.playlists.Remove(title)
+	if err := gs.playlists.Remove(title); err != nil {
+		return err
+	}
+
+	gs.save()
+	gs.publish(EventPlaylistsChanged)
+	return nil
 }
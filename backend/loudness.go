@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math"
+)
+
+// Loudness is measured as in ITU-R BS.1770 (which EBU R128 builds on): the
+// audio is K-weighted, its power measured over overlapping 400ms blocks, and
+// the blocks are gated so silence and quiet passages don't drag the result
+// down.
+
+const (
+	// targetLoudness is the integrated loudness tracks are normalized to,
+	// in LUFS. It's the same target ReplayGain uses, a little louder than
+	// broadcast but plenty of headroom for music.
+	targetLoudness = -18.0
+
+	absoluteGate = -70.0
+	relativeGate = -10.0
+
+	// Blocks are 400ms long, overlapping by 75%, so we measure power over
+	// 100ms steps and combine four at a time.
+	loudnessStep      = sampleRate / 10
+	loudnessStepBlock = 4
+)
+
+// biquad is a second order IIR filter.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the K-weighting filters for 48kHz, a high shelf
+// modelling the head followed by a high pass.
+func kWeighting() []*biquad {
+	return []*biquad{
+		{
+			b0: 1.53512485958697, b1: -2.69169618940638, b2: 1.19839281085285,
+			a1: -1.69065929318241, a2: 0.73248077421585,
+		},
+		{
+			b0: 1, b1: -2, b2: 1,
+			a1: -1.99004745483398, a2: 0.99007225036621,
+		},
+	}
+}
+
+// loudnessMeter measures the integrated loudness and peak of a track as its
+// frames are added.
+type loudnessMeter struct {
+	filters [channels][]*biquad
+
+	// steps holds the mean square of every 100ms step, summed over channels.
+	steps   []float64
+	sum     float64
+	samples int
+
+	peak float64
+}
+
+func newLoudnessMeter() *loudnessMeter {
+	m := &loudnessMeter{}
+	for c := range m.filters {
+		m.filters[c] = kWeighting()
+	}
+	return m
+}
+
+// Add measures a frame of interleaved PCM.
+func (m *loudnessMeter) Add(pcm []int16) {
+	for i := 0; i+channels <= len(pcm); i += channels {
+		for c := 0; c < channels; c++ {
+			x := float64(pcm[i+c]) / -math.MinInt16
+			if abs := math.Abs(x); abs > m.peak {
+				m.peak = abs
+			}
+
+			for _, f := range m.filters[c] {
+				x = f.process(x)
+			}
+			m.sum += x * x
+		}
+
+		m.samples++
+		if m.samples == loudnessStep {
+			m.steps = append(m.steps, m.sum/loudnessStep)
+			m.sum, m.samples = 0, 0
+		}
+	}
+}
+
+func powerToLoudness(power float64) float64 {
+	return -0.691 + 10*math.Log10(power)
+}
+
+// Integrated returns the integrated loudness in LUFS, and false if the track
+// was too short or too quiet to measure.
+func (m *loudnessMeter) Integrated() (float64, bool) {
+	blocks := []float64{}
+	for i := 0; i+loudnessStepBlock <= len(m.steps); i++ {
+		power := 0.0
+		for _, s := range m.steps[i : i+loudnessStepBlock] {
+			power += s
+		}
+		blocks = append(blocks, power/loudnessStepBlock)
+	}
+
+	gated := func(threshold float64) (float64, bool) {
+		power, n := 0.0, 0
+		for _, b := range blocks {
+			if b > 0 && powerToLoudness(b) > threshold {
+				power += b
+				n++
+			}
+		}
+		if n == 0 {
+			return 0, false
+		}
+		return power / float64(n), true
+	}
+
+	power, ok := gated(absoluteGate)
+	if !ok {
+		return 0, false
+	}
+
+	power, ok = gated(powerToLoudness(power) + relativeGate)
+	if !ok {
+		return 0, false
+	}
+	return powerToLoudness(power), true
+}
+
+// Gain returns the gain in dB that brings the track to targetLoudness,
+// without letting its peak clip. ok is false if the track couldn't be
+// measured.
+func (m *loudnessMeter) Gain() (float64, bool) {
+	loudness, ok := m.Integrated()
+	if !ok {
+		return 0, false
+	}
+
+	gain := targetLoudness - loudness
+	if headroom := -20 * math.Log10(m.peak); gain > headroom {
+		gain = headroom
+	}
+	return gain, true
+}
+
+// dbToGain converts decibels to a linear gain.
+func dbToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
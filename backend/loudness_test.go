@@ -0,0 +1,91 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// sineFrames returns seconds of a stereo sine wave at freq Hz, with a peak
+// of amplitude (1 being full scale).
+func sineFrames(freq, amplitude float64, seconds int) [][]int16 {
+	frames := [][]int16{}
+	n := 0
+	for i := 0; i < seconds*sampleRate/frameSize; i++ {
+		pcm := newFrame()
+		for s := 0; s < frameSize; s++ {
+			v := amplitude * math.Sin(2*math.Pi*freq*float64(n)/sampleRate)
+			n++
+			for c := 0; c < channels; c++ {
+				pcm[s*channels+c] = clip(v * math.MaxInt16)
+			}
+		}
+		frames = append(frames, pcm)
+	}
+	return frames
+}
+
+func TestLoudnessMeter(t *testing.T) {
+	tests := []struct {
+		name      string
+		amplitude float64
+		want      float64
+	}{
+		// BS.1770 is defined so a full scale 1kHz sine in both channels
+		// measures 0 LUFS.
+		{name: "0 dBFS", amplitude: 1, want: 0},
+		{name: "-20 dBFS", amplitude: 0.1, want: -20},
+	}
+
+	for _, tc := range tests {
+		m := newLoudnessMeter()
+		for _, pcm := range sineFrames(1000, tc.amplitude, 5) {
+			m.Add(pcm)
+		}
+
+		got, ok := m.Integrated()
+		if !ok {
+			t.Fatalf("%s: couldn't measure loudness", tc.name)
+		}
+		if math.Abs(got-tc.want) > 0.1 {
+			t.Errorf("%s: loudness = %.2f LUFS, want %.2f", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLoudnessMeterSilence(t *testing.T) {
+	m := newLoudnessMeter()
+	for i := 0; i < 250; i++ {
+		m.Add(newFrame())
+	}
+
+	if _, ok := m.Integrated(); ok {
+		t.Error("measured the loudness of silence, want it gated out")
+	}
+	if _, ok := m.Gain(); ok {
+		t.Error("got a gain for silence")
+	}
+}
+
+func TestLoudnessGain(t *testing.T) {
+	// A quiet track is boosted up to the target.
+	m := newLoudnessMeter()
+	for _, pcm := range sineFrames(1000, 0.01, 5) {
+		m.Add(pcm)
+	}
+	gain, ok := m.Gain()
+	if !ok {
+		t.Fatal("couldn't measure loudness")
+	}
+	if math.Abs(gain-(targetLoudness+40)) > 0.1 {
+		t.Errorf("gain = %.2f dB, want %.2f", gain, targetLoudness+40)
+	}
+
+	// A loud track is turned down.
+	m = newLoudnessMeter()
+	for _, pcm := range sineFrames(1000, 1, 5) {
+		m.Add(pcm)
+	}
+	if gain, _ := m.Gain(); math.Abs(gain-targetLoudness) > 0.1 {
+		t.Errorf("gain = %.2f dB, want %.2f", gain, targetLoudness)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -27,6 +29,7 @@ var (
 	videoDir      string
 	workingDir    string
 	siteURL       string
+	cacheSizeMB   int
 )
 
 func init() {
@@ -38,6 +41,10 @@ func init() {
 	flag.StringVar(&workingDir, "working-dir", ".", "working-directory")
 	flag.IntVar(&port, "p", 8080, "port to run the discord bot")
 	flag.StringVar(&runningDir, "d", "", "running directory")
+	flag.StringVar(&youtubeDLPath, "youtube-dl", "youtube-dl", "path of the youtube-dl binary")
+	flag.StringVar(&ffmpegPath, "ffmpeg", "ffmpeg", "path of the ffmpeg binary")
+	flag.StringVar(&opusBitrate, "bitrate", "96k", "opus bitrate used when encoding tracks")
+	flag.IntVar(&cacheSizeMB, "cache-size", 2048, "size of the track cache in MB, 0 disables it")
 }
 
 func validatePassword(pw string) error {
@@ -57,15 +64,17 @@ func validateWorkingDir() {
 	}
 }
 
-func initBot(ongoingSessions *SessionManager) *discordgo.Session {
+func initBot(ongoingSessions *SessionManager, auth *Auth) *discordgo.Session {
 	dg, err := discordgo.New("Bot " + token)
 	if err != nil {
 		log.Fatal("cannot init discord bot", err)
 	}
 
 	// dg.LogLevel = discordgo.LogDebug
-	s := &DiscordBot{ongoingSessions}
+	s := NewDiscordBot(ongoingSessions, auth)
 	dg.AddHandler(s.incomingMessage)
+	dg.AddHandler(s.incomingInteraction)
+	dg.AddHandler(s.ready)
 
 	if err = dg.Open(); err != nil {
 		log.Fatal("cannot init websocket: ", err)
@@ -89,6 +98,15 @@ func initADM() {
 	}
 }
 
+func initCache() {
+	// XXX: dirty global
+	c, err := NewTrackCache(path.Join(videoDir, "tracks"), getTrackCachePath(), int64(cacheSizeMB)<<20)
+	if err != nil {
+		log.Fatalf("cannot init track cache: %v", err)
+	}
+	trackCache = c
+}
+
 func main() {
 	flag.Parse()
 
@@ -109,17 +127,43 @@ func main() {
 		log.Fatal("no site url provided")
 	}
 
+	initSample()
+	initCache()
+
+	// XXX: dirty global
+	effectsDir = path.Join(workingDir, "effects")
+
+	store, err := NewGuildStore(path.Join(workingDir, "guilds"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ongoingSessions := &SessionManager{
 		sessions:    sync.Map{},
 		guildLookup: sync.Map{},
+		store:       store,
 	}
 
-	dg := initBot(ongoingSessions)
+	if err := ongoingSessions.Load(); err != nil {
+		log.Fatalf("cannot load sessions: %v", err)
+	}
 
-	log.Println("discord initalized ...") // XXX: Debug
-	handlerInit(ongoingSessions)
+	secret, err := LoadAuthKey(path.Join(workingDir, "auth.key"))
+	if err != nil {
+		log.Fatalf("cannot load auth key: %v", err)
+	}
 
-	initSample()
+	// The bot has to be up before anyone can log in, so it's fine for the
+	// member lookup to refer to it before it's made.
+	var dg *discordgo.Session
+	auth := NewAuth(secret, !strings.HasPrefix(siteURL, "http://"), func(guildID, userID string) (*Member, error) {
+		return guildMember(dg, guildID, userID)
+	})
+
+	dg = initBot(ongoingSessions, auth)
+
+	log.Println("discord initalized ...") // XXX: Debug
+	handlerInit(ongoingSessions, auth)
 
 	sc := make(chan os.Signal, 1)
 
@@ -133,5 +177,9 @@ func main() {
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
 	<-sc
 
+	ongoingSessions.SaveAll()
+	if err := trackCache.Flush(); err != nil {
+		log.Printf("error saving the track cache: %v", err)
+	}
 	dg.Close()
 }
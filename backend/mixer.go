@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/layeh/gopus"
+)
+
+// The player works on PCM between decoding tracks and sending them to
+// discord, so tracks can be faded and mixed together. A frame of PCM is
+// frameSize samples of interleaved stereo audio.
+
+const (
+	// fadeOutDuration is how long a track takes to fade out when it's skipped
+	// or stopped.
+	fadeOutDuration = 300 * time.Millisecond
+
+	// maxCrossfade is the longest crossfade a session can set.
+	maxCrossfade = 10 * time.Second
+
+	// Volumes are in percent.
+	defaultVolume         = 100
+	defaultAmbienceVolume = 50
+	maxVolume             = 200
+)
+
+func durationFrames(d time.Duration) int {
+	return int(d / frameDuration)
+}
+
+// newFrame returns a frame of silence.
+func newFrame() []int16 {
+	return make([]int16, frameSize*channels)
+}
+
+func clip(v float64) int16 {
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	} else if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
+
+// fadeFrame scales a frame in place, ramping the gain from from to to over
+// the length of the frame so there are no steps between frames.
+func fadeFrame(pcm []int16, from, to float64) {
+	samples := len(pcm) / channels
+	for i := 0; i < samples; i++ {
+		gain := from + (to-from)*float64(i)/float64(samples)
+		for c := 0; c < channels; c++ {
+			pcm[i*channels+c] = clip(float64(pcm[i*channels+c]) * gain)
+		}
+	}
+}
+
+// fadeFrames fades a run of frames from one gain to another, in place.
+func fadeFrames(frames [][]int16, from, to float64) {
+	n := float64(len(frames))
+	for i, pcm := range frames {
+		fadeFrame(pcm,
+			from+(to-from)*float64(i)/n,
+			from+(to-from)*float64(i+1)/n)
+	}
+}
+
+// mixFrame adds src into dst.
+func mixFrame(dst, src []int16) {
+	for i := range dst {
+		if i >= len(src) {
+			return
+		}
+		dst[i] = clip(float64(dst[i]) + float64(src[i]))
+	}
+}
+
+// parseBitrate parses bitrates the way ffmpeg takes them, like "96k".
+func parseBitrate(s string) (int, error) {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		mult = 1000
+		s = s[:len(s)-1]
+	case strings.HasSuffix(s, "M"):
+		mult = 1000 * 1000
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%#v is not a bitrate, try something like 96k", s)
+	}
+	return n * mult, nil
+}
+
+// newEncoder creates the opus encoder for audio going out to discord.
+func newEncoder() (*gopus.Encoder, error) {
+	enc, err := gopus.NewEncoder(sampleRate, channels, gopus.Audio)
+	if err != nil {
+		return nil, fmt.Errorf("newEncoder: %w", err)
+	}
+
+	bitrate, err := parseBitrate(opusBitrate)
+	if err != nil {
+		return nil, fmt.Errorf("newEncoder: %w", err)
+	}
+	enc.SetBitrate(bitrate)
+	return enc, nil
+}
+
+// decodeFrame decodes an opus packet to a single frame of PCM.
+func decodeFrame(dec *gopus.Decoder, pkt []byte) ([]int16, error) {
+	pcm, err := dec.Decode(pkt, frameSize, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Our packets are always a frame long, but don't trust that blindly,
+	// everything downstream assumes a whole frame.
+	if len(pcm) != frameSize*channels {
+		frame := newFrame()
+		copy(frame, pcm)
+		pcm = frame
+	}
+	return pcm, nil
+}
+
+// Layer is one source of audio in a session, like the music or the
+// ambience. Each layer has its own volume and is mixed with the others.
+type Layer struct {
+	frames chan []int16
+
+	// volume is in percent, it's read by the mixer every frame.
+	volume int32
+}
+
+func newLayer(volume int) *Layer {
+	// Players already read well ahead, so keep this short or skipping and
+	// pausing take a while to be heard.
+	return &Layer{frames: make(chan []int16, 10), volume: int32(volume)}
+}
+
+func (l *Layer) SetVolume(volume int) error {
+	if volume < 0 || volume > maxVolume {
+		return fmt.Errorf("volume has to be between 0 and %d", maxVolume)
+	}
+	atomic.StoreInt32(&l.volume, int32(volume))
+	return nil
+}
+
+func (l *Layer) Volume() int {
+	return int(atomic.LoadInt32(&l.volume))
+}
+
+// Mixer mixes the layers of a session together and sends the result to
+// discord. It joins voice when started and leaves once it's stopped, or
+// when nothing has played for a while.
+type Mixer struct {
+	sync.Mutex
+
+	layers []*Layer
+	// volume is the master volume, in percent.
+	volume int
+
+	// duck is a layer the others are turned down under while it plays, if
+	// ducking is on. duckGain is how far down they are, it's only touched
+	// by mix.
+	duck     *Layer
+	ducking  bool
+	duckGain float64
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// hold keeps us in voice while nothing is playing, if it's set and
+	// returns true.
+	hold func() bool
+	// onExit is called whenever the mixer stops.
+	onExit func()
+}
+
+func NewMixer(layers ...*Layer) *Mixer {
+	return &Mixer{layers: layers, volume: defaultVolume, duckGain: 1}
+}
+
+// Start joins voice and starts mixing, unless we're already running.
+func (m *Mixer) Start(msg func(string) error, joinVoice func() (*discordgo.VoiceConnection, error)) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prev, done := m.done, make(chan struct{})
+	m.cancel, m.done = cancel, done
+
+	go func() {
+		defer close(done)
+		if prev != nil {
+			// Let the last voice connection close before opening another.
+			<-prev
+		}
+
+		err := m.run(ctx, joinVoice)
+		cancel()
+
+		m.Lock()
+		if m.done == done {
+			m.cancel = nil
+		}
+		onExit := m.onExit
+		m.Unlock()
+
+		if err != nil {
+			log.Println("Mixer: error: ", err)
+			msg(fmt.Sprintf("uh oh: %v", err))
+		}
+		if onExit != nil {
+			onExit()
+		}
+	}()
+}
+
+// Stop leaves voice.
+func (m *Mixer) Stop() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.cancel != nil {
+		m.cancel()
+		m.cancel = nil
+	}
+}
+
+func (m *Mixer) Running() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.cancel != nil
+}
+
+func (m *Mixer) SetVolume(volume int) error {
+	if volume < 0 || volume > maxVolume {
+		return fmt.Errorf("volume has to be between 0 and %d", maxVolume)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	m.volume = volume
+	return nil
+}
+
+func (m *Mixer) Volume() int {
+	m.Lock()
+	defer m.Unlock()
+	return m.volume
+}
+
+// SetDucking sets whether the other layers are turned down while the duck
+// layer plays.
+func (m *Mixer) SetDucking(on bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.ducking = on
+}
+
+func (m *Mixer) Ducking() bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.ducking
+}
+
+// stepDuck moves duckGain a frame closer to where it's headed, quickly
+// down to duckVolume while ducked and slowly back up after.
+func (m *Mixer) stepDuck(ducked bool) {
+	low := float64(duckVolume) / 100
+	if ducked {
+		m.duckGain -= (1 - low) / float64(durationFrames(duckAttack))
+		if m.duckGain < low {
+			m.duckGain = low
+		}
+		return
+	}
+
+	m.duckGain += (1 - low) / float64(durationFrames(duckRelease))
+	if m.duckGain > 1 {
+		m.duckGain = 1
+	}
+}
+
+func (m *Mixer) holding() bool {
+	m.Lock()
+	hold := m.hold
+	m.Unlock()
+	return hold != nil && hold()
+}
+
+// idleTimeout is how long we stay in voice with nothing to play.
+const idleTimeout = 2 * time.Minute
+
+// timedOut reports whether we've had nothing to play for long enough to
+// leave. We stay while held, they'll be back.
+func (m *Mixer) timedOut(idle time.Duration) bool {
+	return idle > idleTimeout && !m.holding()
+}
+
+// mix takes a frame from every layer that has one ready, applying each
+// layer's volume as it goes. gains holds the gain each layer was last
+// played at, so volume changes are ramped rather than stepped.
+func (m *Mixer) mix(gains []float64) ([]int16, bool) {
+	frames := make([][]int16, len(m.layers))
+	ducked := false
+	for i, l := range m.layers {
+		select {
+		case frames[i] = <-l.frames:
+			if l == m.duck {
+				ducked = m.Ducking()
+			}
+		default:
+		}
+	}
+	m.stepDuck(ducked)
+
+	var out []int16
+	for i, pcm := range frames {
+		if pcm == nil {
+			continue
+		}
+
+		l := m.layers[i]
+		next := float64(l.Volume()) / 100
+		if l != m.duck {
+			next *= m.duckGain
+		}
+		if gains[i] != 1 || next != 1 {
+			fadeFrame(pcm, gains[i], next)
+		}
+		gains[i] = next
+
+		if out == nil {
+			out = pcm
+		} else {
+			mixFrame(out, pcm)
+		}
+	}
+	return out, out != nil
+}
+
+// run is responsible for handling the discord audio connection.
+func (m *Mixer) run(ctx context.Context, joinVoice func() (*discordgo.VoiceConnection, error)) error {
+	conn, err := joinVoice()
+	if err != nil {
+		return err
+	}
+	defer conn.Disconnect()
+
+	// conn.LogLevel = discordgo.LogDebug // uncomment if stuff starts acting weird
+	if err := waitForReady(conn); err != nil {
+		return err
+	}
+
+	if err := conn.Speaking(true); err != nil {
+		return err
+	}
+
+	enc, err := newEncoder()
+	if err != nil {
+		return err
+	}
+
+	gains := make([]float64, len(m.layers))
+	for i, l := range m.layers {
+		gains[i] = float64(l.Volume()) / 100
+	}
+	master := 1.0
+
+	// Nothing paces us while there's nothing to play, so check back every
+	// frame until there is.
+	tick := time.NewTicker(frameDuration)
+	defer tick.Stop()
+	lastFrame := time.Now()
+
+	for {
+		in, ok := m.mix(gains)
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-tick.C:
+			}
+
+			// Haven't got a frame in a long time, assume everything is okay
+			// and we are supposed to leave now. This doubles as an auto
+			// timeout, unless we've been paused.
+			if m.timedOut(time.Since(lastFrame)) {
+				return nil
+			}
+			continue
+		}
+		lastFrame = time.Now()
+
+		// Ramp between volumes so changing it doesn't click.
+		next := float64(m.Volume()) / 100
+		if master != 1 || next != 1 {
+			fadeFrame(in, master, next)
+		}
+		master = next
+
+		opus, err := enc.Encode(in, frameSize, maxBytes)
+		if err != nil {
+			return fmt.Errorf("couldn't encode audio: %w", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case conn.OpusSend <- opus:
+		case <-time.After(time.Second):
+			// We haven't been able to send a frame in a second, assume something is fucked
+			return errors.New("couldn't send audio to discord")
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/layeh/gopus"
+)
+
+func TestFadeFrame(t *testing.T) {
+	pcm := newFrame()
+	for i := range pcm {
+		pcm[i] = 1000
+	}
+
+	fadeFrame(pcm, 1, 0)
+	if pcm[0] != 1000 || pcm[1] != 1000 {
+		t.Errorf("first sample = %d,%d, want it untouched", pcm[0], pcm[1])
+	}
+	if last := pcm[len(pcm)-1]; last < 0 || last > 2 {
+		t.Errorf("last sample = %d, want it faded to ~0", last)
+	}
+	for i := channels; i < len(pcm); i += channels {
+		if pcm[i] > pcm[i-channels] {
+			t.Fatalf("sample %d gets louder while fading out", i)
+		}
+	}
+}
+
+func TestMixFrameClips(t *testing.T) {
+	a, b := newFrame(), newFrame()
+	a[0], b[0] = 30000, 30000
+	a[1], b[1] = -30000, -30000
+
+	mixFrame(a, b)
+	if a[0] != 32767 || a[1] != -32768 {
+		t.Errorf("mixed = %d,%d, want it clipped to 32767,-32768", a[0], a[1])
+	}
+}
+
+func TestMixerLayers(t *testing.T) {
+	music, ambience := newLayer(defaultVolume), newLayer(defaultAmbienceVolume)
+	m := NewMixer(music, ambience)
+	gains := []float64{1, 0.5}
+
+	if _, ok := m.mix(gains); ok {
+		t.Fatal("mix() with nothing queued returned a frame")
+	}
+
+	frame := func(v int16) []int16 {
+		pcm := newFrame()
+		for i := range pcm {
+			pcm[i] = v
+		}
+		return pcm
+	}
+
+	music.frames <- frame(1000)
+	ambience.frames <- frame(1000)
+	out, ok := m.mix(gains)
+	if !ok {
+		t.Fatal("mix() returned nothing")
+	}
+	if out[0] != 1500 {
+		t.Errorf("mixed sample = %d, want 1500", out[0])
+	}
+
+	// Only the ambience is playing.
+	ambience.frames <- frame(1000)
+	out, ok = m.mix(gains)
+	if !ok || out[0] != 500 {
+		t.Errorf("ambience alone = %d, want 500", out[0])
+	}
+}
+
+func TestMixerDucking(t *testing.T) {
+	music, sfx := newLayer(defaultVolume), newLayer(defaultVolume)
+	m := NewMixer(music, sfx)
+	m.duck = sfx
+	gains := []float64{1, 1}
+
+	mix := func(effect bool) {
+		music.frames <- newFrame()
+		if effect {
+			sfx.frames <- newFrame()
+		}
+		if _, ok := m.mix(gains); !ok {
+			t.Fatal("mix() returned nothing")
+		}
+	}
+
+	// Ducking is off, effects play over the music as is.
+	mix(true)
+	if gains[0] != 1 {
+		t.Errorf("music gain = %v without ducking, want 1", gains[0])
+	}
+
+	m.SetDucking(true)
+	for i := 0; i < durationFrames(duckAttack); i++ {
+		mix(true)
+	}
+	if low := float64(duckVolume) / 100; gains[0] < low-1e-9 || gains[0] > low+1e-9 {
+		t.Errorf("music gain = %v while ducked, want %v", gains[0], low)
+	}
+	if gains[1] != 1 {
+		t.Errorf("effect gain = %v, want it untouched", gains[1])
+	}
+
+	for i := 0; i < durationFrames(duckRelease); i++ {
+		mix(false)
+	}
+	if gains[0] < 1-1e-9 {
+		t.Errorf("music gain = %v after effects finished, want 1", gains[0])
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	for in, want := range map[string]int{"96k": 96000, "64000": 64000, "1M": 1000000} {
+		got, err := parseBitrate(in)
+		if err != nil || got != want {
+			t.Errorf("parseBitrate(%#v) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "k", "fast", "-96k"} {
+		if _, err := parseBitrate(in); err == nil {
+			t.Errorf("parseBitrate(%#v) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	enc, err := gopus.NewEncoder(sampleRate, channels, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := gopus.NewDecoder(sampleRate, channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt, err := enc.Encode(newFrame(), frameSize, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm, err := decodeFrame(dec, pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pcm) != frameSize*channels {
+		t.Errorf("decoded %d samples, want %d", len(pcm), frameSize*channels)
+	}
+}
+
+// testSource returns a finished trackSource holding n frames of silence.
+func testSource(t *testing.T, n int) *trackSource {
+	src := &trackSource{
+		frames: make(chan []int16, n),
+		done:   make(chan struct{}),
+		cancel: func() {},
+		gain:   1,
+	}
+	for i := 0; i < n; i++ {
+		src.frames <- newFrame()
+	}
+	close(src.frames)
+	close(src.done)
+	return src
+}
+
+func TestDecodeTrackLoopCrossfade(t *testing.T) {
+	p := NewPlayer(QueueNormal)
+	p.q = NewPlayerQFromPlaylist(QueueNormal, []Track{{Name: "a"}, {Name: "b"}}, false)
+	p.signal = make(chan PlayerSignal)
+	if err := p.SetCrossfade(time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	audio := make(chan []int16, 100)
+	sig, tail, err := p.DecodeTrackLoop(context.Background(), audio, testSource(t, 75), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Type != SigTypeEnd {
+		t.Errorf("finished with signal %v, want end", sig.Type)
+	}
+
+	// The last second is held back to crossfade into the next track.
+	if len(tail) != 50 || len(audio) != 25 {
+		t.Errorf("sent %d frames and kept %d, want 25 and 50", len(audio), len(tail))
+	}
+	if p.frames != 25 {
+		t.Errorf("counted %d frames played, want 25", p.frames)
+	}
+
+	// A track shorter than the crossfade still plays the whole tail.
+	audio = make(chan []int16, 100)
+	p.q = NewPlayerQ(QueueNormal)
+	_, tail, err = p.DecodeTrackLoop(context.Background(), audio, testSource(t, 10), tail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tail) != 0 || len(audio) != 50 {
+		t.Errorf("sent %d frames and kept %d, want 50 and 0", len(audio), len(tail))
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	p := NewPlayer(QueueNormal)
+	p.q = NewPlayerQFromPlaylist(QueueNormal, []Track{{Name: "a", URL: "a"}, {Name: "b", URL: "b"}}, false)
+	p.playerOn = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The current track hasn't been read through yet.
+	src := &trackSource{track: Track{Name: "a", URL: "a"}, done: make(chan struct{})}
+	go p.prefetch(ctx, src)
+
+	var next *trackSource
+	waitFor(t, "the next track to be picked", func() bool {
+		p.Lock()
+		defer p.Unlock()
+		next = p.next
+		return next != nil
+	})
+	if next.track.URL != "b" {
+		t.Errorf("prefetched %#v, want b", next.track.URL)
+	}
+
+	// It isn't downloaded while the current track still is.
+	select {
+	case <-next.done:
+		t.Error("the next track was opened before the current one finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+	waitFor(t, "the next track to give up", func() bool {
+		select {
+		case <-next.done:
+			return true
+		default:
+			return false
+		}
+	})
+}
+
+func TestDecodeTrackLoopPause(t *testing.T) {
+	p := NewPlayer(QueueNormal)
+	p.q = NewPlayerQ(QueueNormal)
+	p.signal = make(chan PlayerSignal)
+
+	type result struct {
+		sig PlayerSignal
+		err error
+	}
+	audio := make(chan []int16)
+	done := make(chan result, 1)
+	go func() {
+		sig, _, err := p.DecodeTrackLoop(context.Background(), audio, testSource(t, 100), nil)
+		done <- result{sig, err}
+	}()
+
+	<-audio
+	p.signal <- SigPause
+	waitFor(t, "the pause", p.Paused)
+
+	// Nothing is sent while paused, but the track is still there.
+	select {
+	case <-audio:
+		t.Fatal("got audio while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Pausing again changes nothing.
+	p.signal <- SigPause
+	p.signal <- SigResume
+	waitFor(t, "the resume", func() bool { return !p.Paused() })
+
+	got := 1
+	for {
+		select {
+		case <-audio:
+			got++
+			continue
+		case res := <-done:
+			if res.err != nil || res.sig.Type != SigTypeEnd {
+				t.Errorf("DecodeTrackLoop() = %v, %v, want end", res.sig.Type, res.err)
+			}
+		}
+		break
+	}
+	if got != 100 {
+		t.Errorf("played %d frames, want all 100 after resuming", got)
+	}
+}
+
+func TestDecodeTrackLoopStopWhilePaused(t *testing.T) {
+	p := NewPlayer(QueueNormal)
+	p.q = NewPlayerQ(QueueNormal)
+	p.signal = make(chan PlayerSignal)
+
+	done := make(chan PlayerSignal, 1)
+	go func() {
+		sig, _, _ := p.DecodeTrackLoop(context.Background(), make(chan []int16), testSource(t, 100), nil)
+		done <- sig
+	}()
+
+	p.signal <- SigPause
+	waitFor(t, "the pause", p.Paused)
+	p.signal <- SigStop
+
+	select {
+	case sig := <-done:
+		if sig.Type != SigTypeStop {
+			t.Errorf("DecodeTrackLoop() = %v, want stop", sig.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stopping while paused didn't end the track")
+	}
+	if p.Paused() {
+		t.Error("still paused after stopping")
+	}
+}
+
+func TestPauseWhileIdle(t *testing.T) {
+	p := NewPlayer(QueueNormal)
+	if err := p.Pause(); err != ErrNotPlaying {
+		t.Errorf("Pause() before starting = %v, want ErrNotPlaying", err)
+	}
+
+	// The PlayLoop is running, but waiting for something to play.
+	p.playerOn, p.idle = true, true
+	if err := p.Pause(); err != ErrNotPlaying {
+		t.Errorf("Pause() while idle = %v, want ErrNotPlaying", err)
+	}
+}
+
+// A paused session keeps its place in voice, however long the break.
+func TestIdleTimeoutHeldWhilePaused(t *testing.T) {
+	gs := newSession("guild", "session", nil)
+
+	if gs.mix.timedOut(time.Second) {
+		t.Error("timed out after a second")
+	}
+	if !gs.mix.timedOut(idleTimeout + time.Second) {
+		t.Error("didn't time out with nothing playing")
+	}
+
+	gs.p.setPaused(true)
+	if gs.mix.timedOut(time.Hour) {
+		t.Error("timed out while paused")
+	}
+	gs.p.setPaused(false)
+	if !gs.mix.timedOut(time.Hour) {
+		t.Error("didn't time out after resuming")
+	}
+}
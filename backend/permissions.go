@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Permission is something only some people may be allowed to do.
+type Permission string
+
+const (
+	// PermSkip is skipping tracks, or removing them from the queue.
+	PermSkip Permission = "skip"
+	// PermStop is stopping, pausing or clearing the music, or sending the
+	// bot away.
+	PermStop Permission = "stop"
+	// PermPlaylist is changing what plays and how: playing or queueing
+	// music, shuffle and loop, seeking, the volume, crossfade and
+	// normalization, and adding or deleting playlists.
+	PermPlaylist Permission = "playlist"
+	// PermScene is switching, saving or deleting scenes, combat and the
+	// ambience.
+	PermScene Permission = "scene"
+	// PermSoundboard is playing, adding or removing sound effects.
+	PermSoundboard Permission = "soundboard"
+)
+
+// permissions is every Permission, in the order they're listed.
+var permissions = []Permission{PermSkip, PermStop, PermPlaylist, PermScene, PermSoundboard}
+
+func ParsePermission(s string) (Permission, error) {
+	p := Permission(strings.ToLower(s))
+	for _, known := range permissions {
+		if p == known {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown permission %#v, expected one of %s", s, joinPermissions(permissions))
+}
+
+func joinPermissions(ps []Permission) string {
+	names := make([]string, len(ps))
+	for i, p := range ps {
+		names[i] = string(p)
+	}
+	return strings.Join(names, ", ")
+}
+
+// Role is who may be allowed to do something, each includes the ones
+// before it.
+type Role string
+
+const (
+	RoleEveryone Role = "everyone"
+	RoleDJ       Role = "dj"
+	RoleDM       Role = "dm"
+)
+
+func ParseRole(s string) (Role, error) {
+	switch r := Role(strings.ToLower(s)); r {
+	case RoleEveryone, RoleDJ, RoleDM:
+		return r, nil
+	}
+	return "", fmt.Errorf("unknown role %#v, expected %#v, %#v or %#v", s, RoleEveryone, RoleDJ, RoleDM)
+}
+
+func (r Role) rank() int {
+	switch r {
+	case RoleDJ:
+		return 1
+	case RoleDM:
+		return 2
+	}
+	return 0
+}
+
+var (
+	ErrNeedDJ = errors.New("you need the DJ role to do that")
+	ErrNeedDM = errors.New("only the DM can do that")
+)
+
+// Permissions says who may control the music in a guild.
+//
+// They only apply once there's a DJ role or a DM, until then everyone can do
+// everything, as they always could.
+type Permissions struct {
+	// DJRole is the id of the DJ role.
+	DJRole string `json:"dj_role,omitempty"`
+	// DM is the user id of the DM, who can do everything.
+	DM string `json:"dm,omitempty"`
+	// Roles is who may do what, anything missing needs the DJ role.
+	Roles map[Permission]Role `json:"roles,omitempty"`
+}
+
+// Enabled reports whether anyone is restricted.
+func (p Permissions) Enabled() bool {
+	return p.DJRole != "" || p.DM != ""
+}
+
+// Role is who may do something.
+func (p Permissions) Role(perm Permission) Role {
+	if r, ok := p.Roles[perm]; ok {
+		return r
+	}
+	return RoleDJ
+}
+
+// Member is someone asking to do something, as far as permissions go.
+type Member struct {
+	UserID string
+	Roles  []string
+	// Admin is set for those who can manage the server, they can do
+	// whatever the DM can.
+	Admin bool
+}
+
+func (p Permissions) roleOf(m Member) Role {
+	if m.Admin || (p.DM != "" && m.UserID == p.DM) {
+		return RoleDM
+	}
+	for _, id := range m.Roles {
+		if p.DJRole != "" && id == p.DJRole {
+			return RoleDJ
+		}
+	}
+	return RoleEveryone
+}
+
+// Allowed checks that a member may do something, the error says who may.
+func (p Permissions) Allowed(m Member, perm Permission) error {
+	if !p.Enabled() {
+		return nil
+	}
+
+	need := p.Role(perm)
+	if p.roleOf(m).rank() >= need.rank() {
+		return nil
+	}
+	if need == RoleDM || p.DJRole == "" {
+		return ErrNeedDM
+	}
+	return ErrNeedDJ
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPermissions(t *testing.T) {
+	var (
+		player = Member{UserID: "player"}
+		dj     = Member{UserID: "dj", Roles: []string{"other", "djs"}}
+		dm     = Member{UserID: "dm"}
+		admin  = Member{UserID: "admin", Admin: true}
+	)
+
+	tests := []struct {
+		name  string
+		perms Permissions
+		m     Member
+		perm  Permission
+		want  error
+	}{
+		{name: "off", perms: Permissions{}, m: player, perm: PermSkip},
+		{name: "off with roles", perms: Permissions{Roles: map[Permission]Role{PermSkip: RoleDM}}, m: player, perm: PermSkip},
+
+		{name: "player", perms: Permissions{DJRole: "djs"}, m: player, perm: PermSkip, want: ErrNeedDJ},
+		{name: "dj", perms: Permissions{DJRole: "djs"}, m: dj, perm: PermSkip},
+		{name: "admin", perms: Permissions{DJRole: "djs"}, m: admin, perm: PermSkip},
+		{name: "everyone", perms: Permissions{DJRole: "djs", Roles: map[Permission]Role{PermSoundboard: RoleEveryone}}, m: player, perm: PermSoundboard},
+
+		{name: "dm only", perms: Permissions{DJRole: "djs", DM: "dm", Roles: map[Permission]Role{PermScene: RoleDM}}, m: dj, perm: PermScene, want: ErrNeedDM},
+		{name: "dm", perms: Permissions{DJRole: "djs", DM: "dm", Roles: map[Permission]Role{PermScene: RoleDM}}, m: dm, perm: PermScene},
+		{name: "admin as dm", perms: Permissions{DM: "dm", Roles: map[Permission]Role{PermScene: RoleDM}}, m: admin, perm: PermScene},
+
+		// Without a DJ role, only the DM can do what DJs could.
+		{name: "no dj role", perms: Permissions{DM: "dm"}, m: dj, perm: PermStop, want: ErrNeedDM},
+		{name: "no dj role dm", perms: Permissions{DM: "dm"}, m: dm, perm: PermStop},
+	}
+
+	for _, tc := range tests {
+		if got := tc.perms.Allowed(tc.m, tc.perm); got != tc.want {
+			t.Errorf("%s: Allowed(%s, %s) = %v, want %v", tc.name, tc.m.UserID, tc.perm, got, tc.want)
+		}
+	}
+}
+
+func TestParsePermissions(t *testing.T) {
+	if p, err := ParsePermission("Skip"); err != nil || p != PermSkip {
+		t.Errorf("ParsePermission(Skip) = %v, %v", p, err)
+	}
+	if _, err := ParsePermission("volume"); err == nil {
+		t.Error("expected error for an unknown permission")
+	}
+	if r, err := ParseRole("DJ"); err != nil || r != RoleDJ {
+		t.Errorf("ParseRole(DJ) = %v, %v", r, err)
+	}
+	if _, err := ParseRole("admin"); err == nil {
+		t.Error("expected error for an unknown role")
+	}
+}
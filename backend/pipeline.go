@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Paths of the binaries used to fetch and encode audio, see main.go.
+var (
+	youtubeDLPath string
+	ffmpegPath    string
+	opusBitrate   string
+)
+
+// encodeArgs builds ffmpeg arguments to encode input into an Ogg/Opus
+// stream on stdout, in the format DecodeTrackLoop expects: 48kHz stereo
+// opus in frames of frameSize samples.
+func encodeArgs(input string, offset time.Duration) []string {
+	frameMS := frameSize * 1000 / sampleRate
+
+	return []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-nostdin",
+		"-ss", fmt.Sprintf("%.3f", offset.Seconds()),
+		"-i", input,
+		"-vn",
+		"-map", "0:a:0",
+		"-c:a", "libopus",
+		"-b:a", opusBitrate,
+		"-application", "audio",
+		"-frame_duration", strconv.Itoa(frameMS),
+		"-ar", strconv.Itoa(sampleRate),
+		"-ac", strconv.Itoa(channels),
+		"-f", "ogg",
+		"pipe:1",
+	}
+}
+
+// stderrTail keeps the end of a process' stderr, enough to tell what went
+// wrong without letting a chatty process eat all our memory.
+type stderrTail struct {
+	sync.Mutex
+	buf []byte
+}
+
+const stderrTailSize = 4096
+
+func (s *stderrTail) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.buf = append(s.buf, p...)
+	if over := len(s.buf) - stderrTailSize; over > 0 {
+		s.buf = s.buf[over:]
+	}
+	return len(p), nil
+}
+
+func (s *stderrTail) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return string(s.buf)
+}
+
+// trackStream is a running pipeline of processes producing an Ogg/Opus
+// stream for a single track.
+//
+// Read from it until io.EOF, then Close it to find out if anything failed.
+// Closing early kills the pipeline.
+type trackStream struct {
+	io.Reader
+
+	name   string
+	cancel context.CancelFunc
+	cmds   []*exec.Cmd
+	stderr []*stderrTail
+
+	closeOnce sync.Once
+	err       error
+}
+
+// newTrackStream starts each command, piping the output of each one into
+// the next. Commands are given as the binary followed by its arguments.
+func newTrackStream(ctx context.Context, name string, cmds ...[]string) (*trackStream, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	ts := &trackStream{name: name, cancel: cancel}
+
+	for _, c := range cmds {
+		cmd := exec.CommandContext(ctx, c[0], c[1:]...)
+		cmd.Dir = workingDir
+		tail := &stderrTail{}
+		cmd.Stderr = tail
+
+		ts.cmds = append(ts.cmds, cmd)
+		ts.stderr = append(ts.stderr, tail)
+	}
+
+	for i := 1; i < len(ts.cmds); i++ {
+		out, err := ts.cmds[i-1].StdoutPipe()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		ts.cmds[i].Stdin = out
+	}
+
+	out, err := ts.cmds[len(ts.cmds)-1].StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	ts.Reader = out
+
+	for i, cmd := range ts.cmds {
+		if err := cmd.Start(); err != nil {
+			cancel()
+			// Reap anything we already started.
+			for _, started := range ts.cmds[:i] {
+				started.Wait()
+			}
+			return nil, fmt.Errorf("%s: cannot start %s: %w", name, cmd.Path, err)
+		}
+	}
+
+	return ts, nil
+}
+
+// wait reaps every process, returning the first failure along with what it
+// wrote to stderr.
+func (ts *trackStream) wait() error {
+	ts.closeOnce.Do(func() {
+		// Wait in reverse, readers exit before the writers feeding them.
+		errs := make([]error, len(ts.cmds))
+		for i := len(ts.cmds) - 1; i >= 0; i-- {
+			errs[i] = ts.cmds[i].Wait()
+		}
+
+		for i, err := range errs {
+			if err != nil {
+				ts.err = fmt.Errorf("%s: %s failed: %w: %s", ts.name, ts.cmds[i].Path, err, ts.stderr[i])
+				break
+			}
+		}
+		ts.cancel()
+	})
+
+	return ts.err
+}
+
+// Close waits for the pipeline to finish after reading it to the end,
+// reporting if any process failed.
+func (ts *trackStream) Close() error {
+	done := make(chan error, 1)
+	go func() { done <- ts.wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second * 10):
+		// Something is stuck, don't hang the player over it.
+		ts.Kill()
+		return fmt.Errorf("%s: timed out waiting for the pipeline to exit", ts.name)
+	}
+}
+
+// Kill stops the pipeline straight away. Errors are ignored since we killed
+// the processes ourselves.
+func (ts *trackStream) Kill() {
+	ts.cancel()
+	ts.wait()
+}
+
+// openTrackStream starts fetching and encoding a track, starting offset into
+// the track.
+func openTrackStream(ctx context.Context, t Track, offset time.Duration) (*trackStream, error) {
+	extract := extractArgs(t.URL)
+	encode := append([]string{ffmpegPath}, encodeArgs("pipe:0", offset)...)
+
+	return newTrackStream(ctx, t.Name, extract, encode)
+}
+
+// openFileStream encodes a local audio file, starting offset into the file.
+func openFileStream(ctx context.Context, path string, offset time.Duration) (*trackStream, error) {
+	encode := append([]string{ffmpegPath}, encodeArgs(path, offset)...)
+	return newTrackStream(ctx, path, encode)
+}
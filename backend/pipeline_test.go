@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonas747/ogg"
+)
+
+// opusFrameDuration reads the frame duration from the TOC byte of an opus
+// packet, see RFC 6716 section 3.1.
+func opusFrameDuration(pkt []byte) time.Duration {
+	config := pkt[0] >> 3
+	switch {
+	case config < 12: // SILK
+		return []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // Hybrid
+		return []time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT
+		return []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+}
+
+// encodeFixture runs testdata/tone.wav, a one second tone, through the
+// pipeline and returns the opus packets it produced.
+func encodeFixture(t *testing.T, offset time.Duration) [][]byte {
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	if opusBitrate == "" {
+		opusBitrate = "96k"
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	fixture, err := filepath.Abs("testdata/tone.wav")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := openFileStream(context.Background(), fixture, offset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := ogg.NewPacketDecoder(ogg.NewDecoder(stream))
+	packets := [][]byte{}
+	for {
+		pkt, _, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			stream.Kill()
+			t.Fatal(err)
+		}
+		packets = append(packets, pkt)
+	}
+
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(packets) < 2 {
+		t.Fatalf("got %d packets, want at least the opus headers", len(packets))
+	}
+	if !bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		t.Errorf("first packet is %q, want OpusHead", packets[0])
+	}
+	if !bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+		t.Errorf("second packet is %q, want OpusTags", packets[1])
+	}
+	return packets[2:]
+}
+
+func TestFileStream(t *testing.T) {
+	packets := encodeFixture(t, 0)
+
+	// One second of audio in 20ms frames, give or take encoder padding.
+	if n := len(packets); n < 48 || n > 52 {
+		t.Errorf("got %d audio packets, want ~50", n)
+	}
+	for i, pkt := range packets {
+		if d := opusFrameDuration(pkt); d != frameDuration {
+			t.Fatalf("packet %d holds %v of audio, want %v", i, d, frameDuration)
+		}
+	}
+
+	seeked := encodeFixture(t, 500*time.Millisecond)
+	if n := len(seeked); n < 23 || n > 27 {
+		t.Errorf("got %d audio packets after seeking 500ms, want ~25", n)
+	}
+}
+
+func TestFileStreamMissing(t *testing.T) {
+	if ffmpegPath == "" {
+		ffmpegPath = "ffmpeg"
+	}
+	if _, err := exec.LookPath(ffmpegPath); err != nil {
+		t.Skip("ffmpeg is not installed")
+	}
+
+	stream, err := openFileStream(context.Background(), "testdata/missing.wav", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, stream)
+
+	if err := stream.Close(); err == nil {
+		t.Error("Close() = nil for a missing file, want an error")
+	}
+}
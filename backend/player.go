@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -9,7 +10,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/bwmarrin/discordgo"
 	"github.com/devoxel/dndmusic/spotify"
 )
 
@@ -103,49 +103,132 @@ var adm *AudioDownloadManager = nil
 type Player struct {
 	sync.Mutex
 
-	q      *PlayerQ
-	audio  chan []byte
+	q      PlayerQ
+	mode   QueueMode
+	out    *Layer
 	signal chan PlayerSignal
 
 	playerOn bool
+	paused   bool
 	exit     chan struct{}
+
+	// idle is set while the PlayLoop is waiting for something to play.
+	idle bool
+
+	// frames counts the opus frames of the current track we've sent out,
+	// including any we skipped by seeking.
+	frames int
+	// seekTo is where the next track should start playing from.
+	seekTo time.Duration
+
+	// next is the upcoming track, prefetched while the current one plays.
+	next *trackSource
+
+	// crossfade is how long tracks overlap when one follows another.
+	crossfade time.Duration
+	// normalize evens out the loudness of tracks we've measured before.
+	normalize bool
+	// shuffle plays queues in a random order.
+	shuffle bool
+	loop    LoopMode
+
+	// notify is told about changes to the player, it's set once before the
+	// player is started.
+	notify func(Event)
+}
+
+// ResumePoint records what a player was doing, so playback can carry on
+// where it left off, even after a restart.
+type ResumePoint struct {
+	Tracks    []Track       `json:"tracks"`
+	Current   int           `json:"current"`
+	AutoClear bool          `json:"auto_clear,omitempty"`
+	Position  time.Duration `json:"position"`
+}
+
+var ErrNotPlaying = errors.New("i'm not playing anything")
+
+func NewPlayer(mode QueueMode) *Player {
+	if mode == "" {
+		mode = QueueNormal
+	}
+	return &Player{mode: mode, loop: LoopAuto, out: newLayer(defaultVolume)}
 }
 
-func NewPlayer() *Player {
-	return &Player{}
+// Layer is where the player's audio goes, to be mixed with the rest of the
+// session.
+func (p *Player) Layer() *Layer {
+	return p.out
 }
 
-func (p *Player) Start(msg func(msg string) error, joinVoice func() (voice *discordgo.VoiceConnection, err error)) {
+// Start starts the PlayLoop if it isn't running, done is called when it
+// exits.
+func (p *Player) Start(msg func(msg string) error, done func()) {
 	log.Println("Start(): starting...") // XXX DEBUG
 	p.Lock()
-	defer p.Unlock()
 	if p.playerOn {
-		p.signal <- SigReload
+		idle := p.idle
+		p.Unlock()
+		if idle {
+			// Wake the PlayLoop up, there's something to play now.
+			p.sendSignal(SigReload)
+		}
 		return
 	}
+	defer p.Unlock()
 
 	if p.q == nil {
-		p.q = NewPlayerQ()
+		p.q = p.newQueue()
 	}
 	p.signal = make(chan PlayerSignal)
 	p.playerOn = true
-	go p.PlayLoop(msg, joinVoice)
+	go p.PlayLoop(msg, done)
 }
 
-func (p *Player) QueueSingle(search string) (Track, error) {
+func (p *Player) QueueSingle(search string, requester Requester) (Track, error) {
 	log.Printf("QueueSingle: queueing %s", search)
-	track, err := adm.DLInfo(search)
+	track, err := p.lookup(search, requester)
 	if err != nil {
 		return Track{}, err
 	}
 
 	p.Lock()
 	if p.q == nil {
-		p.q = NewPlayerQ()
+		p.q = p.newQueue()
 	}
 	p.q.Append(track)
 	p.Unlock()
 
+	p.publish(EventQueueChanged)
+	return track, nil
+}
+
+// QueueNext queues a track to play straight after the current one.
+func (p *Player) QueueNext(search string, requester Requester) (Track, error) {
+	log.Printf("QueueNext: queueing %s", search)
+	track, err := p.lookup(search, requester)
+	if err != nil {
+		return Track{}, err
+	}
+
+	p.Lock()
+	if p.q == nil {
+		p.q = p.newQueue()
+	}
+	p.q.InsertNext(track)
+	p.Unlock()
+
+	p.publish(EventQueueChanged)
+	return track, nil
+}
+
+func (p *Player) lookup(search string, requester Requester) (Track, error) {
+	track, err := adm.DLInfo(search)
+	if err != nil {
+		return Track{}, err
+	}
+	requester.AddedAt = time.Now()
+	track.Requester = &requester
 	return track, nil
 }
 
@@ -153,12 +236,223 @@ func (p *Player) SetPlaylist(playlist *Playlist) error {
 	p.Lock()
 
 	// Set current song to top of playlist.
-	p.q = NewPlayerQFromPlaylist(playlist.Tracks)
+	p.q = NewPlayerQFromPlaylist(p.mode, playlist.Tracks, p.shuffle)
+	p.q.SetLoop(p.loop)
+	on := p.playerOn
+
+	p.Unlock()
+
+	p.publish(EventQueueChanged)
+	if on {
+		p.sendSignal(SigReload)
+	}
+	return nil
+}
+
+// Seek restarts the current track at the given offset.
+func (p *Player) Seek(offset time.Duration) error {
+	if offset < 0 {
+		return errors.New("can't seek to before the start of the track")
+	}
+
+	p.Lock()
+	if !p.playerOn || p.idle {
+		p.Unlock()
+		return ErrNotPlaying
+	}
+	p.seekTo = offset
+	p.Unlock()
+
+	p.sendSignal(SigReload)
+	return nil
+}
+
+// startTrack resets the position for a new track, returning the offset the
+// track should start playing from.
+func (p *Player) startTrack() time.Duration {
+	p.Lock()
+	defer p.Unlock()
+
+	offset := p.seekTo
+	p.seekTo = 0
+	p.frames = int(offset / frameDuration)
+	return offset
+}
+
+// Position returns how far into the current track we are.
+func (p *Player) Position() time.Duration {
+	p.Lock()
+	defer p.Unlock()
+
+	// Frames waiting in the audio buffer haven't been heard yet.
+	played := p.frames - len(p.out.frames)
+	if played < 0 {
+		played = 0
+	}
+	return time.Duration(played) * frameDuration
+}
+
+// ResumePoint returns the current queue and position, or nil if nothing is
+// playing.
+func (p *Player) ResumePoint() *ResumePoint {
+	p.Lock()
+	q, on, idle := p.q, p.playerOn, p.idle
+	p.Unlock()
+
+	if !on || idle || q == nil {
+		return nil
+	}
+
+	st := q.state()
+	if st.current >= len(st.playlist) {
+		return nil
+	}
+
+	return &ResumePoint{
+		Tracks:    st.playlist,
+		Current:   st.current,
+		AutoClear: st.autoClear,
+		Position:  p.Position(),
+	}
+}
+
+// Restore sets up the queue from a ResumePoint, the next Start will carry on
+// from where it was taken. If we're already playing we switch over to it
+// straight away.
+func (p *Player) Restore(rp *ResumePoint) error {
+	if rp.Current < 0 || rp.Current >= len(rp.Tracks) {
+		return errors.New("nothing to resume")
+	}
+
+	p.Lock()
+
+	tracks := make([]Track, len(rp.Tracks))
+	copy(tracks, rp.Tracks)
+
+	p.q = newQ(p.mode, queueState{
+		autoClear: rp.AutoClear,
+		current:   rp.Current,
+		playlist:  tracks,
+		shuffle:   p.shuffle,
+		loop:      p.loop,
+	})
+	p.seekTo = rp.Position
+	on := p.playerOn
 
 	p.Unlock()
+
+	p.publish(EventQueueChanged)
+	if on {
+		p.sendSignal(SigReload)
+	}
+	return nil
+}
+
+// SetCrossfade sets how long tracks overlap for, from the next track on.
+func (p *Player) SetCrossfade(d time.Duration) error {
+	if d < 0 || d > maxCrossfade {
+		return fmt.Errorf("crossfade has to be between 0 and %v", maxCrossfade)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	p.crossfade = d
 	return nil
 }
 
+func (p *Player) Crossfade() time.Duration {
+	p.Lock()
+	defer p.Unlock()
+	return p.crossfade
+}
+
+// SetNormalize turns loudness normalization on or off, from the next track.
+func (p *Player) SetNormalize(on bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.normalize = on
+}
+
+func (p *Player) Normalize() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.normalize
+}
+
+// SetShuffle turns shuffle on or off, for the current queue and any new one.
+func (p *Player) SetShuffle(on bool) {
+	p.Lock()
+	p.shuffle = on
+	if p.q != nil {
+		p.q.SetShuffle(on)
+	}
+	p.Unlock()
+
+	p.publish(EventQueueChanged)
+}
+
+func (p *Player) Shuffle() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.shuffle
+}
+
+// SetLoop sets what happens when a track ends, or the queue runs out.
+func (p *Player) SetLoop(mode LoopMode) {
+	if mode == "" {
+		mode = LoopAuto
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.loop = mode
+	if p.q != nil {
+		p.q.SetLoop(mode)
+	}
+}
+
+func (p *Player) Loop() LoopMode {
+	p.Lock()
+	defer p.Unlock()
+	return p.loop
+}
+
+// SetQueueMode switches the queue implementation, keeping the queued tracks
+// and the current track.
+func (p *Player) SetQueueMode(mode QueueMode) {
+	p.Lock()
+	p.mode = mode
+	if p.q != nil {
+		p.q = ConvertPlayerQ(p.q, mode)
+	}
+	p.Unlock()
+
+	p.publish(EventQueueChanged)
+}
+
+func (p *Player) QueueMode() QueueMode {
+	p.Lock()
+	defer p.Unlock()
+	return p.mode
+}
+
+// newQueue creates an empty queue with the player's settings, p must be
+// locked.
+func (p *Player) newQueue() PlayerQ {
+	q := NewPlayerQ(p.mode)
+	q.SetShuffle(p.shuffle)
+	q.SetLoop(p.loop)
+	return q
+}
+
+// queue returns the current queue, which may be swapped out at any time.
+func (p *Player) queue() PlayerQ {
+	p.Lock()
+	defer p.Unlock()
+	return p.q
+}
+
 func (p *Player) Playing() (Track, []Track) {
 	p.Lock()
 	defer p.Unlock()
@@ -175,10 +469,118 @@ func (p *Player) Playing() (Track, []Track) {
 	return t, pl
 }
 
+// Remove removes the tracks between from and to (inclusive) from the queue.
+func (p *Player) Remove(from, to int) error {
+	q := p.queue()
+	if q == nil {
+		return ErrNoSongs
+	}
+	if err := q.RemoveRange(from, to); err != nil {
+		return err
+	}
+
+	p.publish(EventQueueChanged)
+	return nil
+}
+
+// Clear empties the queue, stopping the current track.
+func (p *Player) Clear() {
+	p.Lock()
+	p.q = p.newQueue()
+	p.Unlock()
+
+	p.publish(EventQueueChanged)
+	p.sendSignal(SigReload)
+}
+
+// RemoveRequester removes all tracks queued by the given user that haven't
+// been played yet.
+func (p *Player) RemoveRequester(id string) int {
+	q := p.queue()
+	if q == nil {
+		return 0
+	}
+
+	removed := q.RemoveRequester(id)
+	if removed > 0 {
+		p.publish(EventQueueChanged)
+	}
+	return removed
+}
+
+// Pause holds playback of the current track until Resume is called.
+func (p *Player) Pause() error {
+	p.Lock()
+	playing := p.playerOn && !p.idle
+	p.Unlock()
+
+	// There's nothing to hold while the PlayLoop waits for a track.
+	if !playing {
+		return ErrNotPlaying
+	}
+	p.sendSignal(SigPause)
+	return nil
+}
+
+func (p *Player) Resume() error {
+	if !p.On() {
+		return ErrNotPlaying
+	}
+	p.sendSignal(SigResume)
+	return nil
+}
+
+func (p *Player) Paused() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.paused
+}
+
+func (p *Player) setPaused(paused bool) {
+	p.Lock()
+	p.paused = paused
+	p.Unlock()
+
+	p.publish(EventPaused)
+}
+
+// publish passes an event on to whoever's listening.
+func (p *Player) publish(t EventType) {
+	if p.notify != nil {
+		p.notify(Event{Type: t})
+	}
+}
+
+// On reports whether the PlayLoop is running.
+func (p *Player) On() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.playerOn
+}
+
 func (p *Player) Skip() {
-	p.signal <- SigSkip
+	p.sendSignal(SigSkip)
 }
 
 func (p *Player) Stop() {
-	p.signal <- SigStop
+	p.sendSignal(SigStop)
+}
+
+// sendSignal passes a signal to the PlayLoop, if it's running.
+func (p *Player) sendSignal(sig PlayerSignal) {
+	p.Lock()
+	on, signal := p.playerOn, p.signal
+	p.Unlock()
+
+	if !on {
+		return
+	}
+
+	// The PlayLoop can exit between us checking and sending, so don't
+	// wait around forever.
+	select {
+	case signal <- sig:
+	case <-time.After(time.Second * 5):
+		log.Printf("sendSignal: timed out sending signal %v", sig.Type)
+	}
 }
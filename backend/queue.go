@@ -2,8 +2,12 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 type SigType int
@@ -11,7 +15,11 @@ type SigType int
 const (
 	SigTypeReload = iota
 	SigTypeSkip
+	// SigTypeEnd is sent once a track has played through.
+	SigTypeEnd
 	SigTypeStop
+	SigTypePause
+	SigTypeResume
 	SigTypeErr
 )
 
@@ -19,6 +27,26 @@ type Track struct {
 	Name     string `json:"name,omitempty"`
 	Uploader string `json:"uploader,omitempty"`
 	URL      string `json:"url,omitempty"`
+
+	// Requester is only set for tracks queued by a user, tracks coming from
+	// a playlist have no requester.
+	Requester *Requester `json:"requester,omitempty"`
+}
+
+// Requester records who queued a track and when.
+type Requester struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// RequesterID returns the discord id of the user that queued the track,
+// or an empty string if nobody did.
+func (t Track) RequesterID() string {
+	if t.Requester == nil {
+		return ""
+	}
+	return t.Requester.ID
 }
 
 func (t Track) Equal(o Track) bool {
@@ -64,13 +92,6 @@ func NewPlaylistFromSpotifyURL(title string, category string, url string) (*Play
 
 }
 
-func (p Playlist) Shuffle() {
-	l := p.Tracks
-	rand.Shuffle(len(l), func(i, j int) {
-		l[i], l[j] = l[j], l[i]
-	})
-}
-
 type PlayerSignal struct {
 	Type SigType
 	Err  error
@@ -79,7 +100,10 @@ type PlayerSignal struct {
 var (
 	SigReload = PlayerSignal{Type: SigTypeReload}
 	SigSkip   = PlayerSignal{Type: SigTypeSkip}
+	SigEnd    = PlayerSignal{Type: SigTypeEnd}
 	SigStop   = PlayerSignal{Type: SigTypeStop}
+	SigPause  = PlayerSignal{Type: SigTypePause}
+	SigResume = PlayerSignal{Type: SigTypeResume}
 )
 
 func SigErr(err error) PlayerSignal {
@@ -89,7 +113,52 @@ func SigErr(err error) PlayerSignal {
 	}
 }
 
-var ErrNoSongs = errors.New("no songs in player queue!")
+var (
+	ErrNoSongs       = errors.New("no songs in player queue!")
+	ErrRemoveCurrent = errors.New("can't remove the track that's playing, skip it instead")
+)
+
+// QueueMode selects the PlayerQ implementation used by a player.
+type QueueMode string
+
+const (
+	// QueueNormal plays tracks in the order they were added.
+	QueueNormal QueueMode = "normal"
+	// QueueBalanced plays one track from each requester in turn.
+	QueueBalanced QueueMode = "balanced"
+)
+
+func ParseQueueMode(s string) (QueueMode, error) {
+	switch m := QueueMode(strings.ToLower(s)); m {
+	case QueueNormal, QueueBalanced:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown queue mode %#v, expected %#v or %#v", s, QueueNormal, QueueBalanced)
+}
+
+// LoopMode decides what happens once a track ends, or the queue runs out.
+type LoopMode string
+
+const (
+	// LoopAuto loops playlists, while queued tracks are cleared once
+	// they've all played.
+	LoopAuto LoopMode = "auto"
+	// LoopOff stops after the last track.
+	LoopOff LoopMode = "off"
+	// LoopQueue plays the queue again from the top.
+	LoopQueue LoopMode = "queue"
+	// LoopOne repeats the current track until it's skipped.
+	LoopOne LoopMode = "one"
+)
+
+func ParseLoopMode(s string) (LoopMode, error) {
+	switch m := LoopMode(strings.ToLower(s)); m {
+	case LoopAuto, LoopOff, LoopQueue, LoopOne:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown loop mode %#v, expected %#v, %#v, %#v or %#v",
+		s, LoopOff, LoopQueue, LoopOne, LoopAuto)
+}
 
 // PlayerQ is the playlist type used by a player.
 //
@@ -98,57 +167,246 @@ var ErrNoSongs = errors.New("no songs in player queue!")
 //
 // In general, a PlayerQ can be modified at any time but
 // this will not affect the player's current state.
-//
-// Later when adding balanced Playlist we should be able to
-// replace this using an interface to have a BalancedPlayerQ
-type PlayerQ struct {
-	sync.Mutex
-
-	autoClear bool
-	current   int
-	playlist  []Track
+type PlayerQ interface {
+	Mode() QueueMode
+	// SetShuffle turns shuffling the upcoming tracks on or off.
+	SetShuffle(on bool)
+	Shuffle() bool
+	SetLoop(mode LoopMode)
+	Loop() LoopMode
+	Len() int
+	Append(t Track)
+	Insert(idx int, t Track) error
+	// InsertNext queues a track to be played after the current track.
+	InsertNext(t Track)
+	// RemoveRange removes the tracks between from and to (inclusive).
+	// The current track can't be removed.
+	RemoveRange(from, to int) error
+	SkipNext() Track
+	// Finish moves on once the current track has played through, which is
+	// the same as skipping it unless it's being repeated.
+	Finish() Track
+	Current() (Track, []Track, error)
+	// Next returns the track Finish would move on to, or ErrNoSongs if the
+	// queue ends after the current track.
+	Next() (Track, error)
+
+	// RemoveRequester removes all upcoming tracks queued by the given user,
+	// returning how many were removed.
+	RemoveRequester(id string) int
+
+	// state copies out the queue so it can be converted to another mode.
+	state() queueState
 }
 
-func NewPlayerQ() *PlayerQ {
-	return &PlayerQ{
+// NewPlayerQ creates an empty queue that is cleared once it's been played.
+func NewPlayerQ(mode QueueMode) PlayerQ {
+	return newQ(mode, queueState{
 		autoClear: true,
 		current:   0,
 		playlist:  []Track{},
-	}
+	})
 }
 
-func NewPlayerQFromPlaylist(from []Track) *PlayerQ {
-	return &PlayerQ{
+// NewPlayerQFromPlaylist creates a queue that loops over the given tracks,
+// in a random order if shuffle is set.
+func NewPlayerQFromPlaylist(mode QueueMode, from []Track, shuffle bool) PlayerQ {
+	// Copy so that changes to the queue never leak into the playlist.
+	playlist := make([]Track, len(from))
+	copy(playlist, from)
+
+	st := queueState{
 		autoClear: false,
 		current:   0,
-		playlist:  from,
+		playlist:  playlist,
+	}
+	if shuffle {
+		// Nothing has played yet, so the first track is up for grabs too.
+		st.shuffle = true
+		st.remember()
+		shuffleTracks(st.playlist)
+	}
+	return newQ(mode, st)
+}
+
+// ConvertPlayerQ returns a queue of the given mode holding the contents of q.
+// The current track is left untouched.
+func ConvertPlayerQ(q PlayerQ, mode QueueMode) PlayerQ {
+	if q.Mode() == mode {
+		return q
+	}
+	return newQ(mode, q.state())
+}
+
+func newQ(mode QueueMode, st queueState) PlayerQ {
+	if mode == QueueBalanced {
+		q := &BalancedPlayerQ{NormalPlayerQ{queueState: st}}
+		q.rebalance()
+		return q
+	}
+	return &NormalPlayerQ{queueState: st}
+}
+
+type queueState struct {
+	// autoClear is set for queues of requested tracks, rather than a
+	// playlist, see LoopAuto.
+	autoClear bool
+	current   int
+	playlist  []Track
+	loop      LoopMode
+
+	// shuffle plays the tracks in a random order. The queue holds its own
+	// copy of the tracks, so it's the copy that gets shuffled and a saved
+	// playlist is never touched. unshuffled remembers where each track was
+	// to put them back in order when shuffle is turned off.
+	shuffle    bool
+	unshuffled map[string]int
+	// wrapped is set once the tracks that already played have been
+	// reshuffled, ready to loop back around to them.
+	wrapped bool
+}
+
+// wraps reports whether the queue goes back to the top once it runs out,
+// rather than being cleared.
+func (st *queueState) wraps() bool {
+	switch st.loop {
+	case LoopQueue, LoopOne:
+		// Skipping a repeated track moves on like any other.
+		return true
+	case LoopOff:
+		return false
 	}
+	return !st.autoClear
 }
 
-func (p *PlayerQ) ToggleShuffle() {
+// remember records the order of the tracks before they're shuffled.
+func (st *queueState) remember() {
+	st.unshuffled = map[string]int{}
+	for i, t := range st.playlist {
+		if _, ok := st.unshuffled[t.URL]; !ok {
+			st.unshuffled[t.URL] = i
+		}
+	}
+}
+
+func shuffleTracks(l []Track) {
+	rand.Shuffle(len(l), func(i, j int) {
+		l[i], l[j] = l[j], l[i]
+	})
+}
+
+// NormalPlayerQ plays tracks in the order they were added.
+type NormalPlayerQ struct {
+	sync.Mutex
+	queueState
+}
+
+func (p *NormalPlayerQ) Mode() QueueMode {
+	return QueueNormal
+}
+
+func (p *NormalPlayerQ) state() queueState {
+	p.Lock()
+	defer p.Unlock()
+
+	st := p.queueState
+	st.playlist = make([]Track, len(p.playlist))
+	copy(st.playlist, p.playlist)
+	return st
+}
+
+func (p *NormalPlayerQ) SetShuffle(on bool) {
 	p.Lock()
 	defer p.Unlock()
-	p.autoClear = !p.autoClear
+	p.setShuffle(on)
 }
 
-func (p *PlayerQ) Len() int {
+func (p *NormalPlayerQ) setShuffle(on bool) {
+	if on == p.shuffle {
+		return
+	}
+	p.shuffle = on
+	p.wrapped = false
+
+	if p.current+1 >= len(p.playlist) {
+		if on {
+			p.remember()
+		}
+		return
+	}
+
+	// Only what's still to come is reordered, the current track keeps playing.
+	upcoming := p.playlist[p.current+1:]
+	if on {
+		p.remember()
+		shuffleTracks(upcoming)
+		return
+	}
+
+	// Tracks queued while shuffling weren't in the original order, they go
+	// after the rest.
+	pos := func(t Track) int {
+		if i, ok := p.unshuffled[t.URL]; ok {
+			return i
+		}
+		return len(p.unshuffled)
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool {
+		return pos(upcoming[i]) < pos(upcoming[j])
+	})
+	p.unshuffled = nil
+}
+
+func (p *NormalPlayerQ) Shuffle() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.shuffle
+}
+
+func (p *NormalPlayerQ) SetLoop(mode LoopMode) {
+	p.Lock()
+	defer p.Unlock()
+	p.loop = mode
+	p.wrapped = false
+}
+
+func (p *NormalPlayerQ) Loop() LoopMode {
+	p.Lock()
+	defer p.Unlock()
+	return p.loop
+}
+
+func (p *NormalPlayerQ) Len() int {
+	p.Lock()
+	defer p.Unlock()
 	return len(p.playlist)
 }
 
-func (p *PlayerQ) Append(t Track) {
+func (p *NormalPlayerQ) Append(t Track) {
 	p.Lock()
 	defer p.Unlock()
 
+	if p.shuffle && len(p.playlist) > 0 {
+		// Anywhere after the current track.
+		p.insert(p.current+1+rand.Intn(len(p.playlist)-p.current), t)
+		return
+	}
 	p.playlist = append(p.playlist, t)
+	p.wrapped = false
 }
 
-func (p *PlayerQ) Insert(idx int, t Track) error {
+func (p *NormalPlayerQ) Insert(idx int, t Track) error {
 	p.Lock()
 	defer p.Unlock()
+	return p.insert(idx, t)
+}
+
+func (p *NormalPlayerQ) insert(idx int, t Track) error {
 	if idx < 0 {
 		return errors.New("index cannot be below zero")
 	}
 
+	p.wrapped = false
 	if idx >= len(p.playlist) {
 		p.playlist = append(p.playlist, t)
 		return nil
@@ -160,27 +418,125 @@ func (p *PlayerQ) Insert(idx int, t Track) error {
 	return nil
 }
 
-func (p *PlayerQ) SkipNext() Track {
+func (p *NormalPlayerQ) InsertNext(t Track) {
 	p.Lock()
 	defer p.Unlock()
+
+	if len(p.playlist) == 0 {
+		p.playlist = append(p.playlist, t)
+		return
+	}
+	p.insert(p.current+1, t)
+}
+
+func (p *NormalPlayerQ) RemoveRange(from, to int) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if from > to {
+		from, to = to, from
+	}
+
+	if from < 0 || to >= len(p.playlist) {
+		return fmt.Errorf("there are only %d tracks in the queue", len(p.playlist))
+	}
+
+	if from <= p.current && p.current <= to {
+		return ErrRemoveCurrent
+	}
+
+	p.playlist = append(p.playlist[:from], p.playlist[to+1:]...)
+	p.wrapped = false
+	if to < p.current {
+		p.current -= to - from + 1
+	}
+	return nil
+}
+
+func (p *NormalPlayerQ) SkipNext() Track {
+	p.Lock()
+	defer p.Unlock()
+	return p.skipNext()
+}
+
+func (p *NormalPlayerQ) Finish() Track {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.loop == LoopOne && p.current < len(p.playlist) {
+		return p.playlist[p.current]
+	}
+	return p.skipNext()
+}
+
+func (p *NormalPlayerQ) skipNext() Track {
+	if len(p.playlist) == 0 {
+		p.current = 0
+		return Track{}
+	}
+
+	p.reshuffle()
 	p.current += 1
 
-	// TODO: Reshuffle here if shuffle is on
-	//  This would require turning shuffle into a Q
-	//  managed thing.
 	if p.current > (len(p.playlist) - 1) {
 		p.current = 0
 
-		if p.autoClear {
+		if !p.wraps() {
 			p.playlist = []Track{}
 			return Track{}
 		}
+
+		if p.shuffle && p.wrapped {
+			// The track that just played is left at the end, move it
+			// somewhere random in this time round, just not first.
+			last := len(p.playlist) - 1
+			if last > 1 {
+				t := p.playlist[last]
+				i := 1 + rand.Intn(last)
+				copy(p.playlist[i+1:], p.playlist[i:last])
+				p.playlist[i] = t
+			}
+		}
+		p.wrapped = false
 	}
 
 	return p.playlist[p.current]
 }
 
-func (p *PlayerQ) Current() (Track, []Track, error) {
+// reshuffle shuffles the tracks that already played once we're on the last
+// one, so they're in a new order when the queue loops back around. The
+// current track isn't one of them, so it never plays twice in a row.
+//
+// It's done ahead of the wrap so that Next can tell what's coming.
+func (p *NormalPlayerQ) reshuffle() {
+	if !p.shuffle || !p.wraps() || p.wrapped || p.current != len(p.playlist)-1 {
+		return
+	}
+	shuffleTracks(p.playlist[:p.current])
+	p.wrapped = true
+}
+
+func (p *NormalPlayerQ) Next() (Track, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.loop == LoopOne && p.current < len(p.playlist) {
+		return p.playlist[p.current], nil
+	}
+
+	next := p.current + 1
+	if next > (len(p.playlist) - 1) {
+		if !p.wraps() || len(p.playlist) == 0 {
+			return Track{}, ErrNoSongs
+		}
+		p.reshuffle()
+		next = 0
+	}
+
+	return p.playlist[next], nil
+}
+
+func (p *NormalPlayerQ) Current() (Track, []Track, error) {
 	// TODO: Avoid locking Q every time we look at the current playlist (with RWMutex??)
 	p.Lock()
 	defer p.Unlock()
@@ -195,3 +551,116 @@ func (p *PlayerQ) Current() (Track, []Track, error) {
 
 	return p.playlist[p.current], p.playlist, nil
 }
+
+func (p *NormalPlayerQ) RemoveRequester(id string) int {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.current >= len(p.playlist) {
+		return 0
+	}
+
+	// Never remove the current track, only what's still to come.
+	kept := p.playlist[:p.current+1]
+	removed := 0
+	for _, t := range p.playlist[p.current+1:] {
+		if t.RequesterID() == id {
+			removed++
+			continue
+		}
+		kept = append(kept, t)
+	}
+
+	p.playlist = kept
+	if removed > 0 {
+		p.wrapped = false
+	}
+	return removed
+}
+
+// BalancedPlayerQ plays tracks round robin style, one track from each
+// requester in turn, so nobody can take over the queue by adding 30 songs.
+//
+// The order is worked out when tracks are added, so explicit inserts are
+// left where they were put.
+type BalancedPlayerQ struct {
+	NormalPlayerQ
+}
+
+func (p *BalancedPlayerQ) Mode() QueueMode {
+	return QueueBalanced
+}
+
+// rounds returns which round each upcoming track will play in, i.e. how many
+// tracks by the same requester play before it. The current track counts
+// towards its requester's rounds since it has only just had its turn.
+func (p *BalancedPlayerQ) rounds() (map[string]int, []int) {
+	seen := map[string]int{}
+	rounds := []int{}
+
+	for i := p.current; i < len(p.playlist); i++ {
+		id := p.playlist[i].RequesterID()
+		if i > p.current {
+			rounds = append(rounds, seen[id])
+		}
+		seen[id]++
+	}
+
+	return seen, rounds
+}
+
+func (p *BalancedPlayerQ) Append(t Track) {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.playlist) == 0 {
+		p.playlist = append(p.playlist, t)
+		return
+	}
+
+	seen, rounds := p.rounds()
+	round := seen[t.RequesterID()]
+
+	// Place the track at the end of its round.
+	idx := len(p.playlist)
+	for i, r := range rounds {
+		if r > round {
+			idx = p.current + 1 + i
+			break
+		}
+	}
+
+	p.insert(idx, t)
+}
+
+// SetShuffle shuffles within rounds, so requesters still take turns.
+func (p *BalancedPlayerQ) SetShuffle(on bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.setShuffle(on)
+	p.rebalance()
+}
+
+// rebalance reorders the upcoming tracks into rounds, keeping the order of
+// each requester's tracks.
+func (p *BalancedPlayerQ) rebalance() {
+	if p.current >= len(p.playlist) {
+		return
+	}
+
+	_, rounds := p.rounds()
+	upcoming := p.playlist[p.current+1:]
+	order := make([]int, len(upcoming))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rounds[order[i]] < rounds[order[j]]
+	})
+
+	sorted := make([]Track, len(upcoming))
+	for i, o := range order {
+		sorted[i] = upcoming[o]
+	}
+	copy(upcoming, sorted)
+}
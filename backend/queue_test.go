@@ -0,0 +1,300 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func trackNames(tracks []Track) []string {
+	names := []string{}
+	for _, t := range tracks {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+func TestBalancedPlayerQ(t *testing.T) {
+	q := NewPlayerQ(QueueBalanced)
+
+	for _, tr := range []Track{
+		{Name: "a1", Requester: &Requester{ID: "a"}},
+		{Name: "a2", Requester: &Requester{ID: "a"}},
+		{Name: "a3", Requester: &Requester{ID: "a"}},
+		{Name: "b1", Requester: &Requester{ID: "b"}},
+		{Name: "c1", Requester: &Requester{ID: "c"}},
+		{Name: "b2", Requester: &Requester{ID: "b"}},
+		{Name: "a4", Requester: &Requester{ID: "a"}},
+	} {
+		q.Append(tr)
+	}
+
+	_, got, err := q.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a1", "b1", "c1", "a2", "b2", "a3", "a4"}
+	if diff := cmp.Diff(want, trackNames(got)); diff != "" {
+		t.Errorf("balanced order mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConvertPlayerQ(t *testing.T) {
+	q := NewPlayerQ(QueueNormal)
+	for _, tr := range []Track{
+		{Name: "a1", Requester: &Requester{ID: "a"}},
+		{Name: "a2", Requester: &Requester{ID: "a"}},
+		{Name: "a3", Requester: &Requester{ID: "a"}},
+		{Name: "b1", Requester: &Requester{ID: "b"}},
+		{Name: "b2", Requester: &Requester{ID: "b"}},
+	} {
+		q.Append(tr)
+	}
+	q.SkipNext()
+
+	q = ConvertPlayerQ(q, QueueBalanced)
+	if q.Mode() != QueueBalanced {
+		t.Fatalf("Mode() = %v, want %v", q.Mode(), QueueBalanced)
+	}
+
+	cur, got, err := q.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.Name != "a2" {
+		t.Errorf("current track = %v, want a2", cur.Name)
+	}
+
+	want := []string{"a1", "a2", "b1", "a3", "b2"}
+	if diff := cmp.Diff(want, trackNames(got)); diff != "" {
+		t.Errorf("converted order mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRemoveRequester(t *testing.T) {
+	q := NewPlayerQ(QueueNormal)
+	for _, tr := range []Track{
+		{Name: "a1", Requester: &Requester{ID: "a"}},
+		{Name: "b1", Requester: &Requester{ID: "b"}},
+		{Name: "a2", Requester: &Requester{ID: "a"}},
+		{Name: "b2", Requester: &Requester{ID: "b"}},
+		{Name: "a3", Requester: &Requester{ID: "a"}},
+	} {
+		q.Append(tr)
+	}
+
+	if n := q.RemoveRequester("a"); n != 2 {
+		t.Errorf("RemoveRequester(a) = %d, want 2", n)
+	}
+
+	_, got, err := q.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a1", "b1", "b2"}
+	if diff := cmp.Diff(want, trackNames(got)); diff != "" {
+		t.Errorf("RemoveRequester order mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRemoveRange(t *testing.T) {
+	q := NewPlayerQFromPlaylist(QueueNormal, []Track{
+		{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}, {Name: "e"},
+	}, false)
+	q.SkipNext()
+	q.SkipNext()
+
+	if err := q.RemoveRange(1, 2); err != ErrRemoveCurrent {
+		t.Errorf("RemoveRange over current track = %v, want %v", err, ErrRemoveCurrent)
+	}
+
+	if err := q.RemoveRange(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	q.InsertNext(Track{Name: "x"})
+
+	cur, got, err := q.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.Name != "c" {
+		t.Errorf("current track = %v, want c", cur.Name)
+	}
+
+	want := []string{"c", "x", "d", "e"}
+	if diff := cmp.Diff(want, trackNames(got)); diff != "" {
+		t.Errorf("RemoveRange order mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestNext(t *testing.T) {
+	q := NewPlayerQ(QueueNormal)
+	if _, err := q.Next(); err != ErrNoSongs {
+		t.Errorf("Next() on an empty queue = %v, want %v", err, ErrNoSongs)
+	}
+
+	q.Append(Track{Name: "a"})
+	q.Append(Track{Name: "b"})
+
+	next, err := q.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Name != "b" {
+		t.Errorf("Next() = %v, want b", next.Name)
+	}
+
+	// Queues are cleared once they've played through.
+	q.SkipNext()
+	if _, err := q.Next(); err != ErrNoSongs {
+		t.Errorf("Next() at the end of the queue = %v, want %v", err, ErrNoSongs)
+	}
+
+	// Playlists loop.
+	q = NewPlayerQFromPlaylist(QueueNormal, []Track{{Name: "a"}, {Name: "b"}}, false)
+	q.SkipNext()
+	if next, err := q.Next(); err != nil || next.Name != "a" {
+		t.Errorf("Next() at the end of a playlist = %v, %v, want a", next.Name, err)
+	}
+}
+
+func namedTracks(names ...string) []Track {
+	tracks := []Track{}
+	for _, n := range names {
+		tracks = append(tracks, Track{Name: n, URL: n})
+	}
+	return tracks
+}
+
+func TestShuffle(t *testing.T) {
+	saved := namedTracks("a", "b", "c", "d", "e", "f", "g", "h")
+	q := NewPlayerQFromPlaylist(QueueNormal, saved, true)
+
+	if diff := cmp.Diff([]string{"a", "b", "c", "d", "e", "f", "g", "h"}, trackNames(saved)); diff != "" {
+		t.Errorf("shuffling changed the saved playlist (-want +got):\n%s", diff)
+	}
+
+	for round := 0; round < 20; round++ {
+		cur, tracks, err := q.Current()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Every track plays once a time round, in whatever order.
+		played := map[string]bool{cur.Name: true}
+		last := cur
+		for i := 1; i < len(tracks); i++ {
+			next, err := q.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := q.SkipNext(); got.Name != next.Name {
+				t.Fatalf("SkipNext() = %v, but Next() said %v", got.Name, next.Name)
+			}
+			played[next.Name] = true
+			last = next
+		}
+		if len(played) != len(saved) {
+			t.Fatalf("round %d played %d distinct tracks, want %d", round, len(played), len(saved))
+		}
+
+		// Reshuffled on the way round, but never straight into a repeat.
+		next, err := q.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := q.SkipNext(); got.Name != next.Name {
+			t.Fatalf("SkipNext() = %v, but Next() said %v", got.Name, next.Name)
+		} else if got.Name == last.Name {
+			t.Fatalf("round %d: %v played twice in a row", round, got.Name)
+		}
+	}
+}
+
+func TestShuffleOff(t *testing.T) {
+	q := NewPlayerQFromPlaylist(QueueNormal, namedTracks("a", "b", "c", "d", "e"), false)
+	q.SkipNext()
+
+	q.SetShuffle(true)
+	if !q.Shuffle() {
+		t.Fatal("Shuffle() = false after SetShuffle(true)")
+	}
+	cur, _, err := q.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.Name != "b" {
+		t.Errorf("current track = %v after shuffling, want b", cur.Name)
+	}
+
+	q.Append(Track{Name: "x", URL: "x"})
+	q.SetShuffle(false)
+
+	_, got, err := q.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a", "b", "c", "d", "e", "x"}
+	if diff := cmp.Diff(want, trackNames(got)); diff != "" {
+		t.Errorf("unshuffled order mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestLoopModes(t *testing.T) {
+	for _, tc := range []struct {
+		loop      LoopMode
+		autoClear bool
+		// want is the track played after each of the tracks ends, "" when
+		// the queue is cleared.
+		want []string
+	}{
+		{LoopAuto, false, []string{"b", "c", "a", "b"}},
+		{LoopAuto, true, []string{"b", "c", ""}},
+		{LoopOff, false, []string{"b", "c", ""}},
+		{LoopQueue, true, []string{"b", "c", "a", "b"}},
+		{LoopOne, false, []string{"a", "a", "a"}},
+	} {
+		var q PlayerQ
+		if tc.autoClear {
+			q = NewPlayerQ(QueueNormal)
+			for _, tr := range namedTracks("a", "b", "c") {
+				q.Append(tr)
+			}
+		} else {
+			q = NewPlayerQFromPlaylist(QueueNormal, namedTracks("a", "b", "c"), false)
+		}
+		q.SetLoop(tc.loop)
+
+		got := []string{}
+		for range tc.want {
+			next, err := q.Next()
+			finished := q.Finish()
+			if err == ErrNoSongs {
+				if q.Len() != 0 {
+					t.Errorf("%s: Next() = %v, but the queue wasn't cleared", tc.loop, err)
+				}
+				got = append(got, "")
+				break
+			} else if next.Name != finished.Name {
+				t.Errorf("%s: Finish() = %v, but Next() said %v", tc.loop, finished.Name, next.Name)
+			}
+			got = append(got, finished.Name)
+		}
+
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s (autoClear %v) order mismatch (-want +got):\n%s", tc.loop, tc.autoClear, diff)
+		}
+	}
+
+	// Skipping a repeated track moves on to the next one.
+	q := NewPlayerQFromPlaylist(QueueNormal, namedTracks("a", "b"), false)
+	q.SetLoop(LoopOne)
+	if got := q.SkipNext(); got.Name != "b" {
+		t.Errorf("SkipNext() repeating a track = %v, want b", got.Name)
+	}
+	if got := q.SkipNext(); got.Name != "a" {
+		t.Errorf("SkipNext() off the end repeating a track = %v, want a", got.Name)
+	}
+}
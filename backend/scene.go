@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrSceneDoesNotExist = errors.New("a scene with that name does not exist")
+
+// reservedSceneWords are the scene subcommands, a scene starting with one
+// couldn't be switched to.
+var reservedSceneWords = map[string]bool{
+	"list": true, "save": true, "delete": true, "remove": true, "rm": true,
+}
+
+// Scene is a preset a DM prepares ahead of time, like "Tavern" or "Final
+// boss", and switches to in one go.
+type Scene struct {
+	Name string `json:"name"`
+
+	// Playlist is the title of the playlist to play, empty means silence.
+	Playlist string `json:"playlist,omitempty"`
+
+	// Ambience is a playlist title, url or search to loop under the music,
+	// empty means no ambience.
+	Ambience string `json:"ambience,omitempty"`
+
+	// Volumes are in percent.
+	Volume         int `json:"volume"`
+	AmbienceVolume int `json:"ambience_volume"`
+
+	QueueMode QueueMode     `json:"queue_mode,omitempty"`
+	Shuffle   bool          `json:"shuffle,omitempty"`
+	Loop      LoopMode      `json:"loop,omitempty"`
+	Crossfade time.Duration `json:"crossfade,omitempty"`
+}
+
+// sceneKey is what scenes are looked up by, names are case insensitive.
+func sceneKey(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Validate checks the settings of a scene, without looking up its playlists.
+func (sc *Scene) Validate() error {
+	sc.Name = strings.TrimSpace(sc.Name)
+	if sc.Name == "" {
+		return errors.New("a scene needs a name")
+	} else if len(sc.Name) > 64 {
+		return errors.New("scene names can be up to 64 characters")
+	}
+	if first := strings.Fields(sceneKey(sc.Name))[0]; reservedSceneWords[first] {
+		return fmt.Errorf("scene names can't start with %#v", first)
+	}
+
+	if sc.Volume < 0 || sc.Volume > maxVolume || sc.AmbienceVolume < 0 || sc.AmbienceVolume > maxVolume {
+		return fmt.Errorf("volume has to be between 0 and %d", maxVolume)
+	}
+	if sc.Crossfade < 0 || sc.Crossfade > maxCrossfade {
+		return fmt.Errorf("crossfade has to be between 0 and %v", maxCrossfade)
+	}
+	if sc.QueueMode != "" {
+		mode, err := ParseQueueMode(string(sc.QueueMode))
+		if err != nil {
+			return err
+		}
+		sc.QueueMode = mode
+	}
+	if sc.Loop != "" {
+		mode, err := ParseLoopMode(string(sc.Loop))
+		if err != nil {
+			return err
+		}
+		sc.Loop = mode
+	}
+	return nil
+}
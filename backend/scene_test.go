@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSceneValidate(t *testing.T) {
+	tests := []struct {
+		scene Scene
+		ok    bool
+	}{
+		{Scene{Name: "Tavern", Volume: 80, AmbienceVolume: 50}, true},
+		{Scene{Name: " Final boss ", Volume: 200, QueueMode: "Balanced", Crossfade: 5 * time.Second}, true},
+		{Scene{Name: ""}, false},
+		{Scene{Name: "save the princess"}, false},
+		{Scene{Name: "Loud", Volume: maxVolume + 1}, false},
+		{Scene{Name: "Quiet", AmbienceVolume: -1}, false},
+		{Scene{Name: "Slow", Crossfade: maxCrossfade + time.Second}, false},
+		{Scene{Name: "Odd", QueueMode: "sideways"}, false},
+	}
+
+	for _, tt := range tests {
+		sc := tt.scene
+		if err := sc.Validate(); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) = %v, want ok = %v", tt.scene, err, tt.ok)
+		}
+	}
+
+	sc := Scene{Name: " Final boss ", QueueMode: "Balanced"}
+	if err := sc.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if sc.Name != "Final boss" || sc.QueueMode != QueueBalanced {
+		t.Errorf("Validate() left %#v, %#v, want them cleaned up", sc.Name, sc.QueueMode)
+	}
+}
+
+func TestSetSceneIsAtomic(t *testing.T) {
+	gs := newSession("guild", "session", nil)
+
+	pl, err := NewPlaylist("Tavern", "Ambient", []Track{{Name: "Lute", URL: "https://example.com/lute"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.AddPlaylist(pl); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gs.SaveScene(&Scene{Name: "Tavern", Playlist: "tavern", Volume: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if got := gs.Scenes(); len(got) != 1 || got[0].Playlist != "Tavern" {
+		t.Fatalf("Scenes() = %+v, want the Tavern scene playing the Tavern playlist", got)
+	}
+	if err := gs.SaveScene(&Scene{Name: "Dungeon", Playlist: "Dungeon"}); err != ErrGuildPlaylistDoesNotExist {
+		t.Errorf("SaveScene(missing playlist) = %v, want ErrGuildPlaylistDoesNotExist", err)
+	}
+
+	// The playlist goes away after the scene was saved, switching to it
+	// mustn't change anything.
+	if err := gs.RemovePlaylist("Tavern"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.SetScene("TAVERN", Requester{}); err == nil {
+		t.Fatal("SetScene() with a missing playlist succeeded")
+	}
+	if gs.Volume() != defaultVolume || gs.Scene() != "" {
+		t.Errorf("failed SetScene() changed the session: volume %d, scene %#v", gs.Volume(), gs.Scene())
+	}
+
+	if err := gs.RemoveScene("tavern"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gs.SetScene("Tavern", Requester{}); err != ErrSceneDoesNotExist {
+		t.Errorf("SetScene(removed) = %v, want ErrSceneDoesNotExist", err)
+	}
+}
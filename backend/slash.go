@@ -0,0 +1,473 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// slashOptions maps the name of an option to its value.
+type slashOptions map[string]*discordgo.ApplicationCommandInteractionDataOption
+
+func newSlashOptions(opts []*discordgo.ApplicationCommandInteractionDataOption) slashOptions {
+	o := slashOptions{}
+	for _, opt := range opts {
+		o[opt.Name] = opt
+	}
+	return o
+}
+
+// String returns the value of a string option, or "" if it wasn't given.
+func (o slashOptions) String(name string) string {
+	opt, ok := o[name]
+	// StringValue panics on anything else, and discord can't be trusted to
+	// send what we registered.
+	if !ok || opt.Type != discordgo.ApplicationCommandOptionString {
+		return ""
+	}
+	s, _ := opt.Value.(string)
+	return s
+}
+
+// Subcommand returns the subcommand used and its options. Subcommands are
+// passed as the only option, with their own options.
+func (o slashOptions) Subcommand() (string, slashOptions, bool) {
+	for _, opt := range o {
+		if opt.Type == discordgo.ApplicationCommandOptionSubCommand {
+			return opt.Name, newSlashOptions(opt.Options), true
+		}
+	}
+	return "", nil, false
+}
+
+type SlashHandler func(s *DiscordBot, ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions)
+
+// SlashCommand is a discord application command, the slash command
+// equivalent of a Command.
+//
+// Slash commands call the same Session methods as text commands, only the
+// replies differ since they are sent as interaction responses.
+type SlashCommand struct {
+	*discordgo.ApplicationCommand
+	Handler SlashHandler
+}
+
+// registerSlashCommands tells discord about our slash commands. It replaces
+// any commands registered previously, so it's safe to call on every start.
+func (s *DiscordBot) registerSlashCommands(ds *discordgo.Session, appID string) error {
+	cmds := []*discordgo.ApplicationCommand{}
+	for _, c := range s.slash {
+		cmds = append(cmds, c.ApplicationCommand)
+	}
+
+	if _, err := ds.ApplicationCommandBulkOverwrite(appID, "", cmds); err != nil {
+		return fmt.Errorf("registerSlashCommands: %w", err)
+	}
+	return nil
+}
+
+func (s *DiscordBot) ready(ds *discordgo.Session, r *discordgo.Ready) {
+	if err := s.registerSlashCommands(ds, r.User.ID); err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *DiscordBot) incomingInteraction(ds *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	// Music only makes sense in guilds.
+	if i.GuildID == "" || i.Member == nil || i.Member.User == nil {
+		s.respondErr(ds, i, fmt.Errorf("you can only use me in a server"))
+		return
+	}
+
+	data := i.ApplicationCommandData()
+	c, ok := s.slash[data.Name]
+	if !ok {
+		s.respondErr(ds, i, fmt.Errorf("unknown command %#v", data.Name))
+		return
+	}
+
+	c.Handler(s, ds, i, newSlashOptions(data.Options))
+}
+
+func (s *DiscordBot) respond(ds *discordgo.Session, i *discordgo.InteractionCreate, data *discordgo.InteractionResponseData) {
+	err := ds.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		log.Printf("respond: %v", err)
+	}
+}
+
+func (s *DiscordBot) respondMsg(ds *discordgo.Session, i *discordgo.InteractionCreate, msg string) {
+	s.respond(ds, i, &discordgo.InteractionResponseData{Content: msg})
+}
+
+// respondErr replies with an error that only the user who ran the command can see.
+func (s *DiscordBot) respondErr(ds *discordgo.Session, i *discordgo.InteractionCreate, err error) {
+	log.Printf("sending interaction err: %v", err)
+	s.respond(ds, i, &discordgo.InteractionResponseData{
+		Content: err.Error(),
+		Flags:   uint64(discordgo.MessageFlagsEphemeral),
+	})
+}
+
+// maxEmbedDescription is the longest description discord accepts in an embed.
+const maxEmbedDescription = 4096
+
+// listEmbed shows lines in a code block, as many as fit in an embed. The
+// footer says how many more there were.
+func listEmbed(title string, lines []string) *discordgo.MessageEmbed {
+	const start, end = "```\n", "```"
+
+	size, shown := len(start)+len(end), 0
+	for _, line := range lines {
+		size += utf8.RuneCountInString(line) + 1
+		if size > maxEmbedDescription {
+			break
+		}
+		shown++
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       title,
+		Color:       3447003,
+		Description: start + strings.Join(lines[:shown], "\n") + "\n" + end,
+	}
+	if more := len(lines) - shown; more > 0 {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: fmt.Sprintf("…and %d more", more)}
+	}
+	return embed
+}
+
+func (s *DiscordBot) respondList(ds *discordgo.Session, i *discordgo.InteractionCreate, title string, lines []string) {
+	s.respond(ds, i, &discordgo.InteractionResponseData{
+		Embeds: []*discordgo.MessageEmbed{listEmbed(title, lines)},
+	})
+}
+
+// slashAllowed checks that the user of an interaction may do something,
+// telling them if they can't.
+func (s *DiscordBot) slashAllowed(ds *discordgo.Session, i *discordgo.InteractionCreate, perm Permission) bool {
+	gs, err := s.sessions.FromGuild(i.GuildID)
+	if err != nil || !gs.Permissions().Enabled() {
+		return true
+	}
+
+	mem, err := discordMember(ds, i.ChannelID, i.Member.User, i.Member)
+	if err == nil {
+		err = gs.Allowed(mem, perm)
+	}
+	if err != nil {
+		s.respondErr(ds, i, err)
+		return false
+	}
+	return true
+}
+
+// deferred acknowledges an interaction that will take a while, then edits
+// the response with whatever f returns once it's done.
+func (s *DiscordBot) deferred(ds *discordgo.Session, i *discordgo.InteractionCreate, f func() (*discordgo.WebhookEdit, error)) {
+	err := ds.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		log.Printf("deferred: %v", err)
+		return
+	}
+
+	edit, err := f()
+	if err != nil {
+		log.Printf("sending interaction err: %v", err)
+		edit = &discordgo.WebhookEdit{Content: err.Error()}
+	}
+
+	if _, err := ds.InteractionResponseEdit(i.Interaction, edit); err != nil {
+		log.Printf("deferred: %v", err)
+	}
+}
+
+func slashCommands() []*SlashCommand {
+	return []*SlashCommand{
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Name:        "play",
+				Description: "Play a playlist, or queue a song",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "query",
+					Description: "A playlist title, url or search",
+					Required:    true,
+				}},
+			},
+			Handler: (*DiscordBot).slashPlay,
+		},
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Name:        "skip",
+				Description: "Skip the current song",
+			},
+			Handler: (*DiscordBot).slashSkip,
+		},
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Name:        "voteskip",
+				Description: "Vote to skip the current song",
+			},
+			Handler: (*DiscordBot).slashVoteSkip,
+		},
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Name:        "stop",
+				Description: "Stop the music",
+			},
+			Handler: (*DiscordBot).slashStop,
+		},
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Name:        "queue",
+				Description: "List the queue, or set the queue mode",
+				Options: []*discordgo.ApplicationCommandOption{{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "mode",
+					Description: "How the queue picks the next song",
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "normal", Value: string(QueueNormal)},
+						{Name: "balanced", Value: string(QueueBalanced)},
+					},
+				}},
+			},
+			Handler: (*DiscordBot).slashQueue,
+		},
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Name:        "playlist",
+				Description: "List, add or delete playlists",
+				Options: []*discordgo.ApplicationCommandOption{
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "list",
+						Description: "List playlists",
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "add",
+						Description: "Add an empty playlist",
+						Options: []*discordgo.ApplicationCommandOption{{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "name",
+							Description: "Title of the playlist",
+							Required:    true,
+						}},
+					},
+					{
+						Type:        discordgo.ApplicationCommandOptionSubCommand,
+						Name:        "delete",
+						Description: "Delete a playlist",
+						Options: []*discordgo.ApplicationCommandOption{{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "name",
+							Description: "Title of the playlist",
+							Required:    true,
+						}},
+					},
+				},
+			},
+			Handler: (*DiscordBot).slashPlaylist,
+		},
+		{
+			ApplicationCommand: &discordgo.ApplicationCommand{
+				Name:        "ui",
+				Description: "Control the bot from your browser",
+			},
+			Handler: (*DiscordBot).slashUI,
+		},
+	}
+}
+
+func (s *DiscordBot) slashPlay(ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions) {
+	search := opts.String("query")
+	if !s.slashAllowed(ds, i, PermPlaylist) {
+		return
+	}
+
+	gs, _, err := s.sessionFor(ds, i.GuildID, i.ChannelID, i.Member.User.ID)
+	if err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+
+	// Playlists take priority over searching youtube.
+	if pl, ok := gs.FindPlaylist(search); ok {
+		if err := gs.SetPlaylist(pl.Title); err != nil {
+			s.respondErr(ds, i, err)
+			return
+		}
+		s.respondMsg(ds, i, fmt.Sprintf("playing playlist %s", pl.Title))
+		return
+	}
+
+	// Looking up a track is slow, discord wants a response within 3 seconds.
+	s.deferred(ds, i, func() (*discordgo.WebhookEdit, error) {
+		track, err := gs.QueueSingle(search, requesterFromMember(i.Member.User, i.Member))
+		if err != nil {
+			return nil, err
+		}
+		return &discordgo.WebhookEdit{Embeds: []*discordgo.MessageEmbed{trackEmbed("Queued", track)}}, nil
+	})
+}
+
+func (s *DiscordBot) slashSkip(ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions) {
+	if !s.slashAllowed(ds, i, PermSkip) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(i.GuildID)
+	if err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+	gs.Skip()
+
+	s.respondMsg(ds, i, "skipped")
+}
+
+func (s *DiscordBot) slashVoteSkip(ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions) {
+	gs, err := s.sessions.FromGuild(i.GuildID)
+	if err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+
+	votes, needed, skipped, err := gs.VoteSkip(i.Member.User.ID)
+	if err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+	if skipped {
+		s.respondMsg(ds, i, "vote passed, skipping")
+		return
+	}
+	s.respondMsg(ds, i, fmt.Sprintf("%d/%d votes to skip", votes, needed))
+}
+
+func (s *DiscordBot) slashStop(ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions) {
+	if !s.slashAllowed(ds, i, PermStop) {
+		return
+	}
+
+	gs, err := s.sessions.FromGuild(i.GuildID)
+	if err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+	gs.Stop()
+
+	s.respondMsg(ds, i, "bye! see you soon :)")
+}
+
+func (s *DiscordBot) slashQueue(ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions) {
+	gs, err := s.sessions.FromGuild(i.GuildID)
+	if err == ErrSessionDoesNotExist {
+		s.respondMsg(ds, i, "i'm not playing anything")
+		return
+	} else if err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+
+	if arg := opts.String("mode"); arg != "" {
+		if !s.slashAllowed(ds, i, PermPlaylist) {
+			return
+		}
+		mode, err := ParseQueueMode(arg)
+		if err != nil {
+			s.respondErr(ds, i, err)
+			return
+		}
+		gs.SetQueueMode(mode)
+		s.respondMsg(ds, i, fmt.Sprintf("queue mode set to %s", mode))
+		return
+	}
+
+	playing, playlist := gs.Playing()
+	if len(playlist) == 0 {
+		s.respondMsg(ds, i, "the queue is empty")
+		return
+	}
+	s.respondList(ds, i, "Queue", queueLines(playing, playlist))
+}
+
+func (s *DiscordBot) slashPlaylist(ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions) {
+	gs, err := s.sessions.FromGuild(i.GuildID)
+	if err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+
+	sub, subOpts, ok := opts.Subcommand()
+	if !ok {
+		s.respondErr(ds, i, fmt.Errorf("expected list, add or delete"))
+		return
+	}
+	name := subOpts.String("name")
+
+	if sub != "list" && !s.slashAllowed(ds, i, PermPlaylist) {
+		return
+	}
+
+	switch sub {
+	case "list":
+		playlists := gs.Playlists()
+		if len(playlists) == 0 {
+			s.respondMsg(ds, i, noPlaylists)
+			return
+		}
+		s.respondList(ds, i, "Playlists", playlistLines(playlists))
+	case "add":
+		pl, err := NewPlaylist(name, "misc", []Track{})
+		if err != nil {
+			s.respondErr(ds, i, err)
+			return
+		}
+		if err := gs.AddPlaylist(pl); err != nil {
+			s.respondErr(ds, i, err)
+			return
+		}
+		s.respondMsg(ds, i, fmt.Sprintf("added playlist %s", pl.Title))
+	case "delete":
+		pl, ok := gs.FindPlaylist(name)
+		if !ok {
+			s.respondErr(ds, i, ErrGuildPlaylistDoesNotExist)
+			return
+		}
+		if err := gs.RemovePlaylist(pl.Title); err != nil {
+			s.respondErr(ds, i, err)
+			return
+		}
+		s.respondMsg(ds, i, fmt.Sprintf("deleted playlist %s", pl.Title))
+	default:
+		s.respondErr(ds, i, fmt.Errorf("unknown playlist command %#v", sub))
+	}
+}
+
+func (s *DiscordBot) slashUI(ds *discordgo.Session, i *discordgo.InteractionCreate, opts slashOptions) {
+	if _, _, err := s.sessionFor(ds, i.GuildID, i.ChannelID, i.Member.User.ID); err != nil {
+		s.respondErr(ds, i, err)
+		return
+	}
+
+	// Only the user who asked can see the link, anyone who sees it could use
+	// it.
+	s.respond(ds, i, &discordgo.InteractionResponseData{
+		Content: s.uiLink(i.GuildID, i.Member.User.ID),
+		Flags:   uint64(discordgo.MessageFlagsEphemeral),
+	})
+}
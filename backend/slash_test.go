@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestSlashOptions(t *testing.T) {
+	opts := newSlashOptions([]*discordgo.ApplicationCommandInteractionDataOption{
+		{Name: "query", Type: discordgo.ApplicationCommandOptionString, Value: "tavern"},
+		{Name: "loud", Type: discordgo.ApplicationCommandOptionBoolean, Value: true},
+	})
+
+	for name, want := range map[string]string{"query": "tavern", "loud": "", "missing": ""} {
+		if got := opts.String(name); got != want {
+			t.Errorf("String(%#v) = %#v, want %#v", name, got, want)
+		}
+	}
+
+	if _, _, ok := opts.Subcommand(); ok {
+		t.Error("Subcommand() found one in options without any")
+	}
+
+	opts = newSlashOptions([]*discordgo.ApplicationCommandInteractionDataOption{{
+		Name: "add",
+		Type: discordgo.ApplicationCommandOptionSubCommand,
+		Options: []*discordgo.ApplicationCommandInteractionDataOption{
+			{Name: "name", Type: discordgo.ApplicationCommandOptionString, Value: "Tavern"},
+		},
+	}})
+	sub, subOpts, ok := opts.Subcommand()
+	if !ok || sub != "add" || subOpts.String("name") != "Tavern" {
+		t.Errorf("Subcommand() = %#v, %v, %v, want add with the name Tavern", sub, subOpts, ok)
+	}
+}
+
+// testInteractions points interaction responses at a test server, returning
+// every response sent.
+func testInteractions(t *testing.T) (*discordgo.Session, func() []discordgo.InteractionResponse) {
+	var responses []discordgo.InteractionResponse
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var res discordgo.InteractionResponse
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			t.Error(err)
+		}
+		responses = append(responses, res)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	endpoint := discordgo.EndpointInteractionResponse
+	discordgo.EndpointInteractionResponse = func(iID, iToken string) string {
+		return srv.URL + "/interactions/" + iID + "/" + iToken + "/callback"
+	}
+	t.Cleanup(func() { discordgo.EndpointInteractionResponse = endpoint })
+
+	ds, err := discordgo.New("Bot token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough of the guild for permissions to be worked out from the state.
+	ds.State.GuildAdd(&discordgo.Guild{
+		ID:       "guild",
+		OwnerID:  "owner",
+		Roles:    []*discordgo.Role{{ID: "guild"}, {ID: "djs"}},
+		Channels: []*discordgo.Channel{{ID: "channel", GuildID: "guild"}},
+	})
+	return ds, func() []discordgo.InteractionResponse { return responses }
+}
+
+func TestSlashAllowed(t *testing.T) {
+	sessions := testSessions()
+	gs, _ := sessions.FromGuild("guild")
+	gs.SetDJRole("djs")
+	s := &DiscordBot{sessions: sessions}
+	ds, responses := testInteractions(t)
+
+	interaction := func(userID string, roles ...string) *discordgo.InteractionCreate {
+		m := &discordgo.Member{GuildID: "guild", User: &discordgo.User{ID: userID}, Roles: roles}
+		ds.State.MemberAdd(m)
+		return &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{
+			ID: userID, Token: "token", GuildID: "guild", ChannelID: "channel", Member: m,
+		}}
+	}
+
+	if !s.slashAllowed(ds, interaction("dj", "djs"), PermSkip) {
+		t.Error("slashAllowed() refused a DJ")
+	}
+	if got := responses(); len(got) != 0 {
+		t.Errorf("slashAllowed() responded %+v to a DJ, want nothing", got)
+	}
+
+	if s.slashAllowed(ds, interaction("player"), PermSkip) {
+		t.Fatal("slashAllowed() let a player without the DJ role skip")
+	}
+	got := responses()
+	if len(got) != 1 || got[0].Data == nil {
+		t.Fatalf("slashAllowed() responded %+v, want one refusal", got)
+	}
+	if got[0].Data.Content != ErrNeedDJ.Error() || got[0].Data.Flags != uint64(discordgo.MessageFlagsEphemeral) {
+		t.Errorf("refusal = %#v, flags %d, want %#v only the player can see", got[0].Data.Content, got[0].Data.Flags, ErrNeedDJ.Error())
+	}
+
+	// Owners can do anything, same as admins.
+	if !s.slashAllowed(ds, interaction("owner"), PermSkip) {
+		t.Error("slashAllowed() refused the server owner")
+	}
+}
+
+func TestListEmbed(t *testing.T) {
+	embed := listEmbed("Queue", []string{"-  1. a", "-  2. b"})
+	if embed.Description != "```\n-  1. a\n-  2. b\n```" || embed.Footer != nil {
+		t.Errorf("short list: description %#v, footer %+v, want both lines and no footer", embed.Description, embed.Footer)
+	}
+
+	// Long lists are cut short at whole lines, counting characters rather
+	// than bytes.
+	var lines []string
+	for i := 0; i < 500; i++ {
+		lines = append(lines, fmt.Sprintf("-  %d. %s", i+1, strings.Repeat("é", 20)))
+	}
+	embed = listEmbed("Queue", lines)
+	if n := utf8.RuneCountInString(embed.Description); n > maxEmbedDescription {
+		t.Errorf("description is %d characters, want at most %d", n, maxEmbedDescription)
+	}
+	shown := strings.Count(embed.Description, "\n") - 1
+	if shown < 100 {
+		t.Errorf("only %d lines shown, the description should be close to full", shown)
+	}
+	if want := fmt.Sprintf("…and %d more", len(lines)-shown); embed.Footer == nil || embed.Footer.Text != want {
+		t.Errorf("footer = %+v, want %#v", embed.Footer, want)
+	}
+
+	// It's sent as the reply.
+	s := &DiscordBot{}
+	ds, responses := testInteractions(t)
+	s.respondList(ds, &discordgo.InteractionCreate{Interaction: &discordgo.Interaction{ID: "1", Token: "token"}}, "Queue", lines)
+	got := responses()
+	if len(got) != 1 || len(got[0].Data.Embeds) != 1 || got[0].Data.Embeds[0].Footer == nil {
+		t.Errorf("respondList() sent %+v, want one embed with a footer", got)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonas747/ogg"
+	"github.com/layeh/gopus"
+)
+
+// Each guild keeps its sound effects in a directory under effectsDir, it's
+// set in main() to live alongside the guild store.
+var effectsDir = "effects"
+
+const (
+	// maxEffectLength is as much of a clip as we keep, sound effects are
+	// meant to be short.
+	maxEffectLength = 30 * time.Second
+
+	// maxEffectUpload is the largest file that can be uploaded as a sound
+	// effect, before it's encoded.
+	maxEffectUpload = 20 << 20
+
+	// addEffectTimeout is how long fetching and encoding an effect can take.
+	addEffectTimeout = 2 * time.Minute
+
+	// duckVolume is the volume, in percent, the music drops to while sound
+	// effects play over it.
+	duckVolume = 30
+
+	duckAttack  = 100 * time.Millisecond
+	duckRelease = 500 * time.Millisecond
+)
+
+var (
+	ErrEffectDoesNotExist = errors.New("there's no sound effect with that name")
+	ErrEffectName         = errors.New("sound effect names can only have letters, numbers, - and _, and be up to 32 characters")
+)
+
+var effectNameRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// reservedEffectNames are the sfx subcommands, an effect named after one
+// could never be played.
+var reservedEffectNames = map[string]bool{
+	"list": true, "add": true, "remove": true, "delete": true, "rm": true, "duck": true,
+}
+
+// effectName cleans up the name of an effect, names are case insensitive.
+func effectName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if !effectNameRegexp.MatchString(name) {
+		return "", ErrEffectName
+	}
+	if reservedEffectNames[name] {
+		return "", fmt.Errorf("%s can't be used as the name of a sound effect", name)
+	}
+	return name, nil
+}
+
+// guildEffectsDir is where the sound effects of a guild are kept.
+func guildEffectsDir(guildID string) string {
+	return path.Join(effectsDir, guildID)
+}
+
+// Effect is a short clip that can be played over the music.
+type Effect struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+
+	// Source is the url or file the effect was made from.
+	Source string        `json:"source,omitempty"`
+	Length time.Duration `json:"length"`
+}
+
+// effectArgs encodes input the same way as tracks, cut to maxEffectLength.
+func effectArgs(input string) []string {
+	limit := []string{"-t", fmt.Sprintf("%.0f", maxEffectLength.Seconds())}
+	return append(limit, encodeArgs(input, 0)...)
+}
+
+// loadEffect decodes an encoded effect into frames of PCM. Effects are short,
+// so they're decoded whole every time they play.
+func loadEffect(p string) ([][]int16, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec, err := gopus.NewDecoder(sampleRate, channels)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := ogg.NewPacketDecoder(ogg.NewDecoder(bufio.NewReader(f)))
+	frames := [][]int16{}
+	skip := 2
+	for {
+		pkt, _, err := decoder.Decode()
+		if err == io.EOF {
+			return frames, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading ogg: %w", err)
+		}
+
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		pcm, err := decodeFrame(dec, pkt)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, pcm)
+	}
+}
+
+// Soundboard holds the sound effects of a guild, and plays them into its
+// Layer. Any number of effects can play at once, they're mixed together.
+type Soundboard struct {
+	sync.Mutex
+
+	dir     string
+	effects map[string]*Effect
+	out     *Layer
+
+	// playing holds what's left of each effect that's playing.
+	playing [][][]int16
+	// stop is closed to stop playing, it's nil unless we are.
+	stop chan struct{}
+}
+
+func newSoundboard(dir string, effects []*Effect) *Soundboard {
+	sb := &Soundboard{
+		dir:     dir,
+		effects: map[string]*Effect{},
+		out:     newLayer(defaultVolume),
+	}
+	for _, e := range effects {
+		sb.effects[e.Name] = e
+	}
+	return sb
+}
+
+func (sb *Soundboard) Layer() *Layer {
+	return sb.out
+}
+
+func (sb *Soundboard) path(e *Effect) string {
+	return path.Join(sb.dir, e.File)
+}
+
+// Effects returns every effect, sorted by name.
+func (sb *Soundboard) Effects() []*Effect {
+	sb.Lock()
+	defer sb.Unlock()
+
+	effects := []*Effect{}
+	for _, e := range sb.effects {
+		effects = append(effects, e)
+	}
+	sort.Slice(effects, func(i, j int) bool {
+		return effects[i].Name < effects[j].Name
+	})
+	return effects
+}
+
+// AddURL fetches an effect from a url, anything youtube-dl understands,
+// replacing any effect with the same name.
+func (sb *Soundboard) AddURL(name, url string) (*Effect, error) {
+	extract := extractArgs(url)
+	encode := append([]string{ffmpegPath}, effectArgs("pipe:0")...)
+
+	return sb.add(name, url, extract, encode)
+}
+
+// AddFile adds an uploaded file as an effect, replacing any effect with the
+// same name.
+func (sb *Soundboard) AddFile(name, filename string, r io.Reader) (*Effect, error) {
+	// Don't bother with the upload if the name is no good.
+	if _, err := effectName(name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(sb.dir, 0755); err != nil {
+		return nil, fmt.Errorf("AddFile: %w", err)
+	}
+
+	// Some containers can't be read from a pipe, so hand ffmpeg a file.
+	upload, err := ioutil.TempFile(sb.dir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("AddFile: %w", err)
+	}
+	defer os.Remove(upload.Name())
+
+	_, err = io.Copy(upload, r)
+	if cErr := upload.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("AddFile: %w", err)
+	}
+
+	encode := append([]string{ffmpegPath}, effectArgs(upload.Name())...)
+	return sb.add(name, filename, encode)
+}
+
+// add runs the pipeline that encodes an effect, and keeps the result.
+func (sb *Soundboard) add(name, source string, cmds ...[]string) (*Effect, error) {
+	name, err := effectName(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(sb.dir, 0755); err != nil {
+		return nil, fmt.Errorf("Soundboard.add: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), addEffectTimeout)
+	defer cancel()
+
+	stream, err := newTrackStream(ctx, name, cmds...)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(sb.dir, "add-*.ogg")
+	if err != nil {
+		stream.Kill()
+		return nil, fmt.Errorf("Soundboard.add: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, stream); err != nil {
+		stream.Kill()
+		tmp.Close()
+		return nil, fmt.Errorf("Soundboard.add: %w", err)
+	}
+	if err := stream.Close(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, fmt.Errorf("Soundboard.add: %w", err)
+	}
+
+	// Make sure what we got actually plays before keeping it.
+	frames, err := loadEffect(tmp.Name())
+	if err != nil {
+		return nil, fmt.Errorf("Soundboard.add: %w", err)
+	} else if len(frames) == 0 {
+		return nil, fmt.Errorf("%s has no audio", source)
+	}
+
+	e := &Effect{
+		Name:   name,
+		File:   name + ".ogg",
+		Source: source,
+		Length: time.Duration(len(frames)) * frameDuration,
+	}
+
+	sb.Lock()
+	defer sb.Unlock()
+
+	if err := os.Rename(tmp.Name(), sb.path(e)); err != nil {
+		return nil, fmt.Errorf("Soundboard.add: %w", err)
+	}
+	sb.effects[name] = e
+	return e, nil
+}
+
+// Remove deletes an effect.
+func (sb *Soundboard) Remove(name string) error {
+	sb.Lock()
+	defer sb.Unlock()
+
+	e, ok := sb.effects[strings.ToLower(name)]
+	if !ok {
+		return ErrEffectDoesNotExist
+	}
+
+	if err := os.Remove(sb.path(e)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Soundboard.Remove: %w", err)
+	}
+	delete(sb.effects, e.Name)
+	return nil
+}
+
+// Play starts an effect, over anything that's already playing.
+func (sb *Soundboard) Play(name string) error {
+	sb.Lock()
+	e, ok := sb.effects[strings.ToLower(name)]
+	sb.Unlock()
+	if !ok {
+		return ErrEffectDoesNotExist
+	}
+
+	frames, err := loadEffect(sb.path(e))
+	if err != nil {
+		return fmt.Errorf("can't play %s: %w", e.Name, err)
+	}
+
+	sb.Lock()
+	defer sb.Unlock()
+
+	sb.playing = append(sb.playing, frames)
+	if sb.stop == nil {
+		sb.stop = make(chan struct{})
+		go sb.run(sb.stop)
+	}
+	return nil
+}
+
+// run mixes the effects that are playing into our layer until they've all
+// finished, or we're stopped.
+func (sb *Soundboard) run(stop chan struct{}) {
+	for {
+		sb.Lock()
+		if sb.stop != stop {
+			sb.Unlock()
+			return
+		} else if len(sb.playing) == 0 {
+			sb.stop = nil
+			sb.Unlock()
+			return
+		}
+
+		frame := newFrame()
+		left := sb.playing[:0]
+		for _, clip := range sb.playing {
+			mixFrame(frame, clip[0])
+			if len(clip) > 1 {
+				left = append(left, clip[1:])
+			}
+		}
+		sb.playing = left
+		sb.Unlock()
+
+		select {
+		case sb.out.frames <- frame:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Playing reports whether any effects are playing.
+func (sb *Soundboard) Playing() bool {
+	sb.Lock()
+	defer sb.Unlock()
+	return sb.stop != nil
+}
+
+// Stop cuts off every effect that's playing.
+func (sb *Soundboard) Stop() {
+	sb.Lock()
+	defer sb.Unlock()
+
+	sb.playing = nil
+	if sb.stop != nil {
+		close(sb.stop)
+		sb.stop = nil
+	}
+}
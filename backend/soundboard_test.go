@@ -0,0 +1,189 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonas747/ogg"
+	"github.com/layeh/gopus"
+)
+
+func tempEffectsDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "effects")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeEffect encodes frames of silence into an Ogg/Opus file, laid out like
+// the ones ffmpeg writes for us.
+func writeEffect(t *testing.T, p string, frames int) {
+	f, err := os.Create(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	enc, err := gopus.NewEncoder(sampleRate, channels, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := ogg.NewEncoder(1, f)
+	if err := w.EncodeBOS(0, []byte("OpusHead")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Encode(0, []byte("OpusTags")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < frames; i++ {
+		pkt, err := enc.Encode(newFrame(), frameSize, maxBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Encode(int64((i+1)*frameSize), pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestEffectName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"Roar", "roar", true},
+		{" door-creak_2 ", "door-creak_2", true},
+		{"", "", false},
+		{"two words", "", false},
+		{"list", "", false},
+		{"0123456789012345678901234567890123", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := effectName(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("effectName(%#v) = %#v, %v, want %#v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestLoadEffect(t *testing.T) {
+	dir := tempEffectsDir(t)
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "roar.ogg")
+	writeEffect(t, p, 25)
+
+	frames, err := loadEffect(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 25 {
+		t.Errorf("got %d frames, want 25", len(frames))
+	}
+	for _, pcm := range frames {
+		if len(pcm) != frameSize*channels {
+			t.Fatalf("got a frame of %d samples, want %d", len(pcm), frameSize*channels)
+		}
+	}
+}
+
+func TestSoundboardOverlap(t *testing.T) {
+	sb := newSoundboard("", nil)
+
+	clip := func(v int16, n int) [][]int16 {
+		frames := [][]int16{}
+		for i := 0; i < n; i++ {
+			pcm := newFrame()
+			for j := range pcm {
+				pcm[j] = v
+			}
+			frames = append(frames, pcm)
+		}
+		return frames
+	}
+
+	// Start both at once, as if they'd been triggered together.
+	sb.Lock()
+	sb.playing = [][][]int16{clip(100, 3), clip(10, 1)}
+	sb.stop = make(chan struct{})
+	go sb.run(sb.stop)
+	sb.Unlock()
+
+	want := []int16{110, 100, 100}
+	for i, w := range want {
+		select {
+		case pcm := <-sb.Layer().frames:
+			if pcm[0] != w {
+				t.Errorf("frame %d = %d, want %d", i, pcm[0], w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for frame %d", i)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for sb.Playing() {
+		if time.Now().After(deadline) {
+			t.Fatal("still playing after every effect finished")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSoundboardPlay(t *testing.T) {
+	dir := tempEffectsDir(t)
+	defer os.RemoveAll(dir)
+
+	writeEffect(t, filepath.Join(dir, "roar.ogg"), 5)
+	sb := newSoundboard(dir, []*Effect{{Name: "roar", File: "roar.ogg"}})
+
+	if err := sb.Play("thunder"); err != ErrEffectDoesNotExist {
+		t.Errorf("Play(unknown) = %v, want ErrEffectDoesNotExist", err)
+	}
+
+	if err := sb.Play("Roar"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-sb.Layer().frames:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for frame %d", i)
+		}
+	}
+
+	if err := sb.Remove("roar"); err != nil {
+		t.Fatal(err)
+	}
+	if len(sb.Effects()) != 0 {
+		t.Errorf("Effects() = %v after removing the only effect", sb.Effects())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "roar.ogg")); !os.IsNotExist(err) {
+		t.Errorf("effect file still exists after Remove: %v", err)
+	}
+}
+
+// Urls come from anyone who can add an effect, they mustn't be able to pass
+// youtube-dl options like --exec.
+func TestURLsAreNotOptions(t *testing.T) {
+	for _, url := range []string{"--exec=touch pwned", "--config-location=/tmp/x", "-a/etc/passwd"} {
+		for _, args := range [][]string{extractArgs(url), infoArgs(url)} {
+			n := len(args)
+			if n < 2 || args[n-2] != "--" || args[n-1] != url {
+				t.Errorf("args for %#v = %#v, want them to end with \"--\", the url", url, args)
+			}
+			for _, a := range args[:n-1] {
+				if a == url {
+					t.Errorf("args for %#v = %#v, the url is passed before \"--\"", url, args)
+				}
+			}
+		}
+	}
+}
@@ -3,8 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
-	"math/rand"
-	"strconv"
+	"log"
 	"sync"
 
 	"github.com/bwmarrin/discordgo"
@@ -25,18 +24,25 @@ type SessionManager struct {
 	// sessions contains all ongoing discord sessions
 	//   i.e., map[session id] -> state
 	sessions sync.Map // map[string]*Session
+
+	// store persists sessions so they survive restarts.
+	store *GuildStore
 }
 
 var ErrSessionExists = errors.New("session already exists")
 var ErrSessionDoesNotExist = errors.New("session does not exist")
 
 func (s *SessionManager) FromOrCreate(guildID string,
-	msg func(msg string) error, joinVoice func() (*discordgo.VoiceConnection, error)) (*Session, string, error) {
+	msg func(msg string) error, joinVoice func() (*discordgo.VoiceConnection, error),
+	listeners func() []string) (*Session, string, error) {
 	sID, ok := s.guildLookup.Load(guildID)
 	if !ok {
-		// XXX: WE NEED TO PERSIST GUILDS HERE!! SUPER MEGA IMPORTANT!!!
 		seshID := generateSID(s) // assign a new one because of interface reasons :(
-		state := newSession()
+		state := newSession(guildID, seshID, s.store)
+
+		state.Lock()
+		state.save()
+		state.Unlock()
 
 		s.sessions.Store(seshID, state)
 		s.guildLookup.Store(guildID, seshID)
@@ -50,12 +56,58 @@ func (s *SessionManager) FromOrCreate(guildID string,
 	}
 
 	state := st.(*Session) // allow panic here we ever store something that isn't a Session
+	state.Lock()
 	state.msg = msg
 	state.joinVoice = joinVoice
+	state.listeners = listeners
+	state.Unlock()
 
 	return state, sID.(string), nil
 }
 
+// Load restores every session persisted in the store.
+//
+// This should be called once on startup, before the bot starts handling
+// messages.
+func (s *SessionManager) Load() error {
+	if s.store == nil {
+		return nil
+	}
+
+	recs, err := s.store.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	n := 0
+	for _, rec := range recs {
+		state, err := sessionFromRecord(rec, s.store)
+		if err != nil {
+			log.Printf("Load: skipping guild %s: %v", rec.GuildID, err)
+			if err := s.store.SetAside(rec.GuildID); err != nil {
+				log.Printf("Load: %v", err)
+			}
+			continue
+		}
+
+		s.sessions.Store(rec.SessionID, state)
+		s.guildLookup.Store(rec.GuildID, rec.SessionID)
+		n++
+	}
+
+	log.Printf("Load: restored %d sessions", n)
+	return nil
+}
+
+// SaveAll checkpoints every session, this should be called before exiting so
+// playback can be resumed after a restart.
+func (s *SessionManager) SaveAll() {
+	s.sessions.Range(func(_, v interface{}) bool {
+		v.(*Session).Checkpoint()
+		return true
+	})
+}
+
 func (s *SessionManager) FromGuild(guildID string) (*Session, error) {
 	sID, exists := s.guildLookup.Load(guildID)
 	if !exists {
@@ -79,7 +131,7 @@ func (s *SessionManager) Exists(sID string) bool {
 func (s *SessionManager) GetState(sID string) (*Session, error) {
 	st, exists := s.sessions.Load(sID)
 	if !exists {
-		return nil, errors.New("invalid id")
+		return nil, ErrSessionDoesNotExist
 	}
 	state := st.(*Session) // allow panic here we ever store something that isn't a Session
 	return state, nil
@@ -90,12 +142,16 @@ func (s *SessionManager) SetPlaylist(id, url string) error {
 	if err != nil {
 		return err
 	}
-	state.SetPlaylist(url)
-	return nil
+	return state.SetPlaylist(url)
 }
 
+// generateSID picks an id for a new session. They're random so they can't be
+// guessed, though the web ui doesn't rely on that any more, see Auth.
 func generateSID(ongoingSessions *SessionManager) string {
-	// XXX: Ensure uniquness.
-	pwi := rand.Intn(899998)
-	return strconv.Itoa(pwi + 100000)
+	for {
+		id := randomToken(16)
+		if !ongoingSessions.Exists(id) {
+			return id
+		}
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/google/go-cmp/cmp"
 )
 
@@ -51,4 +52,109 @@ func TestGuildPlaylists(t *testing.T) {
 		t.Errorf("guildPlaylists.GetAll() mismatch (-want +got):\n%s", diff)
 	}
 
+	if err := l.Remove("c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Get("c"); err == nil {
+		t.Fatal(errors.New("expected error"))
+	}
+	if diff := cmp.Diff([]*Playlist{tests[0], tests[1], tests[3], tests[4]}, l.GetAll()); diff != "" {
+		t.Errorf("guildPlaylists.Remove() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCombatPlaylist(t *testing.T) {
+	gs := &Session{playlists: newGuildPlaylists()}
+	add := func(title, category string) {
+		pl, err := NewPlaylist(title, category, []Track{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := gs.playlists.Insert(pl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("Tavern", "Ambient")
+	if _, err := gs.combatPlaylist(""); err != ErrNoCombatPlaylist {
+		t.Errorf("combatPlaylist() without combat playlists = %v, want ErrNoCombatPlaylist", err)
+	}
+
+	want := func(title, got string) {
+		t.Helper()
+		pl, err := gs.combatPlaylist(title)
+		if err != nil {
+			t.Fatalf("combatPlaylist(%#v): %v", title, err)
+		}
+		if pl.Title != got {
+			t.Errorf("combatPlaylist(%#v) = %s, want %s", title, pl.Title, got)
+		}
+	}
+
+	add("Combat: Boss", "Combat")
+	want("", "Combat: Boss")
+
+	add(defaultCombatPlaylist, "Combat")
+	want("", defaultCombatPlaylist)
+
+	gs.settings.CombatPlaylist = "Combat: Boss"
+	want("", "Combat: Boss")
+
+	want("tavern", "Tavern")
+	if _, err := gs.combatPlaylist("Dungeon"); err != ErrGuildPlaylistDoesNotExist {
+		t.Errorf("combatPlaylist(unknown) = %v, want ErrGuildPlaylistDoesNotExist", err)
+	}
+}
+
+// Sessions restored after a restart don't know how to join voice until
+// someone uses a command in Discord, anything that would start playing has
+// to refuse rather than crash.
+func TestRestoredSessionNeedsVoice(t *testing.T) {
+	sessions := testSessions()
+	gs, err := sessions.FromGuild("guild")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pl, err := NewPlaylist("Tavern", "Combat", []Track{{Name: "Lute", URL: "https://example.com/lute"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.AddPlaylist(pl); err != nil {
+		t.Fatal(err)
+	}
+	if err := gs.SaveScene(&Scene{Name: "Tavern", Playlist: "Tavern", Volume: 80}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gs.SetPlaylist("Tavern"); err != ErrNotInVoice {
+		t.Errorf("SetPlaylist() = %v, want ErrNotInVoice", err)
+	}
+	if _, err := gs.SetScene("Tavern", Requester{}); err != ErrNotInVoice {
+		t.Errorf("SetScene() = %v, want ErrNotInVoice", err)
+	}
+	if gs.Volume() != defaultVolume || gs.Scene() != "" {
+		t.Errorf("refused SetScene() changed the session: volume %d, scene %#v", gs.Volume(), gs.Scene())
+	}
+	if _, err := gs.StartCombat("Tavern"); err != ErrNotInVoice {
+		t.Errorf("StartCombat() = %v, want ErrNotInVoice", err)
+	}
+	if gs.InCombat() {
+		t.Error("refused StartCombat() started combat")
+	}
+	if err := gs.PlayEffect("boom"); err != ErrNotInVoice {
+		t.Errorf("PlayEffect() = %v, want ErrNotInVoice", err)
+	}
+
+	msg := func(string) error { return nil }
+	joinVoice := func() (*discordgo.VoiceConnection, error) { return nil, errors.New("no voice here") }
+	if _, _, err := sessions.FromOrCreate("guild", msg, joinVoice, nil); err != nil {
+		t.Fatal(err)
+	}
+	gs.Lock()
+	err = gs.voiceReady()
+	gs.Unlock()
+	if err != nil {
+		t.Errorf("voiceReady() after FromOrCreate = %v, want nil", err)
+	}
 }
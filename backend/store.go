@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// currentSchemaVersion is the version of guildRecord written to disk.
+//
+// When changing the layout of guildRecord bump this and teach migrateRecord
+// how to bring older records up to date.
+const currentSchemaVersion = 10
+
+var ErrGuildNotStored = errors.New("guild is not in the store")
+
+// SessionSettings holds the player settings of a session that should survive
+// a restart.
+type SessionSettings struct {
+	// Playlist is the title of the last playlist selected in the session.
+	Playlist string `json:"playlist,omitempty"`
+
+	// QueueMode is the queue implementation used by the player.
+	QueueMode QueueMode `json:"queue_mode,omitempty"`
+
+	// Prefix is the prefix for text commands, empty means defaultPrefix.
+	Prefix string `json:"prefix,omitempty"`
+
+	// Crossfade is how long tracks overlap when one follows another.
+	Crossfade time.Duration `json:"crossfade,omitempty"`
+
+	// Volume is the gain applied to the session's audio, in percent.
+	Volume int `json:"volume"`
+
+	// Normalize evens out the loudness of tracks.
+	Normalize bool `json:"normalize,omitempty"`
+
+	// AmbienceVolume is the volume of the ambience under the music, in
+	// percent.
+	AmbienceVolume int `json:"ambience_volume"`
+
+	// Duck turns the music down while sound effects play.
+	Duck bool `json:"duck,omitempty"`
+
+	// CombatPlaylist is the title of the playlist last used for combat.
+	CombatPlaylist string `json:"combat_playlist,omitempty"`
+
+	// Shuffle plays playlists and queued tracks in a random order.
+	Shuffle bool `json:"shuffle,omitempty"`
+
+	// Loop is what happens when a track ends or the queue runs out, empty
+	// means LoopAuto.
+	Loop LoopMode `json:"loop,omitempty"`
+
+	// Permissions says who may control the music.
+	Permissions Permissions `json:"permissions"`
+
+	// VoteSkipShare is the percentage of listeners who have to vote to skip
+	// a track.
+	VoteSkipShare int `json:"vote_skip_share"`
+}
+
+// guildRecord is the on disk representation of a guild's session.
+type guildRecord struct {
+	Version   int             `json:"version"`
+	GuildID   string          `json:"guild_id"`
+	SessionID string          `json:"session_id"`
+	Playlists []*Playlist     `json:"playlists"`
+	Settings  SessionSettings `json:"settings"`
+	Effects   []*Effect       `json:"effects,omitempty"`
+	Scenes    []*Scene        `json:"scenes,omitempty"`
+
+	// Resume is where playback was when the session was last stopped.
+	Resume *ResumePoint `json:"resume,omitempty"`
+}
+
+// GuildStore persists guild sessions as one JSON file per guild.
+//
+// This is deliberately simple, like the rest of our caches. We write whole
+// records every time something changes, which is fine for the amount of
+// playlists a guild is expected to have.
+type GuildStore struct {
+	sync.Mutex
+
+	dir string
+}
+
+func NewGuildStore(dir string) (*GuildStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("NewGuildStore: %w", err)
+	}
+	return &GuildStore{dir: dir}, nil
+}
+
+func (s *GuildStore) path(guildID string) string {
+	return path.Join(s.dir, guildID+".json")
+}
+
+// Save writes the record to disk, replacing whatever was stored for the guild.
+func (s *GuildStore) Save(rec *guildRecord) error {
+	if rec.GuildID == "" {
+		return errors.New("Save: record has no guild id")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	rec.Version = currentSchemaVersion
+
+	// Write to a temporary file first so a crash can't leave half a record.
+	p := s.path(rec.GuildID)
+	tmp := p + ".tmp"
+	if err := writeJSON(tmp, rec); err != nil {
+		return fmt.Errorf("Save(%s): %w", rec.GuildID, err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return fmt.Errorf("Save(%s): %w", rec.GuildID, err)
+	}
+	return nil
+}
+
+// Load reads the record of a single guild.
+func (s *GuildStore) Load(guildID string) (*guildRecord, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	rec := &guildRecord{}
+	if err := loadJSON(s.path(guildID), rec); err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrGuildNotStored
+		}
+		return nil, fmt.Errorf("Load(%s): %w", guildID, err)
+	}
+
+	if err := migrateRecord(rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// SetAside moves the record of a guild out of the way, keeping it for someone
+// to look at rather than having a new session overwrite it.
+func (s *GuildStore) SetAside(guildID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	p := s.path(guildID)
+	if err := os.Rename(p, fmt.Sprintf("%s.bad-%d", p, time.Now().Unix())); err != nil {
+		return fmt.Errorf("SetAside(%s): %w", guildID, err)
+	}
+	return nil
+}
+
+// LoadAll reads the records of every stored guild. Records that can't be read
+// are logged and set aside, one bad file shouldn't stop every other guild
+// loading.
+func (s *GuildStore) LoadAll() ([]*guildRecord, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("LoadAll: %w", err)
+	}
+
+	recs := []*guildRecord{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		guildID := strings.TrimSuffix(f.Name(), ".json")
+		rec, err := s.Load(guildID)
+		if err != nil {
+			log.Printf("LoadAll: skipping guild %s: %v", guildID, err)
+			if err := s.SetAside(guildID); err != nil {
+				log.Printf("LoadAll: %v", err)
+			}
+			continue
+		}
+		recs = append(recs, rec)
+	}
+
+	return recs, nil
+}
+
+// migrateRecord brings a record read from disk up to currentSchemaVersion.
+func migrateRecord(rec *guildRecord) error {
+	if rec.Version > currentSchemaVersion {
+		return fmt.Errorf("guild %s: schema version %d is newer than supported version %d",
+			rec.GuildID, rec.Version, currentSchemaVersion)
+	}
+
+	for rec.Version < currentSchemaVersion {
+		switch rec.Version {
+		case 0:
+			// Records written before versioning share the layout of version 1.
+		case 1:
+			// Volume was added, everything used to play at full volume.
+			rec.Settings.Volume = defaultVolume
+		case 2:
+			rec.Settings.AmbienceVolume = defaultAmbienceVolume
+		case 3:
+			// Sound effects were added, there were none before.
+		case 4:
+			// Combat was added, sessions without a combat playlist fall back
+			// to the Combat category.
+		case 5:
+			// Scenes were added, there were none before.
+		case 6:
+			// Shuffle was added, everything used to play in order.
+		case 7:
+			// Loop modes were added, LoopAuto is how queues used to end.
+		case 8:
+			// Permissions were added, everyone could do everything.
+		case 9:
+			rec.Settings.VoteSkipShare = defaultVoteSkipShare
+		}
+		rec.Version++
+	}
+
+	return nil
+}
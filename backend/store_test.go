@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGuildStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guildstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewGuildStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Load("missing"); err != ErrGuildNotStored {
+		t.Fatalf("Load(missing) = %v, want %v", err, ErrGuildNotStored)
+	}
+
+	pl, err := NewPlaylist("Tavern", "Town", []Track{{Name: "Drinking Song", URL: "https://example.com/a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &guildRecord{
+		GuildID:   "1234",
+		SessionID: "567890",
+		Playlists: []*Playlist{pl},
+		Settings:  SessionSettings{Playlist: "Tavern"},
+	}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]*guildRecord{want}, got); diff != "" {
+		t.Errorf("GuildStore.LoadAll() mismatch (-want +got):\n%s", diff)
+	}
+
+	if got[0].Version != currentSchemaVersion {
+		t.Errorf("record version = %d, want %d", got[0].Version, currentSchemaVersion)
+	}
+}
+
+func TestGuildStoreSkipsBadRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "guildstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewGuildStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &guildRecord{GuildID: "1234", SessionID: "567890"}
+	if err := store.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(store.path("half"), []byte(`{"guild_id": "ha`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].GuildID != "1234" {
+		t.Fatalf("LoadAll() = %+v, want only guild 1234", got)
+	}
+
+	// The bad record is kept, but out of the way of a new session.
+	if _, err := os.Stat(store.path("half")); !os.IsNotExist(err) {
+		t.Errorf("bad record is still in place: %v", err)
+	}
+	kept, err := filepath.Glob(store.path("half") + ".bad-*")
+	if err != nil || len(kept) != 1 {
+		t.Errorf("set aside records = %v, %v, want one", kept, err)
+	}
+}
+
+func TestMigrateRecord(t *testing.T) {
+	rec := &guildRecord{GuildID: "1234"}
+	if err := migrateRecord(rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Version != currentSchemaVersion {
+		t.Errorf("migrated version = %d, want %d", rec.Version, currentSchemaVersion)
+	}
+	if rec.Settings.Volume != defaultVolume {
+		t.Errorf("migrated volume = %d, want %d", rec.Settings.Volume, defaultVolume)
+	}
+	if rec.Settings.AmbienceVolume != defaultAmbienceVolume {
+		t.Errorf("migrated ambience volume = %d, want %d", rec.Settings.AmbienceVolume, defaultAmbienceVolume)
+	}
+
+	rec = &guildRecord{GuildID: "1234", Version: currentSchemaVersion + 1}
+	if err := migrateRecord(rec); err == nil {
+		t.Error("expected error migrating a record from the future")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// defaultVoteSkipShare is the percentage of listeners who have to vote to
+// skip a track.
+const defaultVoteSkipShare = 50
+
+var ErrNotListening = errors.New("you need to be listening to vote")
+
+// votesNeeded is how many of n listeners have to vote to skip, share is a
+// percentage.
+func votesNeeded(n, share int) int {
+	needed := (n*share + 99) / 100
+	if needed < 1 {
+		return 1
+	}
+	return needed
+}
+
+// skipVotes counts the votes to skip the current track.
+//
+// Votes are kept by user id, but only counted while the user is listening,
+// so people who leave the channel stop counting towards a skip.
+type skipVotes struct {
+	sync.Mutex
+	voters map[string]bool
+}
+
+func (v *skipVotes) count(listeners []string) int {
+	n := 0
+	for _, id := range listeners {
+		if v.voters[id] {
+			n++
+		}
+	}
+	return n
+}
+
+// Count is how many listeners have voted, and how many have to.
+func (v *skipVotes) Count(listeners []string, share int) (votes, needed int) {
+	v.Lock()
+	defer v.Unlock()
+	return v.count(listeners), votesNeeded(len(listeners), share)
+}
+
+// Vote adds a vote from a listener. Once enough of them have voted the votes
+// are cleared, and passed is set.
+func (v *skipVotes) Vote(userID string, listeners []string, share int) (votes, needed int, passed bool, err error) {
+	listening := false
+	for _, id := range listeners {
+		listening = listening || id == userID
+	}
+	if !listening {
+		return 0, 0, false, ErrNotListening
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if v.voters == nil {
+		v.voters = map[string]bool{}
+	}
+	v.voters[userID] = true
+
+	votes, needed = v.count(listeners), votesNeeded(len(listeners), share)
+	if votes >= needed {
+		v.voters = nil
+		return votes, needed, true, nil
+	}
+	return votes, needed, false, nil
+}
+
+// Reset clears the votes, it reports whether there were any.
+func (v *skipVotes) Reset() bool {
+	v.Lock()
+	defer v.Unlock()
+
+	had := len(v.voters) > 0
+	v.voters = nil
+	return had
+}
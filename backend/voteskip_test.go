@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestVotesNeeded(t *testing.T) {
+	tests := []struct {
+		n, share, want int
+	}{
+		{n: 0, share: 50, want: 1},
+		{n: 1, share: 50, want: 1},
+		{n: 2, share: 50, want: 1},
+		{n: 3, share: 50, want: 2},
+		{n: 4, share: 75, want: 3},
+		{n: 5, share: 100, want: 5},
+		{n: 5, share: 1, want: 1},
+	}
+
+	for _, tc := range tests {
+		if got := votesNeeded(tc.n, tc.share); got != tc.want {
+			t.Errorf("votesNeeded(%d, %d) = %d, want %d", tc.n, tc.share, got, tc.want)
+		}
+	}
+}
+
+func TestSkipVotes(t *testing.T) {
+	var v skipVotes
+	listeners := []string{"a", "b", "c", "d"}
+
+	if _, _, _, err := v.Vote("z", listeners, 50); err != ErrNotListening {
+		t.Errorf("vote from someone not listening = %v, want %v", err, ErrNotListening)
+	}
+
+	// Voting twice only counts once.
+	for i := 0; i < 2; i++ {
+		votes, needed, passed, err := v.Vote("a", listeners, 50)
+		if err != nil || votes != 1 || needed != 2 || passed {
+			t.Fatalf("Vote(a) = %d, %d, %v, %v, want 1, 2, false, nil", votes, needed, passed, err)
+		}
+	}
+
+	// Votes from people who left don't count.
+	if votes, needed := v.Count([]string{"b", "c"}, 50); votes != 0 || needed != 1 {
+		t.Errorf("Count after a left = %d, %d, want 0, 1", votes, needed)
+	}
+
+	votes, needed, passed, err := v.Vote("b", listeners, 50)
+	if err != nil || votes != 2 || needed != 2 || !passed {
+		t.Fatalf("Vote(b) = %d, %d, %v, %v, want 2, 2, true, nil", votes, needed, passed, err)
+	}
+	if votes, _ := v.Count(listeners, 50); votes != 0 {
+		t.Errorf("votes after passing = %d, want 0", votes)
+	}
+
+	v.Vote("c", listeners, 50)
+	if !v.Reset() {
+		t.Error("Reset() = false with a vote, want true")
+	}
+	if v.Reset() {
+		t.Error("Reset() = true without votes, want false")
+	}
+}
+
+func TestSessionVoteSkip(t *testing.T) {
+	gs := newSession("guild", "session", nil)
+
+	if _, _, _, err := gs.VoteSkip("a"); err != ErrNotPlaying {
+		t.Errorf("VoteSkip with nothing playing = %v, want %v", err, ErrNotPlaying)
+	}
+	if votes, needed := gs.SkipVotes(); votes != 0 || needed != 0 {
+		t.Errorf("SkipVotes outside voice = %d, %d, want 0, 0", votes, needed)
+	}
+
+	if err := gs.SetVoteSkipShare(0); err == nil {
+		t.Error("expected error setting the share to 0%")
+	}
+	if err := gs.SetVoteSkipShare(100); err != nil {
+		t.Fatal(err)
+	}
+
+	gs.listeners = func() []string { return []string{"a", "b", "c"} }
+	if votes, needed := gs.SkipVotes(); votes != 0 || needed != 3 {
+		t.Errorf("SkipVotes = %d, %d, want 0, 3", votes, needed)
+	}
+}
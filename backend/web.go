@@ -6,204 +6,625 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"math"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-func genSessionID(ongoingSessions *SessionManager) string {
-	for {
-		session := strconv.Itoa(rand.Int())
-		if !ongoingSessions.Exists(session) {
-			return session
-		}
-	}
-}
-
 func writeError(where string, w http.ResponseWriter, r *http.Request, err error, c int) {
 	log.Printf("%s: %v", where, err)
 	http.Error(w, err.Error(), c)
 }
 
-type wsMsg struct {
-	Message string `json:"message"`
+// wsInvalidSession answers clients of a session that doesn't exist. Version
+// 0 clients are told so in reply to StatusCheck, that's how the web ui knows
+// to show the invalid session page.
+func wsInvalidSession(req string) (interface{}, error) {
+	if req != "StatusCheck" {
+		return nil, ErrSessionDoesNotExist
+	}
+	return wsStatus{Status: "Unverified"}, nil
+}
+
+func wsStatusCheck(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	return wsSnapshot(gs), nil
+}
+
+// wsSnapshot describes everything about a session the web ui shows.
+func wsSnapshot(st *Session) wsStatus {
+	return wsStatus{
+		Status:      "Verified",
+		Playlists:   st.Playlists(),
+		wsTrack:     wsTrackStatus(st),
+		wsSettings:  wsSettingsStatus(st),
+		wsSkipVotes: wsSkipVotesStatus(st),
+	}
+}
+
+func wsSkipVotesStatus(st *Session) wsSkipVotes {
+	votes, needed := st.SkipVotes()
+	return wsSkipVotes{Votes: votes, Needed: needed}
+}
 
-	// StatusCheck
-	Status           string      `json:"status,omitempty"`
-	Playlists        []*Playlist `json:"playlists,omitempty"`
-	CurrentlyPlaying Track       `json:"playing,omitempty"`
-	CurrentPlaylist  []Track     `json:"current_playlist,omitempty"`
+func wsTrackStatus(st *Session) wsTrack {
+	playing, playlist := st.Playing()
+	return wsTrack{
+		CurrentlyPlaying: playing,
+		CurrentPlaylist:  playlist,
+		Paused:           st.Paused(),
+		Position:         st.Position().Seconds(),
+	}
+}
 
-	// MusicSelect
-	Type  string `json:"type,omitempty"` // UNUSED
-	Title string `json:"title,omitempty"`
+func wsSettingsStatus(st *Session) wsSettings {
+	volume, normalize, shuffle := st.Volume(), st.Normalize(), st.Shuffle()
+	ambienceVolume, ducking := st.AmbienceVolume(), st.Ducking()
+	var ambience *Track
+	if t, ok := st.Ambience(); ok {
+		ambience = &t
+	}
 
-	// MusicSkip
-	//  Empty.
+	return wsSettings{
+		Volume:         &volume,
+		Normalize:      &normalize,
+		Shuffle:        &shuffle,
+		Loop:           st.Loop(),
+		Ambience:       ambience,
+		AmbienceVolume: &ambienceVolume,
+		Effects:        st.Effects(),
+		Ducking:        &ducking,
+		Scenes:         st.Scenes(),
+		CurrentScene:   st.Scene(),
+		Combat:         st.InCombat(),
+		CombatPlaylist: st.CombatPlaylist(),
+	}
 }
 
-func wsInvalidSession(ongoingSessions *SessionManager, id string, req wsMsg) (wsMsg, error) {
-	res := wsMsg{}
+// wsEvent turns an event into the message pushed to clients, with the state
+// that changed.
+func wsEvent(st *Session, e Event) wsMessage {
+	msg := wsMessage{Type: string(e.Type)}
+
+	switch e.Type {
+	case EventTrackChanged, EventQueueChanged:
+		msg.Payload = wsTrackStatus(st)
+	case EventPaused:
+		msg.Payload = wsPaused{Paused: st.Paused(), Position: st.Position().Seconds()}
+	case EventPlaylistsChanged:
+		msg.Payload = wsPlaylists{Playlists: st.Playlists()}
+	case EventSettingsChanged:
+		msg.Payload = wsSettingsStatus(st)
+	case EventSkipVotesChanged:
+		msg.Payload = wsSkipVotesStatus(st)
+	case EventError:
+		msg.Type = wsErrorType
+		msg.Payload = toWsError(e.Err)
+	}
+	return msg
+}
 
-	if req.Message != "StatusCheck" {
-		return res, errors.New("wsInvalidSession: Non StatusCheck in unvalidated session")
+func wsMusicSelect(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsMusicSelectRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
 	}
+	return nil, gs.SetPlaylist(req.Title)
+}
 
-	return wsMsg{
-		Message: "StatusCheckResponse",
-		Status:  "Unverified",
-	}, nil
+func wsMusicSkip(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	gs.Skip()
+	return nil, nil
 }
 
-func wsStatusCheck(ongoingSessions *SessionManager, id string, req wsMsg) (wsMsg, error) {
-	st, err := ongoingSessions.GetState(id)
+func wsVoteSkip(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	votes, needed, skipped, err := gs.VoteSkip(mem.UserID)
 	if err != nil {
-		return wsMsg{}, err
+		return nil, err
 	}
+	return wsVoteSkipResponse{wsSkipVotes: wsSkipVotes{Votes: votes, Needed: needed}, Skipped: skipped}, nil
+}
 
-	playing, playlist := st.Playing()
-	playlists := st.Playlists()
+func wsMusicPause(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	return nil, gs.Pause()
+}
 
-	return wsMsg{
-		Message:          "StatusCheckResponse",
-		Status:           "Verified",
-		Playlists:        playlists,
-		CurrentlyPlaying: playing,
-		CurrentPlaylist:  playlist,
-	}, nil
+func wsMusicResume(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	return nil, gs.Resume()
 }
 
-func wsMusicSelect(ongoingSessions *SessionManager, id string, req wsMsg) error {
-	/* XXX: Eventually return to show errors to user.
-	return wsMsg{
-		Message "MusicSelectionResponse",
+func wsSeek(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSeekRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
 	}
-	*/
+	return nil, gs.Seek(time.Duration(req.Position * float64(time.Second)))
+}
 
-	return ongoingSessions.SetPlaylist(id, req.Title)
+func wsSetVolume(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetVolumeRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	} else if req.Volume == nil {
+		return nil, wsBadRequest("no volume given")
+	}
+	return nil, gs.SetVolume(*req.Volume)
 }
 
-func wsMusicSkip(ongoingSessions *SessionManager, id string, req wsMsg) error {
-	/* XXX: Eventually return to show errors to user.
-	return wsMsg{
-		Message "MusicSelectionResponse",
+func wsSetNormalize(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetNormalizeRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	} else if req.Normalize == nil {
+		return nil, wsBadRequest("normalize not given")
 	}
-	*/
+	gs.SetNormalize(*req.Normalize)
+	return nil, nil
+}
 
-	gs, err := ongoingSessions.GetState(id)
+func wsSetShuffle(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetShuffleRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	} else if req.Shuffle == nil {
+		return nil, wsBadRequest("shuffle not given")
+	}
+	gs.SetShuffle(*req.Shuffle)
+	return nil, nil
+}
+
+func wsSetLoop(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetLoopRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+	mode, err := ParseLoopMode(string(req.Loop))
 	if err != nil {
-		return err
+		return nil, wsBadRequest("%v", err)
 	}
+	gs.SetLoop(mode)
+	return nil, nil
+}
 
-	gs.Skip()
-	return nil
+func wsSetAmbience(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetAmbienceRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(req.Search) {
+	case "":
+		return nil, wsBadRequest("nothing to play")
+	case "off":
+		return nil, gs.StopAmbience()
+	}
+
+	_, err := gs.SetAmbience(req.Search, Requester{})
+	return nil, err
 }
 
-func readLoop(c *websocket.Conn, id string, ongoingSessions *SessionManager) {
-	// it would be more clever to not create my own simplistic RPC protocol.
-	// here and instead use a proper RPC over websocket.
-	// but lets be simple about it and just go for it.
+func wsSetAmbienceVolume(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetAmbienceVolumeRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	} else if req.Volume == nil {
+		return nil, wsBadRequest("no volume given")
+	}
+	return nil, gs.SetAmbienceVolume(*req.Volume)
+}
 
-	// TODO: Remove polling in favour of non polling approach.
+func wsPlayEffect(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsPlayEffectRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+	return nil, gs.PlayEffect(req.Name)
+}
 
-	// TODO: Limit the amount of loops here to prevent ddos without a ticker.
-	t := time.NewTicker(500 * time.Millisecond)
-	defer c.Close()
+func wsAddEffect(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsAddEffectRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	} else if req.URL == "" {
+		return nil, wsBadRequest("no url given")
+	}
+	return gs.AddEffect(req.Name, req.URL)
+}
 
-	for {
-		<-t.C
+func wsRemoveEffect(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsRemoveEffectRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+	return nil, gs.RemoveEffect(req.Name)
+}
+
+func wsSetDucking(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetDuckingRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	} else if req.Ducking == nil {
+		return nil, wsBadRequest("ducking not given")
+	}
+	gs.SetDucking(*req.Ducking)
+	return nil, nil
+}
+
+func wsSetScene(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSetSceneRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+	return gs.SetScene(req.Name, Requester{})
+}
+
+func wsSaveScene(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsSaveSceneRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+
+	sc := req.Scene
+	if sc == nil {
+		sc = gs.CurrentScene(req.Name)
+	}
+	if err := gs.SaveScene(sc); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+func wsDeleteScene(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsDeleteSceneRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+	return nil, gs.RemoveScene(req.Name)
+}
+
+func wsStartCombat(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	var req wsStartCombatRequest
+	if err := wsDecode(payload, &req); err != nil {
+		return nil, err
+	}
+
+	pl, err := gs.StartCombat(req.Title)
+	if err != nil {
+		return nil, err
+	}
+	return wsStartCombatResponse{Playlist: pl.Title}, nil
+}
+
+func wsEndCombat(gs *Session, mem Member, payload json.RawMessage) (interface{}, error) {
+	t, resumed, err := gs.EndCombat()
+	if err != nil {
+		return nil, err
+	}
 
-		messageType, r, err := c.NextReader()
+	res := wsEndCombatResponse{}
+	if resumed {
+		res.Resumed = &t
+	}
+	return res, nil
+}
+
+// wsHandler handles one type of request for a member, it's given the raw
+// payload to decode and returns the payload of the reply.
+type wsHandler struct {
+	handle func(gs *Session, mem Member, payload json.RawMessage) (interface{}, error)
+	// slow handlers run in their own goroutine, so they don't hold up the
+	// rest of the client's messages. Looking up tracks is slow, for one.
+	slow bool
+	// perm is what the client needs to be allowed to do, if anything.
+	perm Permission
+}
+
+var wsHandlers = map[string]wsHandler{
+	"StatusCheck":       {handle: wsStatusCheck},
+	"MusicSelect":       {handle: wsMusicSelect, perm: PermPlaylist},
+	"MusicSkip":         {handle: wsMusicSkip, perm: PermSkip},
+	"VoteSkip":          {handle: wsVoteSkip},
+	"MusicPause":        {handle: wsMusicPause, perm: PermStop},
+	"MusicResume":       {handle: wsMusicResume, perm: PermStop},
+	"Seek":              {handle: wsSeek, perm: PermPlaylist},
+	"SetVolume":         {handle: wsSetVolume, perm: PermPlaylist},
+	"SetNormalize":      {handle: wsSetNormalize, perm: PermPlaylist},
+	"SetShuffle":        {handle: wsSetShuffle, perm: PermPlaylist},
+	"SetLoop":           {handle: wsSetLoop, perm: PermPlaylist},
+	"SetAmbience":       {handle: wsSetAmbience, slow: true, perm: PermScene},
+	"SetAmbienceVolume": {handle: wsSetAmbienceVolume, perm: PermScene},
+	"SetScene":          {handle: wsSetScene, slow: true, perm: PermScene},
+	"SaveScene":         {handle: wsSaveScene, perm: PermScene},
+	"DeleteScene":       {handle: wsDeleteScene, perm: PermScene},
+	"StartCombat":       {handle: wsStartCombat, perm: PermScene},
+	"EndCombat":         {handle: wsEndCombat, perm: PermScene},
+	"PlayEffect":        {handle: wsPlayEffect, perm: PermSoundboard},
+	"AddEffect":         {handle: wsAddEffect, slow: true, perm: PermSoundboard},
+	"RemoveEffect":      {handle: wsRemoveEffect, perm: PermSoundboard},
+	"SetDucking":        {handle: wsSetDucking, perm: PermSoundboard},
+}
+
+// The web ui can send a burst of wsBurst messages, after that it's slowed
+// down to wsRate a second.
+const (
+	wsRate  = 10
+	wsBurst = 20
+
+	// wsWriteTimeout is how long we wait on a client to take a message.
+	wsWriteTimeout = 10 * time.Second
+
+	// wsFollowInterval is how often an idle connection looks for a new
+	// session to follow.
+	wsFollowInterval = 2 * time.Second
+)
+
+// wsLimiter is a token bucket, limiting how fast a client's messages are
+// read.
+type wsLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func newWsLimiter() *wsLimiter {
+	return &wsLimiter{tokens: wsBurst, last: time.Now()}
+}
+
+// wait blocks until the next message can be read.
+func (l *wsLimiter) wait() {
+	now := time.Now()
+	l.tokens = math.Min(wsBurst, l.tokens+now.Sub(l.last).Seconds()*wsRate)
+	l.last = now
+
+	if l.tokens < 1 {
+		time.Sleep(time.Duration((1 - l.tokens) / wsRate * float64(time.Second)))
+		l.tokens, l.last = 1, time.Now()
+	}
+	l.tokens--
+}
+
+// writeLoop is the only thing that writes to a connection. It sends replies
+// from out and, once the client has a session, pushes its events as they
+// happen, starting with a snapshot of everything. The session is looked up
+// again before anything is sent and every wsFollowInterval, so clients that
+// connect before ;create, or stay connected through a new one, follow
+// whichever session is current, and clients that have been locked out are
+// hung up on.
+//
+// writeLoop returns once stop is closed, closing done if it has to give up
+// on the client first.
+func writeLoop(c *websocket.Conn, v int, session func() (*Session, Member, error), out <-chan wsMessage, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	write := func(msg wsMessage) bool {
+		data, err := wsEncode(v, msg)
 		if err != nil {
-			log.Printf("readLoop: read error: %v", err)
-			c.Close()
-			return
+			log.Printf("writeLoop: encode %s: %v", msg.Type, err)
+			return true
+		} else if data == nil {
+			return true
 		}
 
-		if messageType != websocket.TextMessage {
-			log.Println("readLoop: bad message type")
+		c.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := c.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Printf("writeLoop: write: %v", err)
 			c.Close()
-			return
+			return false
 		}
+		return true
+	}
 
-		var req wsMsg
-		d := json.NewDecoder(r)
-
-		if err = d.Decode(&req); err != nil {
-			log.Printf("readLoop: Decode: %v", err)
+	var (
+		st    *Session
+		sub   *Subscription
+		ready <-chan struct{}
+	)
+	defer func() {
+		if sub != nil {
+			sub.Close()
+		}
+	}()
+
+	// follow moves the subscription over to the client's current session,
+	// dropping it if they no longer have one.
+	follow := func() bool {
+		gs, _, err := session()
+		if wsLockedOut(err) {
+			log.Printf("writeLoop: %v", err)
+			write(wsMessage{Type: wsErrorType, Payload: toWsError(err)})
 			c.Close()
-			return
+			return false
+		} else if err != nil {
+			gs = nil
+		}
+		if gs == st {
+			return true
 		}
 
-		// The state of Validate will change when the discord bot is correctly
-		// validated. Shared state: a reliable system indeed!
+		if sub != nil {
+			sub.Close()
+			sub, ready = nil, nil
+		}
+		if st = gs; st == nil {
+			return true
+		}
 
-		var res wsMsg
+		// Subscribe before the snapshot is taken, so no change is missed.
+		sub = st.Subscribe()
+		ready = sub.Ready()
+		return write(wsMessage{Type: "Snapshot", Payload: wsSnapshot(st)})
+	}
 
-		switch {
-		case req.Message == "StatusCheck":
-			res, err = wsStatusCheck(ongoingSessions, id, req)
-			if err != nil {
-				log.Printf("readLoop: StatusCheck: %v", err)
-				c.Close()
+	if !follow() {
+		return
+	}
+
+	check := time.NewTicker(wsFollowInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case msg := <-out:
+			if !follow() || !write(msg) {
 				return
 			}
-		case req.Message == "MusicSelect":
-			err = wsMusicSelect(ongoingSessions, id, req)
-			if err != nil {
-				log.Printf("readLoop: MusicSelect: %v", err)
-				c.Close()
+		case <-check.C:
+			if !follow() {
 				return
 			}
-			continue
-		case req.Message == "MusicSkip":
-			err = wsMusicSkip(ongoingSessions, id, req)
-			if err != nil {
-				log.Printf("readLoop: MusicSkip: %v", err)
-				c.Close()
+		case <-ready:
+			if !follow() {
 				return
+			} else if sub == nil {
+				continue
+			}
+			for _, e := range sub.Events() {
+				if !write(wsEvent(st, e)) {
+					return
+				}
 			}
-			continue
 		}
+	}
+}
+
+// wsLockedOut is whether an error from looking up a client's session means
+// they shouldn't be connected at all.
+func wsLockedOut(err error) bool {
+	return errors.Is(err, ErrNotGuildMember) || errors.Is(err, ErrLoginExpired)
+}
+
+// wsRequest reads the next request off a connection. Version 0 requests are
+// flat, so the whole message is the payload.
+func wsRequest(v int, data []byte) (wsEnvelope, error) {
+	var req wsEnvelope
+	if v < 1 {
+		var legacy struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return req, wsBadRequest("bad message: %v", err)
+		}
+		return wsEnvelope{Type: legacy.Message, Payload: data}, nil
+	}
 
-		w, err := c.NextWriter(websocket.TextMessage)
+	if err := json.Unmarshal(data, &req); err != nil {
+		return req, wsBadRequest("bad message: %v", err)
+	} else if req.V != v {
+		return req, wsBadRequest("expected version %d, not %d", v, req.V)
+	}
+	return req, nil
+}
+
+// readLoop handles the requests of a client. session looks up the session
+// the client is logged in to and who they are, it's called for every request
+// so clients that are no longer allowed in are stopped.
+func readLoop(c *websocket.Conn, v int, session func() (*Session, Member, error), out chan<- wsMessage, writerDone <-chan struct{}) {
+	limit := newWsLimiter()
+
+	reply := func(msg wsMessage) {
+		select {
+		case out <- msg:
+		case <-writerDone:
+		}
+	}
+	replyErr := func(req wsEnvelope, err error) {
+		log.Printf("readLoop: %s: %v", req.Type, err)
+		reply(wsMessage{ID: req.ID, Type: wsErrorType, Payload: toWsError(err), reply: true})
+	}
+
+	for {
+		limit.wait()
+
+		messageType, data, err := c.ReadMessage()
 		if err != nil {
-			log.Printf("readLoop: NextWriter: %v", err)
-			c.Close()
+			log.Printf("readLoop: read error: %v", err)
 			return
 		}
 
-		e := json.NewEncoder(w)
-		if err = e.Encode(res); err != nil {
-			log.Printf("readLoop: Encode: %v", err)
-			c.Close()
+		if messageType != websocket.TextMessage {
+			replyErr(wsEnvelope{}, wsBadRequest("expected a text message"))
+			continue
+		}
+
+		req, err := wsRequest(v, data)
+		if err != nil {
+			replyErr(req, err)
+			continue
+		}
+
+		h, ok := wsHandlers[req.Type]
+		if !ok {
+			replyErr(req, &wsError{Code: wsErrUnknownType, Message: fmt.Sprintf("unknown message type %#v", req.Type)})
+			continue
+		}
+
+		gs, mem, err := session()
+		if wsLockedOut(err) {
+			replyErr(req, err)
 			return
+		} else if err != nil {
+			if v < 1 {
+				res, err := wsInvalidSession(req.Type)
+				if err != nil {
+					replyErr(req, err)
+					continue
+				}
+				reply(wsMessage{ID: req.ID, Type: req.Type, Payload: res, reply: true})
+				continue
+			}
+			replyErr(req, err)
+			continue
+		}
+
+		if h.perm != "" {
+			if err := gs.Allowed(mem, h.perm); err != nil {
+				replyErr(req, err)
+				continue
+			}
 		}
 
+		handle := func(req wsEnvelope) {
+			res, err := h.handle(gs, mem, req.Payload)
+			if err != nil {
+				replyErr(req, err)
+				return
+			}
+			reply(wsMessage{ID: req.ID, Type: req.Type, Payload: res, reply: true})
+		}
+		if h.slow {
+			go handle(req)
+			continue
+		}
+		handle(req)
 	}
 }
 
-func websocketHandler(ongoingSessions *SessionManager) func(w http.ResponseWriter, r *http.Request) {
+func websocketHandler(ongoingSessions *SessionManager, auth *Auth) func(w http.ResponseWriter, r *http.Request) {
+	// Clients are let in by their cookie, so the upgrader's default check
+	// that they come from our own site is what stops other sites from
+	// connecting on their behalf.
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true }, // XXX DEBUG
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		q := r.URL.Query()
-		param, ok := q["s"]
-		if !ok || len(param) != 1 || param[0] == "" {
-			writeError("/ws", w, r, fmt.Errorf("no session id:"), 500)
-			return
-		}
 
-		id := param[0]
+		v := 0
+		if s := q.Get("v"); s != "" {
+			var err error
+			if v, err = strconv.Atoi(s); err != nil || v < 0 || v > wsVersion {
+				writeError("/ws", w, r, fmt.Errorf("unsupported protocol version %#v, the latest is %d", s, wsVersion), http.StatusBadRequest)
+				return
+			}
+		}
 
 		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -211,11 +632,89 @@ func websocketHandler(ongoingSessions *SessionManager) func(w http.ResponseWrite
 			return
 		}
 
-		readLoop(conn, id, ongoingSessions)
+		// Clients that aren't logged in can still poll, they'll find out
+		// they aren't from StatusCheck.
+		u, expires, userErr := auth.login(r)
+		session := func() (*Session, Member, error) {
+			if userErr != nil {
+				return nil, Member{}, userErr
+			}
+			if time.Now().After(expires) {
+				return nil, Member{}, ErrLoginExpired
+			}
+			return auth.Session(u, ongoingSessions)
+		}
+
+		out := make(chan wsMessage)
+		stop, writerDone := make(chan struct{}), make(chan struct{})
+		go writeLoop(conn, v, session, out, stop, writerDone)
+
+		readLoop(conn, v, session, out, writerDone)
+
+		// Let the writer finish what it's sending, it might be why we're
+		// hanging up.
+		close(stop)
+		<-writerDone
+		conn.Close()
+	}
+}
+
+// effectUploadHandler adds a sound effect from a file uploaded as a
+// multipart form, with the effect's name and the file itself.
+func effectUploadHandler(ongoingSessions *SessionManager, auth *Auth) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError("/effects", w, r, fmt.Errorf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+
+		u, err := auth.User(r)
+		if err != nil {
+			writeError("/effects", w, r, err, http.StatusUnauthorized)
+			return
+		}
+		gs, mem, err := auth.Session(u, ongoingSessions)
+		if err == nil {
+			err = gs.Allowed(mem, PermSoundboard)
+		}
+		if err != nil {
+			writeError("/effects", w, r, err, http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxEffectUpload+1<<20)
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			writeError("/effects", w, r, err, http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		f, header, err := r.FormFile("file")
+		if err != nil {
+			writeError("/effects", w, r, err, http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+
+		if header.Size > maxEffectUpload {
+			writeError("/effects", w, r, fmt.Errorf("%s is too big, sound effects can be up to %s",
+				header.Filename, formatBytes(maxEffectUpload)), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		e, err := gs.UploadEffect(r.FormValue("name"), header.Filename, f)
+		if err != nil {
+			writeError("/effects", w, r, err, http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(e)
 	}
 }
 
-func handlerInit(ongoingSessions *SessionManager) {
+func handlerInit(ongoingSessions *SessionManager, auth *Auth) {
 	frontendPath := path.Join(runningDir, "frontend/build")
 	index := path.Join(frontendPath, "index.html")
 	_, err := os.Stat(index)
@@ -228,7 +727,9 @@ func handlerInit(ongoingSessions *SessionManager) {
 
 	staticHandler := http.FileServer(http.Dir(frontendPath))
 
-	http.HandleFunc("/ws", websocketHandler(ongoingSessions))
+	http.HandleFunc("/login", auth.loginHandler())
+	http.HandleFunc("/ws", websocketHandler(ongoingSessions, auth))
+	http.HandleFunc("/effects", effectUploadHandler(ongoingSessions, auth))
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// TODO: Should probably use something cached.
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// testWeb serves the web ui of some sessions.
+type testWeb struct {
+	*httptest.Server
+	auth *Auth
+
+	sync.Mutex
+	// members is who's in which guild.
+	members map[WebUser]*Member
+}
+
+func newTestWeb(t *testing.T, sessions *SessionManager) *testWeb {
+	t.Helper()
+
+	web := &testWeb{members: map[WebUser]*Member{}}
+	web.auth = NewAuth(make([]byte, 64), false, func(guildID, userID string) (*Member, error) {
+		web.Lock()
+		defer web.Unlock()
+		return web.members[WebUser{GuildID: guildID, UserID: userID}], nil
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", web.auth.loginHandler())
+	mux.HandleFunc("/ws", websocketHandler(sessions, web.auth))
+	web.Server = httptest.NewServer(mux)
+	t.Cleanup(web.Close)
+	return web
+}
+
+// setMember adds someone to a guild, or removes them if member is nil,
+// skipping the cache of who is in which guild.
+func (web *testWeb) setMember(u WebUser, member *Member) {
+	web.Lock()
+	web.members[u] = member
+	web.Unlock()
+
+	web.auth.Lock()
+	delete(web.auth.members, u)
+	web.auth.Unlock()
+}
+
+// login follows a login link, it returns the cookies it was swapped for.
+func (web *testWeb) login(t *testing.T, token string) (http.CookieJar, *http.Response) {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(web.URL + "/login?t=" + url.QueryEscape(token))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return jar, res
+}
+
+// dial connects to the websocket handler with the given cookies.
+func (web *testWeb) dial(t *testing.T, jar http.CookieJar, query string) *websocket.Conn {
+	t.Helper()
+
+	dialer := &websocket.Dialer{Jar: jar}
+	c, _, err := dialer.Dial("ws"+strings.TrimPrefix(web.URL, "http")+"/ws?"+query, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// dialWs logs a member of the test guild in and connects.
+func dialWs(t *testing.T, sessions *SessionManager, query string) *websocket.Conn {
+	t.Helper()
+
+	web := newTestWeb(t, sessions)
+	web.setMember(WebUser{GuildID: "guild", UserID: "user"}, &Member{UserID: "user"})
+	jar, _ := web.login(t, web.auth.Token("guild", "user"))
+	return web.dial(t, jar, query)
+}
+
+// readEnvelope reads messages until one of the given type turns up.
+func readEnvelope(t *testing.T, c *websocket.Conn, typ string) wsEnvelope {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var env wsEnvelope
+		if err := c.ReadJSON(&env); err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if env.Type == typ {
+			return env
+		}
+	}
+}
+
+func testSessions() *SessionManager {
+	sessions := &SessionManager{}
+	gs := newSession("guild", "session", nil)
+	sessions.sessions.Store("session", gs)
+	sessions.guildLookup.Store("guild", "session")
+	return sessions
+}
+
+func TestWebsocketProtocol(t *testing.T) {
+	c := dialWs(t, testSessions(), "v=1")
+
+	snapshot := readEnvelope(t, c, "Snapshot")
+	var status wsStatus
+	if err := json.Unmarshal(snapshot.Payload, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != "Verified" || status.Volume == nil || *status.Volume != defaultVolume {
+		t.Errorf("snapshot = %+v, want a verified session at the default volume", status)
+	}
+
+	// Unknown types and bad payloads are answered with errors, the
+	// connection stays up.
+	for _, tc := range []struct {
+		req  string
+		code string
+	}{
+		{`{"v":1,"id":"1","type":"Dance"}`, wsErrUnknownType},
+		{`{"v":1,"id":"2","type":"SetVolume","payload":{"volume":"loud"}}`, wsErrBadRequest},
+		{`{"v":1,"id":"3","type":"SetVolume","payload":{}}`, wsErrBadRequest},
+		{`{"v":1,"id":"4","type":"SetScene","payload":{"name":"nowhere"}}`, wsErrNotFound},
+		{`not json`, wsErrBadRequest},
+	} {
+		if err := c.WriteMessage(websocket.TextMessage, []byte(tc.req)); err != nil {
+			t.Fatal(err)
+		}
+
+		env := readEnvelope(t, c, wsErrorType)
+		var got wsError
+		if err := json.Unmarshal(env.Payload, &got); err != nil {
+			t.Fatal(err)
+		}
+		var req wsEnvelope
+		json.Unmarshal([]byte(tc.req), &req)
+		if got.Code != tc.code || env.ID != req.ID {
+			t.Errorf("%s: got error %+v for request %#v, want code %s for %#v", tc.req, got, env.ID, tc.code, req.ID)
+		}
+	}
+
+	if err := c.WriteJSON(wsEnvelope{V: 1, ID: "5", Type: "SetVolume", Payload: json.RawMessage(`{"volume":50}`)}); err != nil {
+		t.Fatal(err)
+	}
+	// The reply and the event it causes can come in either order.
+	got := map[string]wsEnvelope{}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for got["SetVolume"].Type == "" || got["SettingsChanged"].Type == "" {
+		var env wsEnvelope
+		if err := c.ReadJSON(&env); err != nil {
+			t.Fatalf("waiting for SetVolume and SettingsChanged: %v", err)
+		}
+		got[env.Type] = env
+	}
+	if id := got["SetVolume"].ID; id != "5" {
+		t.Errorf("SetVolume reply has id %#v, want 5", id)
+	}
+	var settings wsSettings
+	if err := json.Unmarshal(got["SettingsChanged"].Payload, &settings); err != nil {
+		t.Fatal(err)
+	}
+	if settings.Volume == nil || *settings.Volume != 50 {
+		t.Errorf("SettingsChanged after SetVolume = %+v, want volume 50", settings)
+	}
+}
+
+func TestWebsocketFollowsSession(t *testing.T) {
+	// Connect before there's a session to follow.
+	sessions := &SessionManager{}
+	c := dialWs(t, sessions, "v=1")
+
+	volume := func(env wsEnvelope) int {
+		t.Helper()
+		var settings wsSettings
+		if err := json.Unmarshal(env.Payload, &settings); err != nil {
+			t.Fatal(err)
+		}
+		if settings.Volume == nil {
+			t.Fatalf("%s has no volume", env.Type)
+		}
+		return *settings.Volume
+	}
+
+	for i, id := range []string{"first", "second"} {
+		gs := newSession("guild", id, nil)
+		sessions.sessions.Store(id, gs)
+		sessions.guildLookup.Store("guild", id)
+
+		// The next request picks the new session up.
+		c.WriteJSON(wsEnvelope{V: 1, ID: id, Type: "StatusCheck"})
+		readEnvelope(t, c, "Snapshot")
+
+		gs.SetVolume(10 + i)
+		if got := volume(readEnvelope(t, c, "SettingsChanged")); got != 10+i {
+			t.Errorf("%s session: pushed volume %d, want %d", id, got, 10+i)
+		}
+	}
+
+	// The session that was replaced isn't followed any more.
+	old, _ := sessions.sessions.Load("first")
+	old.(*Session).SetVolume(30)
+	gs, _ := sessions.FromGuild("guild")
+	gs.SetVolume(40)
+	if got := volume(readEnvelope(t, c, "SettingsChanged")); got != 40 {
+		t.Errorf("pushed volume %d after the session was replaced, want 40", got)
+	}
+}
+
+func TestWebsocketVersion0(t *testing.T) {
+	c := dialWs(t, testSessions(), "")
+
+	// Polling still works, and bad requests are ignored.
+	c.WriteMessage(websocket.TextMessage, []byte(`{"message":"Dance"}`))
+	c.WriteMessage(websocket.TextMessage, []byte(`{"message":"StatusCheck"}`))
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 2; i++ {
+		var msg map[string]interface{}
+		if err := c.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["message"] != "StatusCheckResponse" || msg["status"] != "Verified" {
+			t.Errorf("message %d = %v, want a StatusCheckResponse", i, msg)
+		}
+	}
+
+	// Clients that aren't logged in are told so.
+	c = newTestWeb(t, testSessions()).dial(t, nil, "")
+	c.WriteMessage(websocket.TextMessage, []byte(`{"message":"StatusCheck"}`))
+	var msg map[string]interface{}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := c.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["status"] != "Unverified" {
+		t.Errorf("StatusCheck for a missing session = %v, want Unverified", msg)
+	}
+}
+
+func TestWebsocketPermissions(t *testing.T) {
+	sessions := testSessions()
+	gs, _ := sessions.FromGuild("guild")
+	gs.SetDJRole("djs")
+
+	web := newTestWeb(t, sessions)
+	player, dj := WebUser{GuildID: "guild", UserID: "player"}, WebUser{GuildID: "guild", UserID: "dj"}
+	web.setMember(player, &Member{UserID: "player"})
+	web.setMember(dj, &Member{UserID: "dj", Roles: []string{"djs"}})
+
+	playerJar, _ := web.login(t, web.auth.Token("guild", "player"))
+	djJar, _ := web.login(t, web.auth.Token("guild", "dj"))
+
+	c := web.dial(t, playerJar, "v=1")
+	shuffle := json.RawMessage(`{"shuffle":true}`)
+	c.WriteJSON(wsEnvelope{V: 1, ID: "1", Type: "SetShuffle", Payload: shuffle})
+	var wsErr wsError
+	if err := json.Unmarshal(readEnvelope(t, c, wsErrorType).Payload, &wsErr); err != nil {
+		t.Fatal(err)
+	}
+	if wsErr.Code != wsErrForbidden || wsErr.Message != ErrNeedDJ.Error() {
+		t.Errorf("SetShuffle without the DJ role: got %+v, want %s: %v", wsErr, wsErrForbidden, ErrNeedDJ)
+	}
+
+	// How the music sounds is as restricted as what plays.
+	for i, tc := range []struct {
+		typ     string
+		payload string
+	}{
+		{"Seek", `{"position":60}`},
+		{"SetVolume", `{"volume":0}`},
+		{"SetNormalize", `{"normalize":false}`},
+	} {
+		c.WriteJSON(wsEnvelope{V: 1, ID: fmt.Sprint("restricted-", i), Type: tc.typ, Payload: json.RawMessage(tc.payload)})
+		var wsErr wsError
+		if err := json.Unmarshal(readEnvelope(t, c, wsErrorType).Payload, &wsErr); err != nil {
+			t.Fatal(err)
+		}
+		if wsErr.Code != wsErrForbidden {
+			t.Errorf("%s without the DJ role: got %+v, want %s", tc.typ, wsErr, wsErrForbidden)
+		}
+	}
+	if gs.Volume() != defaultVolume {
+		t.Errorf("volume is %d after a refused SetVolume, want %d", gs.Volume(), defaultVolume)
+	}
+
+	// Everyone can still do what isn't restricted.
+	c.WriteJSON(wsEnvelope{V: 1, ID: "2", Type: "StatusCheck"})
+	readEnvelope(t, c, "StatusCheck")
+
+	c = web.dial(t, djJar, "v=1")
+	c.WriteJSON(wsEnvelope{V: 1, ID: "3", Type: "SetShuffle", Payload: shuffle})
+	if env := readEnvelope(t, c, "SetShuffle"); env.ID != "3" {
+		t.Errorf("SetShuffle reply has id %#v, want 3", env.ID)
+	}
+	if !gs.Shuffle() {
+		t.Error("shuffle is off after a DJ turned it on")
+	}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// wsVersion is the version of the websocket protocol, clients ask for it
+// with ?v= when they connect.
+//
+// Version 1 wraps every message in a wsEnvelope, with a payload of its own
+// type. Clients that don't ask for a version get the flat messages of
+// version 0, which only replies to StatusCheck and never sends errors.
+const wsVersion = 1
+
+// wsEnvelope wraps every message of version 1. Replies echo the ID of the
+// request they answer, events pushed by the server have none.
+type wsEnvelope struct {
+	V       int             `json:"v"`
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// wsMessage is a message on its way out, before it's encoded for the
+// version the client speaks.
+type wsMessage struct {
+	ID      string
+	Type    string
+	Payload interface{}
+	// reply is set for replies to a request, rather than events.
+	reply bool
+}
+
+// wsErrorType is the type of error replies, and of errors during playback.
+const wsErrorType = "Error"
+
+// Error codes, so clients can tell errors apart without parsing messages.
+const (
+	wsErrBadRequest  = "bad_request"
+	wsErrUnknownType = "unknown_type"
+	wsErrNotFound    = "not_found"
+	wsErrForbidden   = "forbidden"
+	wsErrFailed      = "failed"
+)
+
+// wsError is the payload of an error.
+type wsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *wsError) Error() string {
+	return e.Message
+}
+
+func wsBadRequest(format string, a ...interface{}) error {
+	return &wsError{Code: wsErrBadRequest, Message: fmt.Sprintf(format, a...)}
+}
+
+// toWsError works out the code of an error.
+func toWsError(err error) *wsError {
+	var wsErr *wsError
+	if errors.As(err, &wsErr) {
+		return wsErr
+	}
+
+	for _, forbidden := range []error{ErrNotLoggedIn, ErrLoginExpired, ErrNotGuildMember, ErrNeedDJ, ErrNeedDM} {
+		if errors.Is(err, forbidden) {
+			return &wsError{Code: wsErrForbidden, Message: err.Error()}
+		}
+	}
+
+	for _, notFound := range []error{
+		ErrSessionDoesNotExist,
+		ErrGuildPlaylistDoesNotExist,
+		ErrSceneDoesNotExist,
+		ErrEffectDoesNotExist,
+	} {
+		if errors.Is(err, notFound) {
+			return &wsError{Code: wsErrNotFound, Message: err.Error()}
+		}
+	}
+	return &wsError{Code: wsErrFailed, Message: err.Error()}
+}
+
+// wsDecode decodes the payload of a request, a missing payload is the same
+// as an empty one.
+func wsDecode(payload json.RawMessage, v interface{}) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return wsBadRequest("bad payload: %v", err)
+	}
+	return nil
+}
+
+// wsEncode encodes a message for the given version of the protocol. It
+// returns nil if the message isn't part of that version.
+func wsEncode(v int, msg wsMessage) ([]byte, error) {
+	if v >= 1 {
+		payload, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(wsEnvelope{V: wsVersion, ID: msg.ID, Type: msg.Type, Payload: payload})
+	}
+
+	// Version 0 messages are flat, with the type in "message". The only
+	// reply it had was to StatusCheck.
+	switch {
+	case msg.Type == "StatusCheck" || msg.Type == "Snapshot":
+		msg.Type = "StatusCheckResponse"
+	case msg.reply:
+		return nil, nil
+	case msg.Type == wsErrorType:
+		return json.Marshal(map[string]string{"message": wsErrorType, "error": msg.Payload.(*wsError).Message})
+	}
+
+	payload, err := json.Marshal(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	} else if fields == nil {
+		fields = map[string]json.RawMessage{}
+	}
+	fields["message"], _ = json.Marshal(msg.Type)
+	return json.Marshal(fields)
+}
+
+// wsStatus is everything the web ui shows. It's sent when a client connects,
+// and in reply to StatusCheck.
+type wsStatus struct {
+	Status    string      `json:"status,omitempty"`
+	Playlists []*Playlist `json:"playlists,omitempty"`
+	wsTrack
+	wsSettings
+	wsSkipVotes
+}
+
+// wsTrack is what's playing, it's the payload of TrackChanged and
+// QueueChanged.
+type wsTrack struct {
+	CurrentlyPlaying Track   `json:"playing,omitempty"`
+	CurrentPlaylist  []Track `json:"current_playlist,omitempty"`
+	Paused           bool    `json:"paused,omitempty"`
+	// Position is in seconds.
+	Position float64 `json:"position,omitempty"`
+}
+
+// wsPaused is the payload of Paused.
+type wsPaused struct {
+	Paused   bool    `json:"paused"`
+	Position float64 `json:"position"`
+}
+
+// wsPlaylists is the payload of PlaylistsChanged.
+type wsPlaylists struct {
+	Playlists []*Playlist `json:"playlists"`
+}
+
+// wsSkipVotes is the payload of SkipVotesChanged, it's how many listeners
+// have voted to skip the current track and how many have to.
+type wsSkipVotes struct {
+	Votes  int `json:"skip_votes"`
+	Needed int `json:"skip_votes_needed"`
+}
+
+// wsSettings is the payload of SettingsChanged.
+type wsSettings struct {
+	// Volumes are in percent.
+	Volume         *int     `json:"volume,omitempty"`
+	Normalize      *bool    `json:"normalize,omitempty"`
+	Shuffle        *bool    `json:"shuffle,omitempty"`
+	Loop           LoopMode `json:"loop,omitempty"`
+	Ambience       *Track   `json:"ambience,omitempty"`
+	AmbienceVolume *int     `json:"ambience_volume,omitempty"`
+
+	Effects []*Effect `json:"effects,omitempty"`
+	Ducking *bool     `json:"ducking,omitempty"`
+
+	Scenes []*Scene `json:"scenes,omitempty"`
+	// CurrentScene is the scene last switched to.
+	CurrentScene string `json:"scene,omitempty"`
+
+	Combat         bool   `json:"combat,omitempty"`
+	CombatPlaylist string `json:"combat_playlist,omitempty"`
+}
+
+// Request payloads, they're named after the message they go with. Their
+// fields are named the same as in version 0, so those messages can be
+// decoded as payloads.
+
+type wsMusicSelectRequest struct {
+	Title string `json:"title"`
+}
+
+type wsSeekRequest struct {
+	// Position is in seconds.
+	Position float64 `json:"position"`
+}
+
+type wsSetVolumeRequest struct {
+	Volume *int `json:"volume"`
+}
+
+type wsSetNormalizeRequest struct {
+	Normalize *bool `json:"normalize"`
+}
+
+type wsSetShuffleRequest struct {
+	Shuffle *bool `json:"shuffle"`
+}
+
+type wsSetLoopRequest struct {
+	Loop LoopMode `json:"loop"`
+}
+
+type wsSetAmbienceRequest struct {
+	// Search is a playlist title, url or search, or "off".
+	Search string `json:"search"`
+}
+
+type wsSetAmbienceVolumeRequest struct {
+	Volume *int `json:"volume"`
+}
+
+type wsPlayEffectRequest struct {
+	Name string `json:"name"`
+}
+
+type wsAddEffectRequest struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type wsRemoveEffectRequest struct {
+	Name string `json:"name"`
+}
+
+type wsSetDuckingRequest struct {
+	Ducking *bool `json:"ducking"`
+}
+
+type wsSetSceneRequest struct {
+	Name string `json:"name"`
+}
+
+type wsSaveSceneRequest struct {
+	Name string `json:"name"`
+	// Scene is saved if given, otherwise it's what's playing now.
+	Scene *Scene `json:"new_scene,omitempty"`
+}
+
+type wsDeleteSceneRequest struct {
+	Name string `json:"name"`
+}
+
+type wsStartCombatRequest struct {
+	// Title is the combat playlist, empty for the usual one.
+	Title string `json:"title"`
+}
+
+// wsVoteSkipResponse is where the vote stands, Skipped is set if it skipped
+// the track.
+type wsVoteSkipResponse struct {
+	wsSkipVotes
+	Skipped bool `json:"skipped"`
+}
+
+// wsStartCombatResponse is the playlist combat started with.
+type wsStartCombatResponse struct {
+	Playlist string `json:"playlist"`
+}
+
+// wsEndCombatResponse is the track we went back to, if there was one.
+type wsEndCombatResponse struct {
+	Resumed *Track `json:"resumed,omitempty"`
+}
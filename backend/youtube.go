@@ -36,29 +36,18 @@ func sharedArgs() []string {
 	}
 }
 
-func infoArgs() []string {
+// infoArgs asks youtube-dl to describe search. search comes from users, "--"
+// stops it being read as an option.
+func infoArgs(search string) []string {
 	shared := sharedArgs()
-	return append(shared, "-j")
+	return append(shared, "-j", "--", search)
 }
 
-// CMD builds a youtube-dl download command for the given track
-func (t Track) CMD() *exec.Cmd {
-	/*
-		// Here re-encode with ffmpeg which is faster using raw in between
-		// TODO: replace ffmpeg args here with contants
-		// TODO: test out "-movflags +faststart"
-		args := []string{
-			"-o", "-", // to stdout (for ffmpeg)
-			// "--exec", "ffmpeg -i - -vn -sample_fmt s16 -acodec libopus -ar 48000 -ac 2",
-			"--exec", "ffmpeg -vn -c:a libopus -b:a 48K -ac 2",
-		}
-		args = append(args, sharedArgs()...)
-		args = append(args, t.URL)
-		return exec.Command("youtube-dl", args...)
-	*/
-	// XXX: build command in GoLang.
-	// Overhead of a shell is OK tbh.
-	return exec.Command("bash", workingDir+"/download.sh", t.URL)
+// extractArgs is the youtube-dl command that writes the audio of url to
+// stdout. Like infoArgs, url is never read as an option.
+func extractArgs(url string) []string {
+	extract := append([]string{youtubeDLPath}, sharedArgs()...)
+	return append(extract, "-o", "-", "--", url)
 }
 
 func runCmd(cmd *exec.Cmd) ([]byte, error) {
@@ -81,9 +70,11 @@ type youtubeDLResp struct {
 	Formats []struct {
 		URL string `json:"url"`
 	} `json:"formats"`
-	URL      string `json:"url"`
-	Title    string `json:"title"`
-	Uploader string `json:"uploader"`
+	URL string `json:"url"`
+	// WebpageURL doesn't expire like URL does, so it's what we keep.
+	WebpageURL string `json:"webpage_url"`
+	Title      string `json:"title"`
+	Uploader   string `json:"uploader"`
 }
 
 func parseTrack(o []byte) (Track, error) {
@@ -95,19 +86,21 @@ func parseTrack(o []byte) (Track, error) {
 	if len(resp.Formats) == 0 {
 		return Track{}, fmt.Errorf("download format not available")
 	}
-	return Track{Uploader: resp.Uploader, Name: resp.Title, URL: resp.URL}, nil
+	url := resp.WebpageURL
+	if url == "" {
+		url = resp.URL
+	}
+	return Track{Uploader: resp.Uploader, Name: resp.Title, URL: url}, nil
 }
 
-// DLInfo takes a search string (or any yt-dl argument) and converts it
-// to a downloadable track.
+// DLInfo takes a search string (or any url yt-dl understands) and converts
+// it to a downloadable track.
 //
 // TODO: Add the ability to handle a playlist, ie return a []Track{} if
 // given a playlist.  Ideally for this we could identify what yt-dl is doing
 // with the given argument.
 func (adm *AudioDownloadManager) DLInfo(search string) (Track, error) {
-	args := infoArgs()
-	args = append(args, search)
-	cmd := exec.Command("/usr/local/bin/youtube-dl", args...)
+	cmd := exec.Command(youtubeDLPath, infoArgs(search)...)
 
 	out, err := runCmd(cmd)
 	if err != nil {
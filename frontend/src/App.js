@@ -4,10 +4,52 @@ import './App.css';
 import InvalidSession from './InvalidSession.js';
 import ValidSession from './ValidSession.js';
 
-const urlParams = new URLSearchParams(window.location.search);
-const session = urlParams.get('s');
+// We're let in by the cookie the login link from ;ui left behind.
+const socket = new WebSocket("wss://" + window.location.host +"/ws?v=1");
 
-const socket = new WebSocket("wss://" + window.location.host +"/ws?s=" + session);
+// nextID numbers our requests, replies come back with the same id.
+let nextID = 1;
+
+// send sends a request of the given type to the server.
+function send(type, payload) {
+  const msg = { 'v': 1, 'id': String(nextID++), 'type': type, 'payload': payload };
+  const toSend = JSON.stringify(msg);
+  socket.send(toSend);
+}
+
+// trackState picks what's playing out of a message.
+function trackState(msg) {
+  return {
+    playing: 'playing' in msg ? msg.playing : "",
+    current_playlist: 'current_playlist' in msg ? msg.current_playlist : [],
+    paused: !!msg.paused,
+  };
+}
+
+// settingsState picks the session's settings out of a message.
+function settingsState(msg) {
+  return {
+    volume: 'volume' in msg ? msg.volume : 100,
+    shuffle: !!msg.shuffle,
+    loop: 'loop' in msg ? msg.loop : "auto",
+    ambience: 'ambience' in msg ? msg.ambience : null,
+    ambience_volume: 'ambience_volume' in msg ? msg.ambience_volume : 50,
+    effects: 'effects' in msg ? msg.effects : [],
+    ducking: !!msg.ducking,
+    scenes: 'scenes' in msg ? msg.scenes : [],
+    scene: 'scene' in msg ? msg.scene : "",
+    combat: !!msg.combat,
+    combat_playlist: 'combat_playlist' in msg ? msg.combat_playlist : "",
+  };
+}
+
+// skipVotesState picks how the vote to skip is going out of a message.
+function skipVotesState(msg) {
+  return {
+    skip_votes: msg.skip_votes || 0,
+    skip_votes_needed: msg.skip_votes_needed || 0,
+  };
+}
 
 class App extends React.Component {
   constructor(props) {
@@ -15,6 +57,7 @@ class App extends React.Component {
     this.state = {
       validated: false,
       playlists: null,
+      error: "",
     }
   }
 
@@ -30,33 +73,51 @@ class App extends React.Component {
       const msg = JSON.parse(ev.data);
       console.log("ws: message: ", msg);
 
-      if (msg.message === "StatusCheckResponse") {
-        console.log("ws: StatusCheckResponse"); // XXX: DEBUG
-
-        const playing = 'playing' in msg ? msg.playing : "";
-        const cplaylist = 'current_playlist' in msg ? msg.current_playlist : [];
-
-        this.setState({
-          validated: true,
-          playlists: msg.playlists,
-          playing: playing,
-          current_playlist: cplaylist,
-        });
+      // The server sends a snapshot of everything once we connect, then
+      // pushes whatever changes as it happens. Requests are answered with a
+      // reply of the same type, or an Error.
+      const payload = msg.payload || {};
+      switch (msg.type) {
+        case "Snapshot":
+        case "StatusCheck":
+          this.setState({
+            validated: payload.status === "Verified",
+            playlists: 'playlists' in payload ? payload.playlists : [],
+            ...trackState(payload),
+            ...settingsState(payload),
+            ...skipVotesState(payload),
+          });
+          break;
+        case "TrackChanged":
+        case "QueueChanged":
+          this.setState(trackState(payload));
+          break;
+        case "Paused":
+          this.setState({ paused: !!payload.paused });
+          break;
+        case "PlaylistsChanged":
+          this.setState({ playlists: 'playlists' in payload ? payload.playlists : [] });
+          break;
+        case "SettingsChanged":
+          this.setState(settingsState(payload));
+          break;
+        case "SkipVotesChanged":
+        case "VoteSkip":
+          this.setState(skipVotesState(payload));
+          break;
+        case "Error":
+          console.log("ws: error: ", msg.id, payload.code, payload.message);
+          this.setState({ error: payload.message });
+          break;
+        default:
+          break;
       }
-
     };
 
     // TODO: enable these to only show on debug.
     socket.onopen = (ev) => {
       // Normal
       console.log("ws: Opening.");
-
-      setInterval(() => {
-        const msg = { 'message': 'StatusCheck' };
-        const toSend = JSON.stringify(msg);
-        console.log(toSend);
-        socket.send(toSend);
-      }, 600);
     }
 
     socket.onclose = (ev) => {
@@ -80,20 +141,81 @@ class App extends React.Component {
   handlePlaylist(title) {
     console.log("PLAYLIST HANDLED ", title)
 
-    const msg = {
-      'message': 'MusicSelect',
-      'type': 'Playlist',
-      'title': title,
-    };
-
-    const toSend = JSON.stringify(msg);
-    socket.send(toSend);
+    send("MusicSelect", { 'title': title });
   }
 
   handleSkip() {
-    const msg = { 'message': 'MusicSkip' };
-    const toSend = JSON.stringify(msg);
-    socket.send(toSend);
+    send("MusicSkip");
+  }
+
+  handleVoteSkip() {
+    send("VoteSkip");
+  }
+
+  handlePause(paused) {
+    send(paused ? "MusicResume" : "MusicPause");
+  }
+
+  handleVolume(volume) {
+    send("SetVolume", { 'volume': volume });
+  }
+
+  handleAmbience(search) {
+    send("SetAmbience", { 'search': search });
+  }
+
+  handleAmbienceVolume(volume) {
+    send("SetAmbienceVolume", { 'volume': volume });
+  }
+
+  handleSetScene(name) {
+    send("SetScene", { 'name': name });
+  }
+
+  handleSaveScene(name) {
+    send("SaveScene", { 'name': name });
+  }
+
+  handleDeleteScene(name) {
+    send("DeleteScene", { 'name': name });
+  }
+
+  handleShuffle(shuffle) {
+    send("SetShuffle", { 'shuffle': shuffle });
+  }
+
+  handleLoop(loop) {
+    send("SetLoop", { 'loop': loop });
+  }
+
+  handleCombat(combat) {
+    send(combat ? "EndCombat" : "StartCombat");
+  }
+
+  handlePlayEffect(name) {
+    send("PlayEffect", { 'name': name });
+  }
+
+  handleAddEffect(name, url) {
+    send("AddEffect", { 'name': name, 'url': url });
+  }
+
+  handleUploadEffect(name, file) {
+    const form = new FormData();
+    form.append('name', name);
+    form.append('file', file);
+
+    return fetch("/effects", { method: 'POST', body: form })
+      .then((res) => {
+        if (!res.ok) {
+          return res.text().then((text) => { throw new Error(text); });
+        }
+        return res.json();
+      });
+  }
+
+  handleDucking(ducking) {
+    send("SetDucking", { 'ducking': ducking });
   }
 
   render() {
@@ -102,15 +224,49 @@ class App extends React.Component {
       comp = <ValidSession
         handlePlaylist={this.handlePlaylist}
         handleSkip={this.handleSkip}
+        handleVoteSkip={this.handleVoteSkip}
+        handlePause={this.handlePause}
+        handleVolume={this.handleVolume}
+        handleShuffle={this.handleShuffle}
+        handleLoop={this.handleLoop}
+        handleAmbience={this.handleAmbience}
+        handleAmbienceVolume={this.handleAmbienceVolume}
+        handleSetScene={this.handleSetScene}
+        handleSaveScene={this.handleSaveScene}
+        handleDeleteScene={this.handleDeleteScene}
+        handleCombat={this.handleCombat}
+        handlePlayEffect={this.handlePlayEffect}
+        handleAddEffect={this.handleAddEffect}
+        handleUploadEffect={this.handleUploadEffect}
+        handleDucking={this.handleDucking}
 
         playlists={this.state.playlists}
+        paused={this.state.paused}
+        volume={this.state.volume}
+        shuffle={this.state.shuffle}
+        loop={this.state.loop}
+        ambience={this.state.ambience}
+        ambience_volume={this.state.ambience_volume}
+        scenes={this.state.scenes}
+        scene={this.state.scene}
+        combat={this.state.combat}
+        combat_playlist={this.state.combat_playlist}
+        effects={this.state.effects}
+        ducking={this.state.ducking}
         playing={this.state.playing}
+        skip_votes={this.state.skip_votes}
+        skip_votes_needed={this.state.skip_votes_needed}
         current_playlist={this.state.current_playlist}
       />
     }
 
     return (
       <div className="App">
+        { this.state.error &&
+          <div className="App-Error" onClick={() => this.setState({ error: "" })}>
+            { this.state.error }
+          </div>
+        }
         { comp }
       </div>
     );
@@ -6,10 +6,8 @@ function InvalidSession(props) {
     <header className="InvalidSession-header">
       <div className="InvalidSession">
         <p>
-          Your password is:&nbsp;
-            <span className="InvalidSession-password">
-              {props.password}
-            </span>
+          Use <span className="InvalidSession-password">;ui</span> in discord
+          to get a link to log in with.
         </p>
       </div>
     </header>
@@ -1,6 +1,58 @@
 import React from 'react';
 import _ from 'lodash';
 
+function Ambience(props) {
+  if (!props.ambience) {
+    return null;
+  }
+
+  return (
+    <div className="Player-Ambience">
+      <span className="Player-Text">Ambience: </span>
+      <span className="Player-Name">{props.ambience.name}&nbsp;</span>
+      <input
+          type="range"
+          className="Player-Volume"
+          min="0"
+          max="200"
+          value={props.ambience_volume}
+          title={props.ambience_volume + "%"}
+          onChange={(ev) => { props.handleAmbienceVolume(parseInt(ev.target.value, 10)) }}
+      />
+      <button
+          type="button"
+          className="Player-AmbienceStop"
+          onClick={() => { props.handleAmbience("off") }}>
+        x
+      </button>
+    </div>
+  );
+}
+
+function Combat(props) {
+  const title = props.combat ?
+    "go back to the music from before combat" :
+    "switch to " + (props.combat_playlist || "combat music");
+
+  return (
+    <button
+        type="button"
+        className={props.combat ? "Player-CombatButton Player-InCombat" : "Player-CombatButton"}
+        title={title}
+        onClick={() => { props.handleCombat(props.combat) }}>
+      { props.combat ? "End combat" : "Combat!" }
+    </button>
+  );
+}
+
+// loops is the order the loop button goes through the loop modes.
+const loops = {
+  "auto": { next: "queue", label: "loop: auto", title: "playlists loop, queued tracks play once" },
+  "queue": { next: "one", label: "loop: all", title: "looping the whole queue" },
+  "one": { next: "off", label: "loop: one", title: "repeating the current track" },
+  "off": { next: "auto", label: "loop: off", title: "stopping after the last track" },
+};
+
 function PlayerBar(props) {
   let player = (<div className="Player-Empty"/>);
 
@@ -9,7 +61,18 @@ function PlayerBar(props) {
       < Player
         playing={props.playing}
         current_playlist={props.current_playlist}
+        paused={props.paused}
+        volume={props.volume}
+        shuffle={props.shuffle}
+        loop={props.loop}
+        skip_votes={props.skip_votes}
+        skip_votes_needed={props.skip_votes_needed}
         handleSkip={props.handleSkip}
+        handleVoteSkip={props.handleVoteSkip}
+        handlePause={props.handlePause}
+        handleVolume={props.handleVolume}
+        handleShuffle={props.handleShuffle}
+        handleLoop={props.handleLoop}
       />
     );
   }
@@ -26,7 +89,18 @@ function PlayerBar(props) {
 
   return (
     <div className="PlayerBar">
+      < Combat
+        combat={props.combat}
+        combat_playlist={props.combat_playlist}
+        handleCombat={props.handleCombat}
+      />
       { player }
+      < Ambience
+        ambience={props.ambience}
+        ambience_volume={props.ambience_volume}
+        handleAmbience={props.handleAmbience}
+        handleAmbienceVolume={props.handleAmbienceVolume}
+      />
     </div>
   );
 }
@@ -54,6 +128,9 @@ class Player extends React.Component {
           <span className="Player-TrackName">{track.name}&nbsp;</span>
           <span className="Player-TrackSep"> - </span> 
           <span className="Player-TrackArtist">{track.artist}</span>
+          { track.requester &&
+            <span className="Player-TrackRequester"> (added by {track.requester.name})</span>
+          }
         </div>
       );
     });
@@ -72,6 +149,13 @@ class Player extends React.Component {
             <span className="Player-Artist">{this.props.playing.artist}</span>
           </div>
 
+          <button
+              type="button"
+              className="Player-PauseButton"
+              onClick={() => { this.props.handlePause(this.props.paused) }}>
+            { this.props.paused ? "|>" : "||" }
+          </button>
+
           <button
               type="button"
               className="Player-SkipButton"
@@ -79,6 +163,42 @@ class Player extends React.Component {
             >>
           </button>
 
+          <button
+              type="button"
+              className={this.props.skip_votes > 0 ? "Player-VoteSkipButton Player-Voting" : "Player-VoteSkipButton"}
+              title="vote to skip, the track is skipped once enough listeners have voted"
+              onClick={() => { this.props.handleVoteSkip() }}>
+            { this.props.skip_votes_needed > 0 ?
+              "vote skip " + this.props.skip_votes + "/" + this.props.skip_votes_needed :
+              "vote skip" }
+          </button>
+
+          <button
+              type="button"
+              className={this.props.shuffle ? "Player-ShuffleButton Player-Shuffling" : "Player-ShuffleButton"}
+              title={this.props.shuffle ? "shuffle is on" : "shuffle is off"}
+              onClick={() => { this.props.handleShuffle(!this.props.shuffle) }}>
+            shuffle
+          </button>
+
+          <button
+              type="button"
+              className={this.props.loop === "auto" ? "Player-LoopButton" : "Player-LoopButton Player-Looping"}
+              title={(loops[this.props.loop] || loops.auto).title}
+              onClick={() => { this.props.handleLoop((loops[this.props.loop] || loops.auto).next) }}>
+            {(loops[this.props.loop] || loops.auto).label}
+          </button>
+
+          <input
+              type="range"
+              className="Player-Volume"
+              min="0"
+              max="200"
+              value={this.props.volume}
+              title={this.props.volume + "%"}
+              onChange={(ev) => { this.props.handleVolume(parseInt(ev.target.value, 10)) }}
+          />
+
           <div className="Player-PopUp">
             <button
               type="button"
@@ -0,0 +1,62 @@
+import React from 'react';
+import _ from 'lodash';
+
+class Scenes extends React.Component {
+  constructor(props) {
+    super(props);
+    this.state = { name: "" };
+  }
+
+  save() {
+    if (this.state.name === "") {
+      return;
+    }
+    this.props.handleSaveScene(this.state.name);
+    this.setState({ name: "" });
+  }
+
+  render() {
+    const scenes = _.map(this.props.scenes, (sc) => {
+      const current = sc.name === this.props.scene;
+      return (
+        <span className="Scenes-Scene" key={sc.name}>
+          <button
+              type="button"
+              className={current ? "Scenes-Button Scenes-Current" : "Scenes-Button"}
+              title={sc.playlist || "no music"}
+              onClick={() => { this.props.handleSetScene(sc.name) }}>
+            {sc.name}
+          </button>
+          <a
+              className="Scenes-Delete"
+              title={"delete " + sc.name}
+              onClick={() => { this.props.handleDeleteScene(sc.name) }}>
+            x
+          </a>
+        </span>
+      );
+    });
+
+    return (
+      <div className="Scenes">
+        <h4 className="Scenes-Title"> Scenes </h4>
+        <div className="Scenes-List">
+          { scenes }
+        </div>
+        <div className="Scenes-Save">
+          <input
+              type="text"
+              placeholder="scene name"
+              value={this.state.name}
+              onChange={(ev) => { this.setState({ name: ev.target.value }) }}
+          />
+          <button type="button" onClick={() => { this.save() }}>
+            save what's playing
+          </button>
+        </div>
+      </div>
+    );
+  }
+}
+
+export default Scenes;
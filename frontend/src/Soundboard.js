@@ -0,0 +1,95 @@
+import React from 'react';
+import _ from 'lodash';
+
+class Soundboard extends React.Component {
+  constructor(props) {
+    super(props);
+    this.state = {
+      name: "",
+      url: "",
+      file: null,
+      error: "",
+    };
+  }
+
+  add() {
+    const name = this.state.name;
+    if (name === "") {
+      this.setState({ error: "give the effect a name" });
+      return;
+    }
+
+    if (this.state.file) {
+      this.props.handleUploadEffect(name, this.state.file)
+        .then(() => { this.setState({ name: "", file: null, error: "" }); })
+        .catch((err) => { this.setState({ error: err.message }); });
+      return;
+    }
+
+    if (this.state.url !== "") {
+      this.props.handleAddEffect(name, this.state.url);
+      this.setState({ name: "", url: "", error: "" });
+      return;
+    }
+
+    this.setState({ error: "pick a file or give a url" });
+  }
+
+  render() {
+    const effects = _.map(this.props.effects, (e) => {
+      return (
+        <button
+            type="button"
+            key={e.name}
+            className="Soundboard-Effect"
+            title={e.source}
+            onClick={() => { this.props.handlePlayEffect(e.name) }}>
+          {e.name}
+        </button>
+      );
+    });
+
+    return (
+      <div className="Soundboard">
+        <h4 className="Soundboard-Title"> Sound effects </h4>
+        <div className="Soundboard-Effects">
+          { effects }
+        </div>
+
+        <div className="Soundboard-Add">
+          <input
+              type="text"
+              placeholder="name"
+              value={this.state.name}
+              onChange={(ev) => { this.setState({ name: ev.target.value }) }}
+          />
+          <input
+              type="text"
+              placeholder="url"
+              value={this.state.url}
+              onChange={(ev) => { this.setState({ url: ev.target.value }) }}
+          />
+          <input
+              type="file"
+              accept="audio/*,video/*"
+              onChange={(ev) => { this.setState({ file: ev.target.files[0] }) }}
+          />
+          <button type="button" onClick={() => { this.add() }}>
+            add
+          </button>
+          <label className="Soundboard-Duck">
+            <input
+                type="checkbox"
+                checked={!!this.props.ducking}
+                onChange={(ev) => { this.props.handleDucking(ev.target.checked) }}
+            />
+            duck the music
+          </label>
+          <span className="Soundboard-Error">{this.state.error}</span>
+        </div>
+      </div>
+    );
+  }
+}
+
+export default Soundboard;
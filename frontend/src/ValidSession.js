@@ -1,6 +1,8 @@
 import React from 'react';
 import _ from 'lodash';
 import PlayerBar from './Player.js';
+import Scenes from './Scenes.js';
+import Soundboard from './Soundboard.js';
 
 function Playlist(props) {
   const playList = _.map(props.playlists, (pl) => {
@@ -10,6 +12,12 @@ function Playlist(props) {
           <a key={pl.url} onClick={() => { props.handlePlaylist(pl.title); }} className="Playlist-Link">
             {pl.title}
           </a>
+          <a
+            onClick={() => { props.handleAmbience(pl.title); }}
+            className="Playlist-AmbienceLink"
+            title="Loop under the music">
+            &nbsp;~
+          </a>
         </p>
       </div>
     );
@@ -41,7 +49,13 @@ class PlaylistCategory extends React.Component {
     // <img className="Playlist-img" alt="album art" src={pl.album_art}/>
     let playlist = ( <br/> )
     if (this.state.show) {
-      playlist = (<Playlist handlePlaylist={this.props.handlePlaylist} playlists={this.props.playlists}/>)
+      playlist = (
+        <Playlist
+          handlePlaylist={this.props.handlePlaylist}
+          handleAmbience={this.props.handleAmbience}
+          playlists={this.props.playlists}
+        />
+      )
     }
 
     return (
@@ -68,18 +82,51 @@ function ValidSession(props) {
   console.log(categorys)
 
   const playlists = _.map(categorys, (k, v) => {
-    return <PlaylistCategory handlePlaylist={props.handlePlaylist} name={v} playlists={k} />
+    return <PlaylistCategory handlePlaylist={props.handlePlaylist} handleAmbience={props.handleAmbience} name={v} playlists={k} />
   });
 
   console.log(playlists);
 
   return (
     <div className="ValidSession-body">
+      < Scenes
+        scenes={props.scenes}
+        scene={props.scene}
+        handleSetScene={props.handleSetScene}
+        handleSaveScene={props.handleSaveScene}
+        handleDeleteScene={props.handleDeleteScene}
+      />
       { playlists }
+      < Soundboard
+        effects={props.effects}
+        ducking={props.ducking}
+        handlePlayEffect={props.handlePlayEffect}
+        handleAddEffect={props.handleAddEffect}
+        handleUploadEffect={props.handleUploadEffect}
+        handleDucking={props.handleDucking}
+      />
       < PlayerBar
         playing={props.playing}
         current_playlist={props.current_playlist}
+        paused={props.paused}
+        volume={props.volume}
+        shuffle={props.shuffle}
+        loop={props.loop}
+        skip_votes={props.skip_votes}
+        skip_votes_needed={props.skip_votes_needed}
         handleSkip={props.handleSkip}
+        handleVoteSkip={props.handleVoteSkip}
+        handlePause={props.handlePause}
+        handleVolume={props.handleVolume}
+        handleShuffle={props.handleShuffle}
+        handleLoop={props.handleLoop}
+        ambience={props.ambience}
+        ambience_volume={props.ambience_volume}
+        handleAmbience={props.handleAmbience}
+        handleAmbienceVolume={props.handleAmbienceVolume}
+        combat={props.combat}
+        combat_playlist={props.combat_playlist}
+        handleCombat={props.handleCombat}
       />
     </div>
   );
@@ -3,12 +3,11 @@ module github.com/devoxel/dndmusic
 go 1.14
 
 require (
-	github.com/bwmarrin/discordgo v0.22.1-0.20201217190221-8d6815dde7ed
+	github.com/bwmarrin/discordgo v0.25.0
 	github.com/google/go-cmp v0.5.4
 	github.com/gorilla/sessions v1.2.1
-	github.com/gorilla/websocket v1.4.0
+	github.com/gorilla/websocket v1.4.2
 	github.com/jonas747/dca v0.0.0-20200609191102-fe85ccf0947a
 	github.com/jonas747/ogg v0.0.0-20161220051205-b4f6f4cf3757
 	github.com/layeh/gopus v0.0.0-20161224163843-0ebf989153aa
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2 // indirect
 )